@@ -0,0 +1,90 @@
+package main
+
+import (
+    "log"
+    "net"
+    "strings"
+)
+
+// getCIDRListEnv parses a comma-separated list of CIDRs or bare IPs. Invalid
+// entries are skipped with a warning.
+func getCIDRListEnv(key string) []*net.IPNet {
+    var nets []*net.IPNet
+    for _, entry := range getListEnv(key, "") {
+        if !strings.Contains(entry, "/") {
+            if ip := net.ParseIP(entry); ip != nil {
+                if ip4 := ip.To4(); ip4 != nil {
+                    entry += "/32"
+                } else {
+                    entry += "/128"
+                }
+            }
+        }
+        _, ipNet, err := net.ParseCIDR(entry)
+        if err != nil {
+            log.Printf("Warning: Invalid CIDR in %s: %s", key, entry)
+            continue
+        }
+        nets = append(nets, ipNet)
+    }
+    return nets
+}
+
+// clientIP extracts the client IP from a remote address, reporting
+// IPv4-mapped IPv6 addresses (::ffff:1.2.3.4) from dual-stack listeners as
+// plain IPv4 so they match IPv4 rules. It returns nil if addr has no IP.
+func clientIP(addr net.Addr) net.IP {
+    var ip net.IP
+    switch a := addr.(type) {
+    case *net.UDPAddr:
+        ip = a.IP
+    case *net.TCPAddr:
+        ip = a.IP
+    case nil:
+        return nil
+    default:
+        host, _, err := net.SplitHostPort(addr.String())
+        if err != nil {
+            host = addr.String()
+        }
+        ip = net.ParseIP(host)
+    }
+    if ip4 := ip.To4(); ip4 != nil {
+        return ip4
+    }
+    return ip
+}
+
+// formatClient renders a remote address for logs, with IPv4-mapped
+// addresses shown as IPv4.
+func formatClient(addr net.Addr) string {
+    if addr == nil {
+        return "unknown"
+    }
+    ip := clientIP(addr)
+    if ip == nil {
+        return addr.String()
+    }
+    if _, port, err := net.SplitHostPort(addr.String()); err == nil {
+        return net.JoinHostPort(ip.String(), port)
+    }
+    return ip.String()
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+    for _, n := range nets {
+        if n.Contains(ip) {
+            return true
+        }
+    }
+    return false
+}
+
+// clientAllowed checks the client against ALLOWED_CLIENTS. An empty list
+// allows everyone.
+func (c *Config) clientAllowed(ip net.IP) bool {
+    if len(c.AllowedClients) == 0 {
+        return true
+    }
+    return ip != nil && containsIP(c.AllowedClients, ip)
+}
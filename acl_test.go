@@ -0,0 +1,44 @@
+package main
+
+import (
+    "net"
+    "testing"
+
+    "github.com/miekg/dns"
+)
+
+func TestClientIPUnmapsIPv4(t *testing.T) {
+    mapped := net.ParseIP("::ffff:10.1.2.3")
+    for _, addr := range []net.Addr{
+        &net.UDPAddr{IP: mapped, Port: 5353},
+        &net.TCPAddr{IP: mapped, Port: 5353},
+    } {
+        ip := clientIP(addr)
+        if len(ip) != net.IPv4len || !ip.Equal(net.IPv4(10, 1, 2, 3)) {
+            t.Errorf("clientIP(%v) = %v, want the IPv4 10.1.2.3", addr, ip)
+        }
+    }
+    if got := formatClient(&net.UDPAddr{IP: mapped, Port: 5353}); got != "10.1.2.3:5353" {
+        t.Errorf("formatClient = %s, want 10.1.2.3:5353", got)
+    }
+}
+
+func TestAllowedClientsMatchMappedAddress(t *testing.T) {
+    p := testProxy(t, "ALLOWED_CLIENTS", "10.0.0.0/8", "HOST_INTERNAL_IP", "192.0.2.1")
+    for _, tt := range []struct {
+        client string
+        want   int
+    }{
+        {"::ffff:10.1.2.3", dns.RcodeSuccess},
+        {"10.1.2.3", dns.RcodeSuccess},
+        {"::ffff:192.168.1.1", dns.RcodeRefused},
+        {"fd00::1", dns.RcodeRefused},
+    } {
+        r := new(dns.Msg)
+        r.SetQuestion(hostInternalName, dns.TypeA)
+        m := queryFrom(p, &net.UDPAddr{IP: net.ParseIP(tt.client), Port: 5353}, r)
+        if m == nil || m.Rcode != tt.want {
+            t.Errorf("client %s got %v, want %s", tt.client, m, dns.RcodeToString[tt.want])
+        }
+    }
+}
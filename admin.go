@@ -0,0 +1,147 @@
+package main
+
+import (
+    "crypto/subtle"
+    "encoding/json"
+    "io"
+    "net/http"
+    "strconv"
+    "strings"
+    "sync/atomic"
+    "time"
+
+    "github.com/miekg/dns"
+)
+
+// adminHandler serves the operator endpoints on ADMIN_ADDR.
+func (p *DNSProxy) adminHandler() http.Handler {
+    mux := http.NewServeMux()
+    mux.HandleFunc("/cache/flush", p.requireToken(http.MethodPost, p.handleCacheFlush))
+    mux.HandleFunc("/loglevel", p.requireToken(http.MethodPost, p.handleLogLevel))
+    mux.HandleFunc("/maintenance", p.requireToken(http.MethodPost, p.handleMaintenance))
+    mux.HandleFunc("/upstream", p.requireToken(http.MethodPost, p.handleUpstream))
+    mux.HandleFunc("/status", p.requireToken(http.MethodGet, p.handleStatus))
+    mux.HandleFunc("/resolv.conf", p.requireToken(http.MethodGet, p.handleResolvConf))
+    mux.HandleFunc("/clients", p.requireToken(http.MethodGet, p.handleClients))
+    return mux
+}
+
+// requireToken restricts a handler to the given method and to requests
+// carrying the configured ADMIN_TOKEN as a bearer token.
+func (p *DNSProxy) requireToken(method string, next http.HandlerFunc) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        if r.Method != method {
+            w.Header().Set("Allow", method)
+            http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+            return
+        }
+
+        token := p.config().AdminToken
+        if token == "" {
+            http.Error(w, "admin token not configured", http.StatusForbidden)
+            return
+        }
+        given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+        if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+            http.Error(w, "unauthorized", http.StatusUnauthorized)
+            return
+        }
+        next(w, r)
+    }
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(v)
+}
+
+// handleCacheFlush drops every cached answer, or only those for ?name=.
+func (p *DNSProxy) handleCacheFlush(w http.ResponseWriter, r *http.Request) {
+    var flushed int
+    if name := r.URL.Query().Get("name"); name != "" {
+        name = strings.ToLower(dns.Fqdn(name))
+        flushed = p.cache.flushName(name)
+        p.logInfo("Flushed %d cache entries for %s", flushed, name)
+    } else {
+        flushed = p.cache.flush()
+        p.logInfo("Flushed all %d cache entries", flushed)
+    }
+    writeJSON(w, map[string]int{"flushed": flushed})
+}
+
+// handleLogLevel changes the log level to ?level= until the next reload.
+func (p *DNSProxy) handleLogLevel(w http.ResponseWriter, r *http.Request) {
+    if err := p.setLevel(r.URL.Query().Get("level")); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    writeJSON(w, map[string]string{"level": p.level()})
+}
+
+// handleMaintenance turns maintenance mode on or off with ?enabled=.
+func (p *DNSProxy) handleMaintenance(w http.ResponseWriter, r *http.Request) {
+    enabled, err := strconv.ParseBool(r.URL.Query().Get("enabled"))
+    if err != nil {
+        http.Error(w, "enabled must be true or false", http.StatusBadRequest)
+        return
+    }
+    p.setMaintenance(enabled)
+    writeJSON(w, map[string]bool{"maintenance": p.inMaintenance()})
+}
+
+// handleUpstream turns upstream forwarding on or off with ?enabled=, e.g. to
+// cut off external resolution during an incident.
+func (p *DNSProxy) handleUpstream(w http.ResponseWriter, r *http.Request) {
+    enabled, err := strconv.ParseBool(r.URL.Query().Get("enabled"))
+    if err != nil {
+        http.Error(w, "enabled must be true or false", http.StatusBadRequest)
+        return
+    }
+    p.setUpstream(enabled)
+    writeJSON(w, map[string]bool{"upstream": p.upstreamEnabled()})
+}
+
+// upstreamInflight returns the queries currently outstanding per upstream.
+func (p *DNSProxy) upstreamInflight() map[string]int {
+    inflight := make(map[string]int)
+    for _, upstream := range p.config().allUpstreams() {
+        inflight[upstream] = p.inflight.current(upstream)
+    }
+    return inflight
+}
+
+// handleStatus reports process start time, uptime and basic counters, to
+// help correlate restarts with incidents.
+func (p *DNSProxy) handleStatus(w http.ResponseWriter, r *http.Request) {
+    uptime := time.Since(p.started)
+    writeJSON(w, map[string]interface{}{
+        "started":        p.started.UTC().Format(time.RFC3339),
+        "uptime":         uptime.Truncate(time.Second).String(),
+        "uptime_seconds": int64(uptime / time.Second),
+        "queries":        atomic.LoadInt64(&p.queryCount),
+        "errors":         atomic.LoadInt64(&p.errorCount),
+        "rate_limited":   atomic.LoadInt64(&p.rateLimitedCount),
+        "log_level":      p.level(),
+        "maintenance":    p.inMaintenance(),
+        "upstream":       p.upstreamEnabled(),
+        "cache":          p.cache.statsByType(),
+        "inflight":       p.upstreamInflight(),
+    })
+}
+
+// handleClients lists the clients sending the most queries, busiest first,
+// when TOP_CLIENTS is set.
+func (p *DNSProxy) handleClients(w http.ResponseWriter, r *http.Request) {
+    n := p.config().TopClients
+    if n <= 0 {
+        http.Error(w, "TOP_CLIENTS is not set", http.StatusNotFound)
+        return
+    }
+    writeJSON(w, map[string]interface{}{"clients": p.topClients.top(n)})
+}
+
+// handleResolvConf serves a resolv.conf snippet for clients of this proxy.
+func (p *DNSProxy) handleResolvConf(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+    io.WriteString(w, p.config().resolvConf())
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+    "encoding/json"
+    "net"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/miekg/dns"
+)
+
+const testAdminToken = "secret"
+
+// adminRequest sends a request with the test admin token to the admin API.
+func adminRequest(p *DNSProxy, method, target string) *httptest.ResponseRecorder {
+    req := httptest.NewRequest(method, target, nil)
+    req.Header.Set("Authorization", "Bearer "+testAdminToken)
+    w := httptest.NewRecorder()
+    p.adminHandler().ServeHTTP(w, req)
+    return w
+}
+
+// cacheAnswer stores an A record for name in the cache of p.
+func cacheAnswer(p *DNSProxy, name string, qtype uint16) cacheKey {
+    m := new(dns.Msg)
+    m.SetQuestion(name, qtype)
+    rr, _ := dns.NewRR(name + " 60 IN A 10.0.0.1")
+    m.Answer = append(m.Answer, rr)
+    key := cacheKey{name: name, qtype: qtype, qclass: dns.ClassINET}
+    p.cache.set(key, m, time.Now())
+    return key
+}
+
+func TestAdminCacheFlushName(t *testing.T) {
+    p := testProxy(t, "CACHE_ENABLED", "true", "ADMIN_TOKEN", testAdminToken)
+    web := cacheAnswer(p, "web.docker.", dns.TypeA)
+    webMX := cacheAnswer(p, "web.docker.", dns.TypeMX)
+    db := cacheAnswer(p, "db.docker.", dns.TypeA)
+
+    w := adminRequest(p, http.MethodPost, "/cache/flush?name=WEB.docker")
+    if w.Code != http.StatusOK {
+        t.Fatalf("status %d: %s", w.Code, w.Body)
+    }
+    var body map[string]int
+    if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || body["flushed"] != 2 {
+        t.Errorf("response %s, want 2 flushed", w.Body)
+    }
+    if p.cache.get(web) != nil || p.cache.get(webMX) != nil {
+        t.Error("web.docker. still cached after flushing it")
+    }
+    if p.cache.get(db) == nil {
+        t.Error("db.docker. flushed along with web.docker.")
+    }
+
+    adminRequest(p, http.MethodPost, "/cache/flush")
+    if n := p.cache.len(); n != 0 {
+        t.Errorf("%d entries left after flushing all", n)
+    }
+}
+
+func TestAdminRequiresToken(t *testing.T) {
+    p := testProxy(t, "ADMIN_TOKEN", testAdminToken)
+    for _, tt := range []struct {
+        method, auth string
+        want         int
+    }{
+        {http.MethodPost, "Bearer " + testAdminToken, http.StatusOK},
+        {http.MethodPost, "Bearer wrong", http.StatusUnauthorized},
+        {http.MethodPost, "", http.StatusUnauthorized},
+        {http.MethodGet, "Bearer " + testAdminToken, http.StatusMethodNotAllowed},
+    } {
+        req := httptest.NewRequest(tt.method, "/cache/flush", nil)
+        if tt.auth != "" {
+            req.Header.Set("Authorization", tt.auth)
+        }
+        w := httptest.NewRecorder()
+        p.adminHandler().ServeHTTP(w, req)
+        if w.Code != tt.want {
+            t.Errorf("%s with %q: status %d, want %d", tt.method, tt.auth, w.Code, tt.want)
+        }
+    }
+}
+
+func TestLogLevelChanges(t *testing.T) {
+    p := testProxy(t, "LOG_LEVEL", "INFO", "ADMIN_TOKEN", testAdminToken)
+    logs := captureLog(t)
+
+    p.logDebug("debug line 1")
+    if w := adminRequest(p, http.MethodPost, "/loglevel?level=debug"); w.Code != http.StatusOK {
+        t.Fatalf("status %d: %s", w.Code, w.Body)
+    }
+    p.logDebug("debug line 2")
+    p.toggleDebug()
+    p.logDebug("debug line 3")
+    p.toggleDebug()
+    p.logDebug("debug line 4")
+
+    out := logs.String()
+    for line, want := range map[string]bool{"debug line 1": false, "debug line 2": true, "debug line 3": false, "debug line 4": true} {
+        if got := strings.Contains(out, "[DEBUG] "+line); got != want {
+            t.Errorf("%q logged %v, want %v", line, got, want)
+        }
+    }
+
+    if w := adminRequest(p, http.MethodPost, "/loglevel?level=verbose"); w.Code != http.StatusBadRequest {
+        t.Errorf("unknown level: status %d, want %d", w.Code, http.StatusBadRequest)
+    }
+    if level := p.level(); level != "DEBUG" {
+        t.Errorf("level %s after an unknown level, want DEBUG unchanged", level)
+    }
+}
+
+func TestAdminStatusUptime(t *testing.T) {
+    p := testProxy(t, "ADMIN_TOKEN", testAdminToken)
+    read := func() (started string, uptime int64) {
+        t.Helper()
+        w := adminRequest(p, http.MethodGet, "/status")
+        var status struct {
+            Started string `json:"started"`
+            Uptime  int64  `json:"uptime_seconds"`
+        }
+        if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+            t.Fatalf("status %s: %v", w.Body, err)
+        }
+        return status.Started, status.Uptime
+    }
+
+    started1, uptime1 := read()
+    time.Sleep(1100 * time.Millisecond)
+    started2, uptime2 := read()
+    if uptime2 <= uptime1 {
+        t.Errorf("uptime went from %ds to %ds, want it to increase", uptime1, uptime2)
+    }
+    if started1 != started2 {
+        t.Errorf("start time changed from %s to %s", started1, started2)
+    }
+    if _, err := time.Parse(time.RFC3339, started1); err != nil {
+        t.Errorf("start time %q is not RFC 3339: %v", started1, err)
+    }
+}
+
+func TestAdminUpstreamToggle(t *testing.T) {
+    upstream := fakeDNS(t, answerA("192.0.2.1"))
+    p := testProxy(t, "ENABLE_UPSTREAM", "true", "UPSTREAM_DNS", upstream, "ADMIN_TOKEN", testAdminToken)
+
+    if ip := answerIP(query(p, "example.com.", dns.TypeA)); ip != "192.0.2.1" {
+        t.Fatalf("answer %q with upstream on, want 192.0.2.1", ip)
+    }
+    if w := adminRequest(p, http.MethodPost, "/upstream?enabled=false"); w.Code != http.StatusOK {
+        t.Fatalf("status %d: %s", w.Code, w.Body)
+    }
+    if m := query(p, "example.com.", dns.TypeA); m.Rcode != dns.RcodeNameError || len(m.Answer) != 0 {
+        t.Errorf("got %s with %d answers with upstream off, want NXDOMAIN", dns.RcodeToString[m.Rcode], len(m.Answer))
+    }
+    adminRequest(p, http.MethodPost, "/upstream?enabled=true")
+    if ip := answerIP(query(p, "example.com.", dns.TypeA)); ip != "192.0.2.1" {
+        t.Errorf("answer %q with upstream back on, want 192.0.2.1", ip)
+    }
+    if w := adminRequest(p, http.MethodPost, "/upstream?enabled=maybe"); w.Code != http.StatusBadRequest {
+        t.Errorf("enabled=maybe: status %d, want %d", w.Code, http.StatusBadRequest)
+    }
+}
+
+func TestAdminResolvConf(t *testing.T) {
+    p := testProxy(t, "ADMIN_TOKEN", testAdminToken,
+        "LISTEN_ADDR", "10.1.2.3", "LISTEN_PORT", "53", "STRIP_SUFFIX", ".docker,.internal")
+    w := adminRequest(p, http.MethodGet, "/resolv.conf")
+    if w.Code != http.StatusOK {
+        t.Fatalf("got %d, want 200", w.Code)
+    }
+    body := w.Body.String()
+    for _, line := range []string{"nameserver 10.1.2.3\n", "search docker internal\n", "options ndots:1\n"} {
+        if !strings.Contains(body, line) {
+            t.Errorf("snippet has no %q:\n%s", line, body)
+        }
+    }
+
+    p = testProxy(t, "ADMIN_TOKEN", testAdminToken, "LISTEN_ADDR", "0.0.0.0", "LISTEN_PORT", "5353")
+    body = adminRequest(p, http.MethodGet, "/resolv.conf").Body.String()
+    for _, line := range []string{"nameserver 127.0.0.1\n", "port 5353", "replace with an address clients can reach"} {
+        if !strings.Contains(body, line) {
+            t.Errorf("snippet on 0.0.0.0:5353 has no %q:\n%s", line, body)
+        }
+    }
+}
+
+func TestAdminTopClients(t *testing.T) {
+    p := testProxy(t, "ADMIN_TOKEN", testAdminToken, "TOP_CLIENTS", "2", "HOST_INTERNAL_IP", "192.0.2.1")
+    ask := func(ip net.IP) {
+        r := new(dns.Msg)
+        r.SetQuestion(hostInternalName, dns.TypeA)
+        queryFrom(p, &net.UDPAddr{IP: ip, Port: 40000}, r)
+    }
+    heavy := net.IPv4(10, 9, 9, 9)
+    for i := 0; i < 200; i++ {
+        // One heavy client among many sending a query each
+        ask(net.IPv4(10, 1, byte(i/250), byte(i%250+1)))
+        if i%4 == 0 {
+            ask(heavy)
+        }
+    }
+
+    w := adminRequest(p, http.MethodGet, "/clients")
+    if w.Code != http.StatusOK {
+        t.Fatalf("got %d, want 200", w.Code)
+    }
+    var body struct {
+        Clients []clientCount `json:"clients"`
+    }
+    if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+        t.Fatal(err)
+    }
+    if len(body.Clients) != 2 {
+        t.Fatalf("got %v, want the top 2 clients", body.Clients)
+    }
+    if top := body.Clients[0]; top.Client != heavy.String() || top.Queries < 50 {
+        t.Errorf("busiest client %v, want %s with at least its 50 queries", top, heavy)
+    }
+
+    p.topClients.mu.Lock()
+    tracked := len(p.topClients.counts)
+    p.topClients.mu.Unlock()
+    if tracked > 2*topClientsSlack {
+        t.Errorf("%d clients tracked, want at most %d", tracked, 2*topClientsSlack)
+    }
+}
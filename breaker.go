@@ -0,0 +1,107 @@
+package main
+
+import (
+    "sync"
+    "time"
+)
+
+type breakerState int
+
+const (
+    breakerClosed breakerState = iota
+    breakerOpen
+    breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+    switch s {
+    case breakerOpen:
+        return "open"
+    case breakerHalfOpen:
+        return "half-open"
+    }
+    return "closed"
+}
+
+// circuitBreaker stops queries to an upstream after repeated failures. Once
+// the open period has passed a single probe query is let through, and its
+// outcome decides whether the breaker closes again or reopens.
+type circuitBreaker struct {
+    mu       sync.Mutex
+    state    breakerState
+    failures int
+    openedAt time.Time
+    probing  bool
+}
+
+func (b *circuitBreaker) allow(now time.Time, openFor time.Duration) bool {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+
+    switch b.state {
+    case breakerOpen:
+        if now.Sub(b.openedAt) < openFor {
+            return false
+        }
+        b.state = breakerHalfOpen
+        b.probing = true
+        return true
+    case breakerHalfOpen:
+        if b.probing {
+            return false
+        }
+        b.probing = true
+        return true
+    }
+    return true
+}
+
+func (b *circuitBreaker) success() {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+
+    b.state = breakerClosed
+    b.failures = 0
+    b.probing = false
+}
+
+func (b *circuitBreaker) failure(now time.Time, threshold int) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+
+    b.failures++
+    b.probing = false
+    if b.state == breakerHalfOpen || b.failures >= threshold {
+        b.state = breakerOpen
+        b.openedAt = now
+    }
+}
+
+// release hands back a probe slot taken by allow when the probe query is
+// never answered, so the next query can probe instead.
+func (b *circuitBreaker) release() {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+
+    b.probing = false
+}
+
+func (b *circuitBreaker) current() breakerState {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+
+    return b.state
+}
+
+// breaker returns the circuit breaker for upstream, creating it on first use.
+func (p *DNSProxy) breaker(upstream string) *circuitBreaker {
+    p.breakersMu.Lock()
+    defer p.breakersMu.Unlock()
+
+    b, ok := p.breakers[upstream]
+    if !ok {
+        b = &circuitBreaker{}
+        p.breakers[upstream] = b
+    }
+    return b
+}
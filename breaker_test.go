@@ -0,0 +1,124 @@
+package main
+
+import (
+    "sync/atomic"
+    "testing"
+    "time"
+
+    "github.com/miekg/dns"
+)
+
+func TestBreakerHalfOpenProbe(t *testing.T) {
+    b := &circuitBreaker{}
+    now := time.Now()
+    b.failure(now, 1)
+    if b.allow(now, time.Minute) {
+        t.Fatal("open breaker allowed a query")
+    }
+    later := now.Add(2 * time.Minute)
+    if !b.allow(later, time.Minute) {
+        t.Fatal("breaker did not let a probe through after the open period")
+    }
+    if b.allow(later, time.Minute) {
+        t.Fatal("breaker let a second probe through")
+    }
+    b.release()
+    if !b.allow(later, time.Minute) {
+        t.Fatal("released probe slot was not handed to the next query")
+    }
+    b.success()
+    if b.current() != breakerClosed {
+        t.Fatalf("got %s after a successful probe, want closed", b.current())
+    }
+}
+
+// A probe skipped because the upstream is at UPSTREAM_MAX_INFLIGHT must not
+// keep the breaker half-open for good.
+func TestBreakerProbeReleasedWhenBusy(t *testing.T) {
+    upstream := fakeDNS(t, answerA("192.0.2.1"))
+    p := testProxy(t, "ENABLE_UPSTREAM", "true", "UPSTREAM_DNS", upstream,
+        "BREAKER_THRESHOLD", "1", "BREAKER_OPEN_SECONDS", "1", "UPSTREAM_MAX_INFLIGHT", "1")
+
+    p.breaker(upstream).failure(time.Now().Add(-time.Hour), 1)
+    p.inflight.acquire(upstream, 1)
+    if m := query(p, "busy.example.", dns.TypeA); m.Rcode != dns.RcodeServerFailure {
+        t.Fatalf("got %s while the upstream is at its in-flight cap, want SERVFAIL", dns.RcodeToString[m.Rcode])
+    }
+    p.inflight.release(upstream)
+
+    m := query(p, "free.example.", dns.TypeA)
+    if m.Rcode != dns.RcodeSuccess || len(m.Answer) != 1 {
+        t.Fatalf("got %s with %d answers once the upstream is free, want an answer", dns.RcodeToString[m.Rcode], len(m.Answer))
+    }
+    if state := p.breaker(upstream).current(); state != breakerClosed {
+        t.Fatalf("breaker is %s after a successful probe, want closed", state)
+    }
+}
+
+// flakyDNS answers A queries, or garbage that fails the exchange while
+// failing is set, and counts the queries it got.
+func flakyDNS(t *testing.T, ip string, failing *int32, count *int64) string {
+    return fakeDNS(t, func(w dns.ResponseWriter, r *dns.Msg) {
+        atomic.AddInt64(count, 1)
+        if atomic.LoadInt32(failing) != 0 {
+            w.Write([]byte{0, 1, 2})
+            return
+        }
+        answerA(ip)(w, r)
+    })
+}
+
+func TestBreakerSkipsOpenUpstream(t *testing.T) {
+    var failing int32 = 1
+    var first, second int64
+    bad := flakyDNS(t, "192.0.2.1", &failing, &first)
+    good := flakyDNS(t, "192.0.2.2", new(int32), &second)
+    p := testProxy(t, "ENABLE_UPSTREAM", "true", "UPSTREAM_DNS", bad+","+good,
+        "BREAKER_THRESHOLD", "2", "BREAKER_OPEN_SECONDS", "1")
+
+    for i := 0; i < 2; i++ {
+        if ip := answerIP(query(p, "example.com.", dns.TypeA)); ip != "192.0.2.2" {
+            t.Fatalf("query %d answered %q, want the second upstream's 192.0.2.2", i, ip)
+        }
+    }
+    if state := p.breaker(bad).current(); state != breakerOpen {
+        t.Fatalf("breaker %s after 2 failures, want open", state)
+    }
+
+    // Open: the failing upstream isn't even asked
+    query(p, "example.com.", dns.TypeA)
+    if n := atomic.LoadInt64(&first); n != 2 {
+        t.Errorf("open upstream got %d queries, want 2", n)
+    }
+
+    // Half-open after BREAKER_OPEN_SECONDS: one probe, which closes it
+    atomic.StoreInt32(&failing, 0)
+    time.Sleep(1100 * time.Millisecond)
+    if ip := answerIP(query(p, "example.com.", dns.TypeA)); ip != "192.0.2.1" {
+        t.Errorf("probe answered %q, want the recovered 192.0.2.1", ip)
+    }
+    if state := p.breaker(bad).current(); state != breakerClosed {
+        t.Errorf("breaker %s after a successful probe, want closed", state)
+    }
+}
+
+func TestAllBreakersOpenFailFast(t *testing.T) {
+    var first, second int64
+    a := countingDNS(t, 0, &first)
+    b := countingDNS(t, 0, &second)
+    p := testProxy(t, "ENABLE_UPSTREAM", "true", "UPSTREAM_DNS", a+","+b, "BREAKER_THRESHOLD", "1")
+    p.breaker(a).failure(time.Now(), 1)
+    p.breaker(b).failure(time.Now(), 1)
+
+    start := time.Now()
+    m := query(p, "example.com.", dns.TypeA)
+    if took := time.Since(start); took > 100*time.Millisecond {
+        t.Errorf("SERVFAIL took %v with every breaker open", took)
+    }
+    if m == nil || m.Rcode != dns.RcodeServerFailure {
+        t.Errorf("got %v, want SERVFAIL", m)
+    }
+    if n := atomic.LoadInt64(&first) + atomic.LoadInt64(&second); n != 0 {
+        t.Errorf("open upstreams got %d queries", n)
+    }
+}
@@ -0,0 +1,536 @@
+package main
+
+import (
+    "container/heap"
+    "context"
+    "net"
+    "strconv"
+    "sync"
+    "time"
+
+    "github.com/miekg/dns"
+)
+
+// TTL handed out for answers served past their expiry
+const staleAnswerTTL = 30
+
+// Values of CACHE_PREFERENCE
+const (
+    preferFresh  = "fresh"
+    preferCached = "cached"
+)
+
+// prefersCache reports whether client wants a stale cached answer right
+// away rather than waiting for a fresh lookup.
+func (c *Config) prefersCache(client net.IP) bool {
+    if c.CachePreference != preferCached {
+        return false
+    }
+    return len(c.CachePreferenceClients) == 0 || (client != nil && containsIP(c.CachePreferenceClients, client))
+}
+
+type cacheKey struct {
+    name   string
+    qtype  uint16
+    qclass uint16
+}
+
+type cacheEntry struct {
+    // Answers in packed wire form, which takes far less memory than the
+    // unpacked records
+    packed     []byte
+    // EDNS EXPIRE value from the reply, kept so it survives cache hits
+    expire     *uint32
+    stored     time.Time
+    expires    time.Time
+    hits       int
+    refreshing bool
+    // NXDOMAIN cached under NEGATIVE_CACHE_TTL_SECONDS, with the authority
+    // section in packed instead of the answers
+    negative bool
+
+    // The entry's key and position in the cache's expiry heap
+    key   cacheKey
+    index int
+}
+
+// expiryHeap orders cache entries by expiry, soonest first, so eviction and
+// the sweep of expired entries don't have to scan the whole cache.
+type expiryHeap []*cacheEntry
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].expires.Before(h[j].expires) }
+
+func (h expiryHeap) Swap(i, j int) {
+    h[i], h[j] = h[j], h[i]
+    h[i].index, h[j].index = i, j
+}
+
+func (h *expiryHeap) Push(x interface{}) {
+    entry := x.(*cacheEntry)
+    entry.index = len(*h)
+    *h = append(*h, entry)
+}
+
+func (h *expiryHeap) Pop() interface{} {
+    old := *h
+    entry := old[len(old)-1]
+    old[len(old)-1] = nil
+    *h = old[:len(old)-1]
+    return entry
+}
+
+func (e *cacheEntry) fresh(now time.Time) bool {
+    return now.Before(e.expires)
+}
+
+// usableIfError reports whether an expired entry may still be served because
+// the resolver failed and the entry is within the stale-if-error window.
+func (e *cacheEntry) usableIfError(now time.Time, staleTTL time.Duration) bool {
+    return staleTTL > 0 && !e.negative && now.Before(e.expires.Add(staleTTL))
+}
+
+// packAnswers packs answers into a message body for storage in the cache.
+func packAnswers(answers []dns.RR) ([]byte, error) {
+    m := new(dns.Msg)
+    m.Answer = answers
+    m.Compress = true
+    return m.Pack()
+}
+
+func unpackAnswers(packed []byte) ([]dns.RR, error) {
+    m := new(dns.Msg)
+    if err := m.Unpack(packed); err != nil {
+        return nil, err
+    }
+    return m.Answer, nil
+}
+
+// reply builds a response to r from the cached answers, with TTLs reduced by
+// the time spent in the cache. It returns nil if the entry can't be unpacked.
+func (e *cacheEntry) reply(r *dns.Msg, now time.Time) *dns.Msg {
+    answers, err := unpackAnswers(e.packed)
+    if err != nil {
+        return nil
+    }
+
+    m := new(dns.Msg)
+    m.SetReply(r)
+    m.RecursionAvailable = true
+
+    elapsed := uint32(now.Sub(e.stored) / time.Second)
+    for _, rr := range answers {
+        if ttl := rr.Header().Ttl; ttl > elapsed {
+            rr.Header().Ttl = ttl - elapsed
+        } else {
+            rr.Header().Ttl = staleAnswerTTL
+        }
+    }
+    if e.negative {
+        m.Rcode = dns.RcodeNameError
+        m.Ns = answers
+        return m
+    }
+    m.Answer = answers
+
+    if opt := r.IsEdns0(); opt != nil && e.expire != nil {
+        expire := uint32(0)
+        if *e.expire > elapsed {
+            expire = *e.expire - elapsed
+        }
+        m.SetEdns0(opt.UDPSize(), opt.Do())
+        reply := m.IsEdns0()
+        reply.Option = append(reply.Option, &dns.EDNS0_EXPIRE{Code: dns.EDNS0EXPIRE, Expire: expire})
+    }
+    return m
+}
+
+// expireOption returns the EDNS EXPIRE value carried by m, if any.
+func expireOption(m *dns.Msg) *uint32 {
+    opt := m.IsEdns0()
+    if opt == nil {
+        return nil
+    }
+    for _, o := range opt.Option {
+        if e, ok := o.(*dns.EDNS0_EXPIRE); ok && !e.Empty {
+            expire := e.Expire
+            return &expire
+        }
+    }
+    return nil
+}
+
+// Rough per-entry cost of the map slot, key and entry struct on top of the
+// packed answers, used for CACHE_MAX_BYTES
+const cacheEntryOverhead = 160
+
+// size estimates the memory held by the entry stored under key.
+func (e *cacheEntry) size(key cacheKey) int {
+    return cacheEntryOverhead + len(e.packed) + len(key.name)
+}
+
+type answerCache struct {
+    mu         sync.Mutex
+    entries    map[cacheKey]*cacheEntry
+    expiry     expiryHeap
+    maxEntries int
+    // Byte budget from CACHE_MAX_BYTES (0 for none) and the estimated size
+    // of all entries
+    maxBytes   int
+    bytes      int
+
+    statsMu sync.Mutex
+    stats   map[uint16]*cacheStats
+}
+
+// cacheStats counts lookups of one query type.
+type cacheStats struct {
+    Hits   int64 `json:"hits"`
+    Misses int64 `json:"misses"`
+}
+
+func newAnswerCache(maxEntries, maxBytes int) *answerCache {
+    return &answerCache{
+        entries:    make(map[cacheKey]*cacheEntry),
+        maxEntries: maxEntries,
+        maxBytes:   maxBytes,
+        stats:      make(map[uint16]*cacheStats),
+    }
+}
+
+func (c *answerCache) record(qtype uint16, hit bool) {
+    c.statsMu.Lock()
+    defer c.statsMu.Unlock()
+
+    s, ok := c.stats[qtype]
+    if !ok {
+        s = &cacheStats{}
+        c.stats[qtype] = s
+    }
+    if hit {
+        s.Hits++
+    } else {
+        s.Misses++
+    }
+}
+
+// statsByType returns a copy of the hit and miss counters keyed by type name.
+func (c *answerCache) statsByType() map[string]cacheStats {
+    c.statsMu.Lock()
+    defer c.statsMu.Unlock()
+
+    stats := make(map[string]cacheStats, len(c.stats))
+    for qtype, s := range c.stats {
+        name, ok := dns.TypeToString[qtype]
+        if !ok {
+            name = "TYPE" + strconv.Itoa(int(qtype))
+        }
+        stats[name] = *s
+    }
+    return stats
+}
+
+// setLimits applies new CACHE_MAX_ENTRIES and CACHE_MAX_BYTES values,
+// evicting right away if the cache no longer fits.
+func (c *answerCache) setLimits(maxEntries, maxBytes int) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    c.maxEntries, c.maxBytes = maxEntries, maxBytes
+    for len(c.entries) > maxEntries || (maxBytes > 0 && c.bytes > maxBytes) {
+        if !c.evictOneLocked() {
+            return
+        }
+    }
+}
+
+func (c *answerCache) get(key cacheKey) *cacheEntry {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    entry, ok := c.entries[key]
+    if !ok {
+        return nil
+    }
+    entry.hits++
+    return entry
+}
+
+// set stores the answers of m for key. now is when the lookup for m began.
+func (c *answerCache) set(key cacheKey, m *dns.Msg, now time.Time) {
+    answers := m.Answer
+    if len(answers) == 0 {
+        return
+    }
+
+    ttl := answers[0].Header().Ttl
+    for _, rr := range answers {
+        if rr.Header().Ttl < ttl {
+            ttl = rr.Header().Ttl
+        }
+    }
+    if ttl == 0 {
+        return
+    }
+
+    packed, err := packAnswers(answers)
+    if err != nil {
+        return
+    }
+    c.store(key, &cacheEntry{
+        packed:  packed,
+        expire:  expireOption(m),
+        stored:  now,
+        expires: now.Add(time.Duration(ttl) * time.Second),
+    })
+}
+
+// setNegative stores the NXDOMAIN in m for key, for the SOA minimum of its
+// authority section (RFC 2308) or defaultTTL when there is no SOA.
+func (c *answerCache) setNegative(key cacheKey, m *dns.Msg, now time.Time, defaultTTL time.Duration) {
+    ttl := defaultTTL
+    for _, rr := range m.Ns {
+        if soa, ok := rr.(*dns.SOA); ok {
+            minimum := soa.Minttl
+            if soa.Hdr.Ttl < minimum {
+                minimum = soa.Hdr.Ttl
+            }
+            ttl = time.Duration(minimum) * time.Second
+        }
+    }
+    if ttl <= 0 {
+        return
+    }
+
+    packed, err := packAnswers(m.Ns)
+    if err != nil {
+        return
+    }
+    c.store(key, &cacheEntry{
+        packed:   packed,
+        stored:   now,
+        expires:  now.Add(ttl),
+        negative: true,
+    })
+}
+
+// store inserts entry, evicting others when the cache is full or over its
+// byte budget. Entries never change once stored apart from the hit count and
+// refresh flag guarded by mu, so readers holding an entry see it whole.
+func (c *answerCache) store(key cacheKey, entry *cacheEntry) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    size := entry.size(key)
+    if c.maxEntries <= 0 || (c.maxBytes > 0 && size > c.maxBytes) {
+        return
+    }
+    if old, ok := c.entries[key]; ok {
+        // Concurrent misses race to store their answer, keep the one from
+        // the lookup that started last
+        if old.stored.After(entry.stored) {
+            return
+        }
+        entry.hits, entry.refreshing = old.hits, old.refreshing
+        c.deleteLocked(key)
+    }
+    c.evictLocked(size)
+    entry.key = key
+    c.entries[key] = entry
+    heap.Push(&c.expiry, entry)
+    c.bytes += size
+}
+
+func (c *answerCache) deleteLocked(key cacheKey) {
+    if entry, ok := c.entries[key]; ok {
+        c.bytes -= entry.size(key)
+        delete(c.entries, key)
+        heap.Remove(&c.expiry, entry.index)
+    }
+}
+
+func (c *answerCache) flush() int {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    n := len(c.entries)
+    c.entries, c.expiry, c.bytes = make(map[cacheKey]*cacheEntry), nil, 0
+    return n
+}
+
+// flushName drops the entries for name across all query types.
+func (c *answerCache) flushName(name string) int {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    n := 0
+    for key := range c.entries {
+        if key.name == name {
+            c.deleteLocked(key)
+            n++
+        }
+    }
+    return n
+}
+
+// evictLocked drops the entries closest to expiry until there is room for a
+// new one of size bytes, both in number and in CACHE_MAX_BYTES.
+func (c *answerCache) evictLocked(size int) {
+    for len(c.entries) >= c.maxEntries || (c.maxBytes > 0 && c.bytes+size > c.maxBytes) {
+        if !c.evictOneLocked() {
+            return
+        }
+    }
+}
+
+// evictOneLocked drops the entry closest to expiry, returning false when the
+// cache is empty.
+func (c *answerCache) evictOneLocked() bool {
+    if len(c.expiry) == 0 {
+        return false
+    }
+    c.deleteLocked(c.expiry[0].key)
+    return true
+}
+
+// sweep drops the entries past their stale-if-error window, returning how
+// many it dropped.
+func (c *answerCache) sweep(now time.Time, staleTTL time.Duration) int {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    n := 0
+    for len(c.expiry) > 0 && !now.Before(c.expiry[0].expires.Add(staleTTL)) {
+        c.deleteLocked(c.expiry[0].key)
+        n++
+    }
+    return n
+}
+
+// usage returns the estimated size of all entries in bytes.
+func (c *answerCache) usage() int {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    return c.bytes
+}
+
+func (c *answerCache) len() int {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    return len(c.entries)
+}
+
+// dueForRefresh returns the keys of entries that were used since they were
+// stored and expire within the given window, marking them as being refreshed
+// so they are only picked up once.
+func (c *answerCache) dueForRefresh(now time.Time, ahead time.Duration) []cacheKey {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    var keys []cacheKey
+    for key, entry := range c.entries {
+        if entry.refreshing || entry.negative || entry.hits == 0 || !entry.fresh(now) {
+            continue
+        }
+        if entry.expires.Sub(now) <= ahead {
+            entry.refreshing = true
+            keys = append(keys, key)
+        }
+    }
+    return keys
+}
+
+// startPrefetch marks the entry for key as being refreshed when less than
+// threshold (a fraction of its TTL) is left, returning whether the caller
+// should refresh it.
+func (c *answerCache) startPrefetch(key cacheKey, now time.Time, threshold float64) bool {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    entry, ok := c.entries[key]
+    if !ok || entry.refreshing || entry.negative || !entry.fresh(now) {
+        return false
+    }
+    ttl := entry.expires.Sub(entry.stored)
+    if float64(entry.expires.Sub(now)) > float64(ttl)*threshold {
+        return false
+    }
+    entry.refreshing = true
+    return true
+}
+
+// startRefresh marks the entry for key as being refreshed, returning false
+// if it is gone or a refresh is already running.
+func (c *answerCache) startRefresh(key cacheKey) bool {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    entry, ok := c.entries[key]
+    if !ok || entry.refreshing {
+        return false
+    }
+    entry.refreshing = true
+    return true
+}
+
+func (c *answerCache) refreshDone(key cacheKey) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    if entry, ok := c.entries[key]; ok {
+        entry.refreshing = false
+    }
+}
+
+// refreshCache periodically drops expired entries and re-resolves popular
+// ones shortly before they expire, so clients keep getting cached answers
+// without paying for a lookup. It runs until ctx is cancelled.
+func (p *DNSProxy) refreshCache(ctx context.Context) {
+    ticker := time.NewTicker(time.Second)
+    defer ticker.Stop()
+
+    for {
+        var now time.Time
+        select {
+        case now = <-ticker.C:
+        case <-ctx.Done():
+            return
+        }
+
+        cfg := p.config()
+        if !cfg.CacheEnabled {
+            continue
+        }
+        p.cache.sweep(now, cfg.StaleIfErrorTTL)
+        if cfg.CacheRefreshAhead <= 0 {
+            continue
+        }
+        for _, key := range p.cache.dueForRefresh(now, cfg.CacheRefreshAhead) {
+            go p.refreshEntry(key)
+        }
+    }
+}
+
+func (p *DNSProxy) refreshEntry(key cacheKey) {
+    defer p.cache.refreshDone(key)
+
+    query := new(dns.Msg)
+    query.SetQuestion(key.name, key.qtype)
+    query.Question[0].Qclass = key.qclass
+    query.RecursionDesired = true
+
+    cfg := p.requestConfig()
+    ctx, cancel := context.WithTimeout(context.Background(), cfg.RequestTimeout)
+    defer cancel()
+
+    p.logDebug("Refreshing cached entry for %s (type: %s)", key.name, dns.TypeToString[key.qtype])
+    start := time.Now()
+    m, failed := p.lookup(ctx, cfg, query)
+    if failed || m.Rcode != dns.RcodeSuccess || len(m.Answer) == 0 || m.Truncated {
+        p.logDebug("Background refresh for %s returned no usable answer", key.name)
+        return
+    }
+    p.cache.set(key, m, start)
+}
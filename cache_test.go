@@ -0,0 +1,443 @@
+package main
+
+import (
+    "fmt"
+    "net"
+    "runtime"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "testing"
+    "time"
+
+    "github.com/miekg/dns"
+)
+
+// sequentialDNS answers the nth query with 10.0.0.n, so a test can tell a
+// fresh lookup from a cached answer.
+func sequentialDNS(t *testing.T, ttl uint32, count *int64) string {
+    return fakeDNS(t, func(w dns.ResponseWriter, r *dns.Msg) {
+        n := atomic.AddInt64(count, 1)
+        m := new(dns.Msg)
+        m.SetReply(r)
+        rr, _ := dns.NewRR(fmt.Sprintf("%s %d IN A 10.0.0.%d", r.Question[0].Name, ttl, n))
+        m.Answer = append(m.Answer, rr)
+        w.WriteMsg(m)
+    })
+}
+
+func answerIP(m *dns.Msg) string {
+    if m == nil || len(m.Answer) == 0 {
+        return ""
+    }
+    if a, ok := m.Answer[0].(*dns.A); ok {
+        return a.A.String()
+    }
+    return ""
+}
+
+func TestCacheRefreshAhead(t *testing.T) {
+    var count int64
+    docker := sequentialDNS(t, 10, &count)
+    p := testProxy(t, "DOCKER_DNS", docker, "CACHE_ENABLED", "true", "CACHE_REFRESH_AHEAD", "3")
+
+    if ip := answerIP(query(p, "web.docker.", dns.TypeA)); ip != "10.0.0.1" {
+        t.Fatalf("first answer %s, want 10.0.0.1", ip)
+    }
+    if ip := answerIP(query(p, "web.docker.", dns.TypeA)); ip != "10.0.0.1" {
+        t.Fatalf("second answer %s, want the cached 10.0.0.1", ip)
+    }
+
+    // Not due yet with 10s left, due once less than CACHE_REFRESH_AHEAD is
+    cfg := p.config()
+    if keys := p.cache.dueForRefresh(time.Now(), cfg.CacheRefreshAhead); len(keys) != 0 {
+        t.Fatalf("%d entries due right after the lookup, want 0", len(keys))
+    }
+    keys := p.cache.dueForRefresh(time.Now().Add(8*time.Second), cfg.CacheRefreshAhead)
+    if len(keys) != 1 {
+        t.Fatalf("%d entries due near expiry, want 1", len(keys))
+    }
+    p.refreshEntry(keys[0])
+
+    m := query(p, "web.docker.", dns.TypeA)
+    if ip := answerIP(m); ip != "10.0.0.2" {
+        t.Errorf("answer after refresh %s, want the refreshed 10.0.0.2", ip)
+    }
+    if ttl := m.Answer[0].Header().Ttl; ttl < 9 {
+        t.Errorf("refreshed answer TTL %d, want close to 10", ttl)
+    }
+    if n := atomic.LoadInt64(&count); n != 2 {
+        t.Errorf("Docker DNS got %d queries, want 2", n)
+    }
+}
+
+func TestCacheStaleIfError(t *testing.T) {
+    r := new(dns.Msg)
+    r.SetQuestion("web.docker.", dns.TypeA)
+    m := new(dns.Msg)
+    m.SetReply(r)
+    rr, _ := dns.NewRR("web.docker. 10 IN A 10.0.0.1")
+    m.Answer = append(m.Answer, rr)
+
+    cache := newAnswerCache(10, 0)
+    key := cacheKey{name: "web.docker.", qtype: dns.TypeA}
+    now := time.Now()
+    cache.set(key, m, now)
+    entry := cache.get(key)
+
+    later := now.Add(15 * time.Second)
+    if entry.fresh(later) {
+        t.Fatal("entry still fresh past its TTL")
+    }
+    if !entry.usableIfError(later, 10*time.Second) {
+        t.Error("entry not usable within STALE_IF_ERROR_TTL")
+    }
+    if entry.usableIfError(now.Add(25*time.Second), 10*time.Second) {
+        t.Error("entry usable past STALE_IF_ERROR_TTL")
+    }
+    if stale := entry.reply(r, later); stale.Answer[0].Header().Ttl != staleAnswerTTL {
+        t.Errorf("stale answer TTL %d, want %d", stale.Answer[0].Header().Ttl, staleAnswerTTL)
+    }
+}
+
+func TestPackedAnswersRoundTrip(t *testing.T) {
+    var answers []dns.RR
+    for _, s := range []string{
+        "web.docker. 60 IN CNAME web-1.docker.",
+        "web-1.docker. 60 IN A 172.17.0.2",
+        "web-1.docker. 60 IN AAAA fd00::2",
+        "web-1.docker. 60 IN TXT \"v=1\" \"two words\"",
+        "_http._tcp.web.docker. 60 IN SRV 10 5 8080 web-1.docker.",
+        "web.docker. 60 IN MX 10 mail.web.docker.",
+    } {
+        rr, err := dns.NewRR(s)
+        if err != nil {
+            t.Fatal(err)
+        }
+        answers = append(answers, rr)
+    }
+
+    packed, err := packAnswers(answers)
+    if err != nil {
+        t.Fatal(err)
+    }
+    unpacked, err := unpackAnswers(packed)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(unpacked) != len(answers) {
+        t.Fatalf("got %d records back, want %d", len(unpacked), len(answers))
+    }
+    for i := range answers {
+        if unpacked[i].String() != answers[i].String() {
+            t.Errorf("record %d came back as %s, want %s", i, unpacked[i], answers[i])
+        }
+    }
+}
+
+func TestPrefetchOnHit(t *testing.T) {
+    var count int64
+    docker := sequentialDNS(t, 10, &count)
+    p := testProxy(t, "DOCKER_DNS", docker, "CACHE_ENABLED", "true", "PREFETCH_THRESHOLD", "0.99")
+
+    query(p, "web.docker.", dns.TypeA)
+    // Over 1% of the 10s TTL gone
+    time.Sleep(150 * time.Millisecond)
+    if ip := answerIP(query(p, "web.docker.", dns.TypeA)); ip != "10.0.0.1" {
+        t.Fatalf("near-expiry hit answered %q, want the cached 10.0.0.1", ip)
+    }
+
+    deadline := time.Now().Add(2 * time.Second)
+    for atomic.LoadInt64(&count) < 2 && time.Now().Before(deadline) {
+        time.Sleep(10 * time.Millisecond)
+    }
+    if n := atomic.LoadInt64(&count); n != 2 {
+        t.Fatalf("Docker DNS got %d queries, want a background refresh", n)
+    }
+    deadline = time.Now().Add(2 * time.Second)
+    for answerIP(query(p, "web.docker.", dns.TypeA)) != "10.0.0.2" {
+        if time.Now().After(deadline) {
+            t.Fatal("refreshed answer never reached the cache")
+        }
+        time.Sleep(10 * time.Millisecond)
+    }
+}
+
+func TestCacheStatsPerType(t *testing.T) {
+    docker := fakeDNS(t, func(w dns.ResponseWriter, r *dns.Msg) {
+        m := new(dns.Msg)
+        m.SetReply(r)
+        rr, _ := dns.NewRR(r.Question[0].Name + " 60 IN AAAA fd00::2")
+        if r.Question[0].Qtype == dns.TypeA {
+            rr, _ = dns.NewRR(r.Question[0].Name + " 60 IN A 172.17.0.2")
+        }
+        m.Answer = append(m.Answer, rr)
+        w.WriteMsg(m)
+    })
+    p := testProxy(t, "DOCKER_DNS", docker, "CACHE_ENABLED", "true")
+
+    for _, qtype := range []uint16{dns.TypeA, dns.TypeA, dns.TypeA, dns.TypeAAAA} {
+        query(p, "web.docker.", qtype)
+    }
+    stats := p.cache.statsByType()
+    if got, want := stats["A"], (cacheStats{Hits: 2, Misses: 1}); got != want {
+        t.Errorf("A stats %+v, want %+v", got, want)
+    }
+    if got, want := stats["AAAA"], (cacheStats{Hits: 0, Misses: 1}); got != want {
+        t.Errorf("AAAA stats %+v, want %+v", got, want)
+    }
+    if _, ok := stats["MX"]; ok {
+        t.Error("stats for a type never queried")
+    }
+}
+
+func TestCachePreferenceCached(t *testing.T) {
+    var count int64
+    docker := sequentialDNS(t, 1, &count)
+    p := testProxy(t, "DOCKER_DNS", docker, "CACHE_ENABLED", "true", "STALE_IF_ERROR_TTL", "60",
+        "CACHE_PREFERENCE", "cached", "CACHE_PREFERENCE_CLIENTS", "10.1.0.0/16")
+    hinted := &net.UDPAddr{IP: net.ParseIP("10.1.1.5"), Port: 40000}
+    other := &net.UDPAddr{IP: net.ParseIP("10.9.9.9"), Port: 40000}
+    ask := func(client net.Addr) *dns.Msg {
+        r := new(dns.Msg)
+        r.SetQuestion("web.docker.", dns.TypeA)
+        return queryFrom(p, client, r)
+    }
+
+    ask(hinted)
+    time.Sleep(1100 * time.Millisecond)
+    m := ask(hinted)
+    if ip := answerIP(m); ip != "10.0.0.1" {
+        t.Fatalf("latency-sensitive client got %q after expiry, want the cached 10.0.0.1", ip)
+    }
+    if ttl := m.Answer[0].Header().Ttl; ttl != staleAnswerTTL {
+        t.Errorf("stale answer TTL %d, want %d", ttl, staleAnswerTTL)
+    }
+    deadline := time.Now().Add(2 * time.Second)
+    for atomic.LoadInt64(&count) < 2 && time.Now().Before(deadline) {
+        time.Sleep(10 * time.Millisecond)
+    }
+    if n := atomic.LoadInt64(&count); n != 2 {
+        t.Fatalf("Docker DNS got %d queries, want a background refresh", n)
+    }
+
+    time.Sleep(1100 * time.Millisecond)
+    if ip := answerIP(ask(other)); ip != "10.0.0.3" {
+        t.Errorf("client outside CACHE_PREFERENCE_CLIENTS got %q after expiry, want the fresh 10.0.0.3", ip)
+    }
+}
+
+// Run with go test -race: writers for the same name race with readers.
+func TestConcurrentCacheWrites(t *testing.T) {
+    cache := newAnswerCache(10, 0)
+    key := cacheKey{name: "web.docker.", qtype: dns.TypeA}
+    r := new(dns.Msg)
+    r.SetQuestion("web.docker.", dns.TypeA)
+
+    const writers = 50
+    var wg sync.WaitGroup
+    for i := 0; i < writers; i++ {
+        wg.Add(2)
+        go func(i int) {
+            defer wg.Done()
+            m := new(dns.Msg)
+            m.SetReply(r)
+            for host := 1; host <= 2; host++ {
+                rr, _ := dns.NewRR(fmt.Sprintf("web.docker. 60 IN A 10.0.%d.%d", i, host))
+                m.Answer = append(m.Answer, rr)
+            }
+            cache.set(key, m, time.Now())
+        }(i)
+        go func() {
+            defer wg.Done()
+            if entry := cache.get(key); entry != nil {
+                checkCachedReply(t, entry.reply(r, time.Now()))
+            }
+        }()
+    }
+    wg.Wait()
+
+    if n := cache.len(); n != 1 {
+        t.Fatalf("%d entries for one name, want 1", n)
+    }
+    entry := cache.get(key)
+    if used := cache.usage(); used != entry.size(key) {
+        t.Errorf("cache accounts %d bytes, want the %d of its one entry", used, entry.size(key))
+    }
+    checkCachedReply(t, entry.reply(r, time.Now()))
+}
+
+// checkCachedReply fails unless m holds both answers of a single writer.
+func checkCachedReply(t *testing.T, m *dns.Msg) {
+    t.Helper()
+    if m == nil || len(m.Answer) != 2 {
+        t.Errorf("cached reply %v, want the 2 answers of one writer", m)
+        return
+    }
+    a, b := m.Answer[0].(*dns.A).A.To4(), m.Answer[1].(*dns.A).A.To4()
+    if a[2] != b[2] || a[3] != 1 || b[3] != 2 {
+        t.Errorf("cached reply mixes writers: %s and %s", a, b)
+    }
+}
+
+func TestCacheMaxBytes(t *testing.T) {
+    // largeAnswer holds 50 TXT records of 200 bytes, packed to over 10KB
+    largeAnswer := func(name string, ttl uint32) *dns.Msg {
+        m := new(dns.Msg)
+        m.SetQuestion(name, dns.TypeTXT)
+        for i := 0; i < 50; i++ {
+            m.Answer = append(m.Answer, &dns.TXT{
+                Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: ttl},
+                Txt: []string{fmt.Sprintf("%03d%s", i, strings.Repeat("x", 197))},
+            })
+        }
+        return m
+    }
+
+    const budget = 40000
+    cache := newAnswerCache(1000, budget)
+    now := time.Now()
+    for i := 0; i < 20; i++ {
+        name := fmt.Sprintf("big%d.docker.", i)
+        cache.set(cacheKey{name: name, qtype: dns.TypeTXT}, largeAnswer(name, uint32(100+i)), now)
+        if used := cache.usage(); used > budget {
+            t.Fatalf("after %d entries the cache holds %d bytes, over the %d budget", i+1, used, budget)
+        }
+    }
+    if n := cache.len(); n == 0 || n >= 4 {
+        t.Errorf("%d entries of over 10KB within a 40KB budget, want 1 to 3", n)
+    }
+    // The entries closest to expiry go first
+    if cache.get(cacheKey{name: "big19.docker.", qtype: dns.TypeTXT}) == nil {
+        t.Error("latest-expiring entry evicted")
+    }
+    if cache.get(cacheKey{name: "big0.docker.", qtype: dns.TypeTXT}) != nil {
+        t.Error("earliest-expiring entry kept")
+    }
+
+    // An entry over the whole budget is not stored at all
+    small := newAnswerCache(1000, 1000)
+    small.set(cacheKey{name: "big.docker.", qtype: dns.TypeTXT}, largeAnswer("big.docker.", 100), now)
+    if n, used := small.len(), small.usage(); n != 0 || used != 0 {
+        t.Errorf("entry over CACHE_MAX_BYTES stored: %d entries, %d bytes", n, used)
+    }
+}
+
+// Expired entries are dropped by the sweep alone, without refresh-ahead, and
+// those still within STALE_IF_ERROR_TTL stay.
+func TestCacheSweep(t *testing.T) {
+    cache := newAnswerCache(10, 0)
+    now := time.Now()
+    for i, ttl := range []uint32{1, 5, 60} {
+        name := fmt.Sprintf("web%d.docker.", i)
+        m := new(dns.Msg)
+        m.SetQuestion(name, dns.TypeA)
+        rr, _ := dns.NewRR(fmt.Sprintf("%s %d IN A 10.0.0.1", name, ttl))
+        m.Answer = append(m.Answer, rr)
+        cache.set(cacheKey{name: name, qtype: dns.TypeA}, m, now)
+    }
+
+    if n := cache.sweep(now.Add(3*time.Second), 0); n != 1 || cache.len() != 2 {
+        t.Errorf("sweep after 3s dropped %d, left %d, want 1 dropped and 2 left", n, cache.len())
+    }
+    if n := cache.sweep(now.Add(10*time.Second), 10*time.Second); n != 0 {
+        t.Errorf("sweep dropped %d entries within STALE_IF_ERROR_TTL, want 0", n)
+    }
+    if n := cache.sweep(now.Add(20*time.Second), 10*time.Second); n != 1 || cache.len() != 1 {
+        t.Errorf("sweep after 20s dropped %d, left %d, want 1 dropped and 1 left", n, cache.len())
+    }
+    if cache.get(cacheKey{name: "web2.docker.", qtype: dns.TypeA}) == nil {
+        t.Error("sweep dropped the unexpired entry")
+    }
+}
+
+// A query of another class must not be answered from the IN entry.
+func TestCacheKeyedByClass(t *testing.T) {
+    var count int64
+    docker := sequentialDNS(t, 60, &count)
+    p := testProxy(t, "DOCKER_DNS", docker, "CACHE_ENABLED", "true")
+
+    query(p, "web.docker.", dns.TypeA)
+    r := new(dns.Msg)
+    r.SetQuestion("web.docker.", dns.TypeA)
+    r.Question[0].Qclass = dns.ClassCHAOS
+    p.dispatch(r)
+    query(p, "web.docker.", dns.TypeA)
+
+    if n := atomic.LoadInt64(&count); n != 2 {
+        t.Errorf("Docker DNS got %d queries, want 2: one per class", n)
+    }
+}
+
+// Entries each benchmark iteration fills the cache with
+const benchCacheEntries = 1000
+
+// benchAnswers returns a typical Docker answer for the nth service: a CNAME
+// to the container and its A records.
+func benchAnswers(n int) *dns.Msg {
+    m := new(dns.Msg)
+    m.SetQuestion(fmt.Sprintf("svc%d.docker.", n), dns.TypeA)
+    for _, s := range []string{
+        fmt.Sprintf("svc%d.docker. 60 IN CNAME svc%d-1.docker.", n, n),
+        fmt.Sprintf("svc%d-1.docker. 60 IN A 172.17.%d.%d", n, n/250, n%250+1),
+        fmt.Sprintf("svc%d-1.docker. 60 IN A 172.18.%d.%d", n, n/250, n%250+1),
+    } {
+        rr, _ := dns.NewRR(s)
+        m.Answer = append(m.Answer, rr)
+    }
+    return m
+}
+
+// heapInUse returns the live heap after a collection.
+func heapInUse() uint64 {
+    runtime.GC()
+    var stats runtime.MemStats
+    runtime.ReadMemStats(&stats)
+    return stats.HeapAlloc
+}
+
+// benchmarkCacheFill builds a cache of msgs with fill for every iteration
+// and reports the heap each entry holds on to.
+func benchmarkCacheFill(b *testing.B, fill func(msgs []*dns.Msg) interface{}) {
+    msgs := make([]*dns.Msg, benchCacheEntries)
+    for i := range msgs {
+        msgs[i] = benchAnswers(i)
+    }
+
+    b.ReportAllocs()
+    var held uint64
+    for i := 0; i < b.N; i++ {
+        before := heapInUse()
+        cache := fill(msgs)
+        held += heapInUse() - before
+        runtime.KeepAlive(cache)
+    }
+    b.ReportMetric(float64(held)/float64(b.N*len(msgs)), "bytes/entry")
+}
+
+// The packed wire form the cache stores, against keeping a copy of the
+// unpacked records.
+func BenchmarkCacheEntryPacked(b *testing.B) {
+    benchmarkCacheFill(b, func(msgs []*dns.Msg) interface{} {
+        c := newAnswerCache(len(msgs), 0)
+        now := time.Now()
+        for _, m := range msgs {
+            c.set(cacheKey{name: m.Question[0].Name, qtype: dns.TypeA}, m, now)
+        }
+        return c
+    })
+}
+
+func BenchmarkCacheEntryRecords(b *testing.B) {
+    benchmarkCacheFill(b, func(msgs []*dns.Msg) interface{} {
+        c := make(map[cacheKey][]dns.RR, len(msgs))
+        for _, m := range msgs {
+            answers := make([]dns.RR, len(m.Answer))
+            for i, rr := range m.Answer {
+                answers[i] = dns.Copy(rr)
+            }
+            c[cacheKey{name: m.Question[0].Name, qtype: dns.TypeA}] = answers
+        }
+        return c
+    })
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+    "os"
+    "strings"
+
+    "github.com/miekg/dns"
+)
+
+// CHAOS class names identifying the server
+const (
+    versionBindName  = "version.bind."
+    versionSrvName   = "version.server."
+    hostnameBindName = "hostname.bind."
+    idServerName     = "id.server."
+    authorsBindName  = "authors.bind."
+)
+
+func defaultHostname() string {
+    hostname, err := os.Hostname()
+    if err != nil {
+        return ""
+    }
+    return hostname
+}
+
+// chaosText returns the text for a CHAOS class name, and false for names the
+// proxy doesn't answer, which then go through the usual lookup.
+func (c *Config) chaosText(domain string) (string, bool) {
+    switch domain {
+    case versionBindName, versionSrvName:
+        return version, true
+    case hostnameBindName, idServerName:
+        return c.ChaosHostname, c.ChaosHostname != ""
+    case authorsBindName:
+        return c.ChaosAuthors, c.ChaosAuthors != ""
+    }
+    return "", false
+}
+
+// answerChaos answers CHAOS class TXT queries for version.bind, hostname.bind
+// (and id.server) and authors.bind, so each instance of a fleet can be told
+// apart with dig CH TXT hostname.bind. It returns nil for anything else.
+func (p *DNSProxy) answerChaos(cfg *Config, r *dns.Msg) *dns.Msg {
+    question := r.Question[0]
+    if question.Qclass != dns.ClassCHAOS {
+        return nil
+    }
+    domain := strings.ToLower(question.Name)
+    text, ok := cfg.chaosText(domain)
+    if !ok {
+        return nil
+    }
+
+    m := new(dns.Msg)
+    m.SetReply(r)
+    m.Authoritative = true
+    if question.Qtype == dns.TypeTXT || question.Qtype == dns.TypeANY {
+        m.Answer = append(m.Answer, &dns.TXT{
+            Hdr: dns.RR_Header{Name: question.Name, Rrtype: dns.TypeTXT, Class: dns.ClassCHAOS},
+            Txt: []string{text},
+        })
+    }
+    p.logDebug("Answered CHAOS query %s", domain)
+    return m
+}
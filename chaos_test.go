@@ -0,0 +1,45 @@
+package main
+
+import (
+    "testing"
+
+    "github.com/miekg/dns"
+)
+
+// queryChaos asks for the CHAOS class TXT record of name.
+func queryChaos(p *DNSProxy, name string) *dns.Msg {
+    r := new(dns.Msg)
+    r.SetQuestion(name, dns.TypeTXT)
+    r.Question[0].Qclass = dns.ClassCHAOS
+    m, _ := p.dispatch(r)
+    return m
+}
+
+func TestChaosNames(t *testing.T) {
+    p := testProxy(t, "CHAOS_HOSTNAME", "dns-3.example", "CHAOS_AUTHORS", "the dns-proxy authors")
+    for name, want := range map[string]string{
+        versionBindName:  version,
+        versionSrvName:   version,
+        hostnameBindName: "dns-3.example",
+        idServerName:     "dns-3.example",
+        "AUTHORS.BIND.":  "the dns-proxy authors",
+    } {
+        m := queryChaos(p, name)
+        if m == nil || m.Rcode != dns.RcodeSuccess || len(m.Answer) != 1 {
+            t.Errorf("%s: got %v, want one TXT", name, m)
+            continue
+        }
+        txt, ok := m.Answer[0].(*dns.TXT)
+        if !ok || txt.Hdr.Class != dns.ClassCHAOS || len(txt.Txt) != 1 || txt.Txt[0] != want {
+            t.Errorf("%s: answer %v, want CH TXT %q", name, m.Answer[0], want)
+        }
+    }
+
+    // Empty settings leave the names unanswered
+    p = testProxy(t, "CHAOS_HOSTNAME", "", "CHAOS_AUTHORS", "")
+    for _, name := range []string{hostnameBindName, idServerName, authorsBindName} {
+        if m := queryChaos(p, name); m != nil && len(m.Answer) != 0 {
+            t.Errorf("%s answered %v with the setting empty", name, m.Answer)
+        }
+    }
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+    "encoding/json"
+    "log"
+    "net"
+    "reflect"
+    "strconv"
+    "time"
+
+    "github.com/miekg/dns"
+)
+
+// Config fields whose values never appear in logs
+var secretConfigFields = map[string]bool{
+    "AdminToken":   true,
+    "CookieSecret": true,
+}
+
+const redactedValue = "REDACTED"
+
+// redacted returns the configuration keyed by field name, ready for JSON,
+// with secrets replaced by REDACTED. Durations, networks, rules and query
+// types are given in their readable form rather than as raw numbers.
+func (c *Config) redacted() map[string]interface{} {
+    out := make(map[string]interface{})
+    v := reflect.ValueOf(c).Elem()
+    for i := 0; i < v.NumField(); i++ {
+        name := v.Type().Field(i).Name
+        switch value := v.Field(i).Interface().(type) {
+        case string:
+            if secretConfigFields[name] && value != "" {
+                value = redactedValue
+            }
+            out[name] = value
+        case time.Duration:
+            out[name] = value.String()
+        case []*net.IPNet:
+            nets := make([]string, len(value))
+            for j, n := range value {
+                nets[j] = n.String()
+            }
+            out[name] = nets
+        case []regexRule:
+            rules := make([]string, len(value))
+            for j, rule := range value {
+                rules[j] = rule.pattern.String() + "=" + string(rule.action)
+            }
+            out[name] = rules
+        case []scheduleRule:
+            rules := make([]string, len(value))
+            for j, rule := range value {
+                rules[j] = rule.String()
+            }
+            out[name] = rules
+        case []uint16:
+            qtypes := make([]string, len(value))
+            for j, qtype := range value {
+                qtypes[j] = qtypeName(qtype)
+            }
+            out[name] = qtypes
+        case map[uint16]time.Duration:
+            timeouts := make(map[string]string, len(value))
+            for qtype, timeout := range value {
+                timeouts[qtypeName(qtype)] = timeout.String()
+            }
+            out[name] = timeouts
+        case map[uint16]ednsAction:
+            policy := make(map[string]ednsAction, len(value))
+            for code, action := range value {
+                policy[strconv.Itoa(int(code))] = action
+            }
+            out[name] = policy
+        default:
+            out[name] = value
+        }
+    }
+    return out
+}
+
+func qtypeName(qtype uint16) string {
+    if name, ok := dns.TypeToString[qtype]; ok {
+        return name
+    }
+    return "TYPE" + strconv.Itoa(int(qtype))
+}
+
+// printConfigJSON logs the effective configuration as one JSON line, with
+// no timestamp prefix, for log pipelines to pick up.
+func printConfigJSON(config *Config) {
+    line, err := json.Marshal(config.redacted())
+    if err != nil {
+        log.Printf("Warning: Could not encode configuration as JSON: %v", err)
+        return
+    }
+    jsonLogger.Println(string(line))
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+    "encoding/json"
+    "os"
+    "strings"
+    "testing"
+)
+
+func TestPrintConfigJSON(t *testing.T) {
+    t.Setenv("ADMIN_TOKEN", "supersecret")
+    t.Setenv("LISTEN_PORT", "5353")
+    t.Setenv("TIMEOUT_SECONDS", "3")
+    t.Setenv("ALLOWED_CLIENTS", "10.0.0.0/8")
+    t.Setenv("QTYPE_TIMEOUTS", "TXT=4")
+    logs := &logBuffer{}
+    jsonLogger.SetOutput(logs)
+    t.Cleanup(func() { jsonLogger.SetOutput(os.Stderr) })
+
+    printConfigJSON(loadConfig())
+    out := logs.String()
+    if strings.Count(out, "\n") != 1 {
+        t.Fatalf("want one JSON line, got:\n%s", out)
+    }
+    if strings.Contains(out, "supersecret") {
+        t.Errorf("ADMIN_TOKEN not redacted:\n%s", out)
+    }
+
+    var config map[string]interface{}
+    if err := json.Unmarshal([]byte(out), &config); err != nil {
+        t.Fatalf("does not parse: %v\n%s", err, out)
+    }
+    for field, want := range map[string]interface{}{
+        "AdminToken": redactedValue,
+        "ListenPort": "5353",
+        "Timeout":    "3s",
+    } {
+        if config[field] != want {
+            t.Errorf("%s is %v, want %v", field, config[field], want)
+        }
+    }
+    if clients, _ := config["AllowedClients"].([]interface{}); len(clients) != 1 || clients[0] != "10.0.0.0/8" {
+        t.Errorf("AllowedClients is %v, want [10.0.0.0/8]", config["AllowedClients"])
+    }
+    if timeouts, _ := config["QtypeTimeouts"].(map[string]interface{}); timeouts["TXT"] != "4s" {
+        t.Errorf("QtypeTimeouts is %v, want TXT 4s", config["QtypeTimeouts"])
+    }
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/binary"
+    "encoding/hex"
+    "log"
+    "net"
+    "time"
+
+    "github.com/miekg/dns"
+)
+
+// Lengths of the hex-encoded cookie parts (RFC 7873)
+const (
+    clientCookieHexLen = 16
+    maxCookieHexLen    = 80
+)
+
+// cookieSecret returns the configured COOKIE_SECRET, or a random secret that
+// lives as long as the process when none is set. Several proxies behind one
+// address should share a configured secret.
+func cookieSecret(configured string) []byte {
+    if configured != "" {
+        if secret, err := hex.DecodeString(configured); err == nil && len(secret) >= 16 {
+            return secret
+        }
+        log.Printf("Warning: COOKIE_SECRET must be at least 16 hex-encoded bytes, using a random secret")
+    }
+    secret := make([]byte, 16)
+    if _, err := rand.Read(secret); err != nil {
+        log.Fatalf("Failed to generate cookie secret: %v", err)
+    }
+    return secret
+}
+
+// serverCookie builds an interoperable server cookie (RFC 9018 layout:
+// version, reserved, timestamp, hash) bound to the client cookie and IP.
+// The hash is a truncated HMAC-SHA256 rather than SipHash, which is fine as
+// only this proxy has to verify it.
+func serverCookie(secret []byte, clientCookie []byte, client net.IP, now time.Time) []byte {
+    cookie := make([]byte, 16)
+    cookie[0] = 1
+    binary.BigEndian.PutUint32(cookie[4:8], uint32(now.Unix()))
+
+    mac := hmac.New(sha256.New, secret)
+    mac.Write(clientCookie)
+    mac.Write(cookie[:8])
+    mac.Write(client)
+    copy(cookie[8:], mac.Sum(nil)[:8])
+    return cookie
+}
+
+// addCookie answers a client cookie in the request with our server cookie in
+// the response, replacing any cookie passed through from upstream.
+func (p *DNSProxy) addCookie(r *dns.Msg, m *dns.Msg, client net.IP) {
+    reqOpt := r.IsEdns0()
+    if reqOpt == nil {
+        return
+    }
+
+    var clientCookie []byte
+    for _, o := range reqOpt.Option {
+        if c, ok := o.(*dns.EDNS0_COOKIE); ok && len(c.Cookie) >= clientCookieHexLen && len(c.Cookie) <= maxCookieHexLen {
+            clientCookie, _ = hex.DecodeString(c.Cookie[:clientCookieHexLen])
+        }
+    }
+    if len(clientCookie) == 0 {
+        return
+    }
+
+    opt := m.IsEdns0()
+    if opt == nil {
+        m.SetEdns0(reqOpt.UDPSize(), reqOpt.Do())
+        opt = m.IsEdns0()
+    }
+    options := opt.Option[:0]
+    for _, o := range opt.Option {
+        if o.Option() != dns.EDNS0COOKIE {
+            options = append(options, o)
+        }
+    }
+
+    cookie := append(clientCookie, serverCookie(p.cookieSecret, clientCookie, client, time.Now())...)
+    opt.Option = append(options, &dns.EDNS0_COOKIE{
+        Code:   dns.EDNS0COOKIE,
+        Cookie: hex.EncodeToString(cookie),
+    })
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+    "net"
+    "strings"
+    "testing"
+
+    "github.com/miekg/dns"
+)
+
+// responseCookie returns the hex cookie in the OPT record of m, if any.
+func responseCookie(m *dns.Msg) string {
+    if opt := m.IsEdns0(); opt != nil {
+        for _, o := range opt.Option {
+            if c, ok := o.(*dns.EDNS0_COOKIE); ok {
+                return c.Cookie
+            }
+        }
+    }
+    return ""
+}
+
+func TestServerCookie(t *testing.T) {
+    p := testProxy(t, "ENABLE_COOKIES", "true", "COOKIE_SECRET", "000102030405060708090a0b0c0d0e0f",
+        "HOST_INTERNAL_IP", "192.0.2.1")
+    client := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 5), Port: 5353}
+    const clientCookie = "0123456789abcdef"
+
+    r := new(dns.Msg)
+    r.SetQuestion(hostInternalName, dns.TypeA)
+    r.SetEdns0(1232, false)
+    opt := r.IsEdns0()
+    opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: clientCookie})
+
+    cookie := responseCookie(queryFrom(p, client, r))
+    if !strings.HasPrefix(cookie, clientCookie) || len(cookie) != len(clientCookie)+32 {
+        t.Fatalf("response cookie %q, want the client cookie and a 16-byte server cookie", cookie)
+    }
+
+    other := responseCookie(queryFrom(p, &net.UDPAddr{IP: net.IPv4(10, 0, 0, 6), Port: 5353}, r))
+    if other[len(clientCookie):] == cookie[len(clientCookie):] {
+        t.Error("two clients got the same server cookie")
+    }
+
+    plain := new(dns.Msg)
+    plain.SetQuestion(hostInternalName, dns.TypeA)
+    plain.SetEdns0(1232, false)
+    if cookie := responseCookie(queryFrom(p, client, plain)); cookie != "" {
+        t.Errorf("response to a query without a cookie carries %q", cookie)
+    }
+}
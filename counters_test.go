@@ -0,0 +1,41 @@
+package main
+
+import (
+    "sync"
+    "sync/atomic"
+    "testing"
+
+    "github.com/miekg/dns"
+)
+
+// Run with go test -race: the counters are shared by every handler goroutine.
+func TestCountersExactUnderConcurrency(t *testing.T) {
+    p := testProxy(t, "HOST_INTERNAL_IP", "192.168.65.2")
+
+    const good, bad = 200, 50
+    var wg sync.WaitGroup
+    for i := 0; i < good+bad; i++ {
+        wg.Add(1)
+        go func(i int) {
+            defer wg.Done()
+            r := new(dns.Msg)
+            if i < good {
+                r.SetQuestion(hostInternalName, dns.TypeA)
+            } else {
+                // Logged and counted as one error
+                r.Id = dns.Id()
+            }
+            if _, err := p.dispatch(r); err != nil {
+                t.Error(err)
+            }
+        }(i)
+    }
+    wg.Wait()
+
+    if got := atomic.LoadInt64(&p.queryCount); got != good+bad {
+        t.Errorf("queryCount is %d, want %d", got, good+bad)
+    }
+    if got := atomic.LoadInt64(&p.errorCount); got != bad {
+        t.Errorf("errorCount is %d, want %d", got, bad)
+    }
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+    "log"
+    "net"
+    "time"
+
+    "github.com/miekg/dns"
+)
+
+// Address of Docker's embedded DNS server inside containers
+const dockerEmbeddedDNS = "127.0.0.11:53"
+
+// Value of DOCKER_DNS asking for the embedded server to be detected
+const dockerDNSAuto = "auto"
+
+// How long detection waits for the embedded DNS server to answer
+const detectTimeout = 500 * time.Millisecond
+
+// detectDockerDNS returns the embedded Docker DNS server if it answers a
+// test query, otherwise fallback, or the first nameserver of the system
+// resolver when no fallback is configured.
+func detectDockerDNS(fallback, resolvConf string) string {
+    probe := new(dns.Msg)
+    probe.SetQuestion(".", dns.TypeNS)
+    client := &dns.Client{Net: "udp", Timeout: detectTimeout}
+    _, _, err := client.Exchange(probe, dockerEmbeddedDNS)
+    if err == nil {
+        log.Printf("Detected Docker embedded DNS at %s", dockerEmbeddedDNS)
+        return dockerEmbeddedDNS
+    }
+    log.Printf("Docker embedded DNS at %s did not answer: %v", dockerEmbeddedDNS, err)
+
+    if fallback != "" {
+        log.Printf("Using DOCKER_DNS_FALLBACK %s as Docker DNS", fallback)
+        return fallback
+    }
+    if conf, err := dns.ClientConfigFromFile(resolvConf); err == nil && len(conf.Servers) > 0 {
+        server := net.JoinHostPort(conf.Servers[0], conf.Port)
+        log.Printf("Using system resolver %s from %s as Docker DNS", server, resolvConf)
+        return server
+    }
+    log.Printf("Warning: No system resolver found in %s, keeping %s as Docker DNS", resolvConf, dockerEmbeddedDNS)
+    return dockerEmbeddedDNS
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+
+    "github.com/miekg/dns"
+)
+
+func TestDetectDockerDNSFallback(t *testing.T) {
+    probe := new(dns.Msg)
+    probe.SetQuestion(".", dns.TypeNS)
+    if _, _, err := (&dns.Client{Timeout: 200 * time.Millisecond}).Exchange(probe, dockerEmbeddedDNS); err == nil {
+        t.Skipf("Docker embedded DNS answers at %s", dockerEmbeddedDNS)
+    }
+
+    resolvConf := filepath.Join(t.TempDir(), "resolv.conf")
+    if err := os.WriteFile(resolvConf, []byte("search example.com\nnameserver 10.9.8.7\nnameserver 10.9.8.8\n"), 0o644); err != nil {
+        t.Fatal(err)
+    }
+    for _, tt := range []struct {
+        fallback, resolvConf, want string
+    }{
+        {"10.1.1.1:53", resolvConf, "10.1.1.1:53"},
+        {"", resolvConf, "10.9.8.7:53"},
+        {"", filepath.Join(t.TempDir(), "missing"), dockerEmbeddedDNS},
+    } {
+        if got := detectDockerDNS(tt.fallback, tt.resolvConf); got != tt.want {
+            t.Errorf("detectDockerDNS(%q, %s) = %s, want %s", tt.fallback, filepath.Base(tt.resolvConf), got, tt.want)
+        }
+    }
+}
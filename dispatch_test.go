@@ -0,0 +1,27 @@
+package main
+
+import (
+    "testing"
+
+    "github.com/miekg/dns"
+)
+
+func TestDispatchWithoutSocket(t *testing.T) {
+    p := testProxy(t, "DOCKER_DNS", fakeDNS(t, answerA("172.17.0.2")))
+
+    r := new(dns.Msg)
+    r.SetQuestion("web.docker.", dns.TypeA)
+    m, err := p.dispatch(r)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if m.Id != r.Id || m.Rcode != dns.RcodeSuccess {
+        t.Fatalf("got %v, want a NOERROR reply to query %d", m, r.Id)
+    }
+    if len(m.Answer) != 1 {
+        t.Fatalf("got %d answers, want 1", len(m.Answer))
+    }
+    if a, ok := m.Answer[0].(*dns.A); !ok || a.A.String() != "172.17.0.2" {
+        t.Errorf("got %v, want web.docker. A 172.17.0.2", m.Answer[0])
+    }
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+    "context"
+    "time"
+
+    "github.com/miekg/dns"
+)
+
+// wantsValidation reports whether r asks for DNSSEC (the DO bit) and a
+// VALIDATING_UPSTREAM is configured to answer it.
+func (c *Config) wantsValidation(r *dns.Msg) bool {
+    if c.ValidatingUpstream == "" {
+        return false
+    }
+    opt := r.IsEdns0()
+    return opt != nil && opt.Do()
+}
+
+// forwardToValidating sends a DO query to VALIDATING_UPSTREAM. AD is passed
+// on only from this resolver, every other path leaves it clear.
+func (p *DNSProxy) forwardToValidating(ctx context.Context, cfg *Config, response *dns.Msg, request *dns.Msg) error {
+    domain := request.Question[0].Name
+    p.logDebug("DO bit set for %s, querying validating upstream %s", domain, cfg.ValidatingUpstream)
+
+    start := time.Now()
+    reply, err := p.exchange(ctx, cfg, request, cfg.ValidatingUpstream)
+    p.metrics.observeLookup("validating", start)
+    if err != nil {
+        p.logError("Validating upstream %s query failed for %s: %v", cfg.ValidatingUpstream, domain, err)
+        response.SetRcode(request, dns.RcodeServerFailure)
+        return err
+    }
+
+    p.copyReply(cfg, response, request, reply)
+    response.AuthenticatedData = reply.AuthenticatedData
+    return nil
+}
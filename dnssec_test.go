@@ -0,0 +1,52 @@
+package main
+
+import (
+    "testing"
+
+    "github.com/miekg/dns"
+)
+
+// answerAD answers like answerA with the AD flag set.
+func answerAD(ip string) dns.HandlerFunc {
+    return func(w dns.ResponseWriter, r *dns.Msg) {
+        m := new(dns.Msg)
+        m.SetReply(r)
+        m.AuthenticatedData = true
+        rr, _ := dns.NewRR(r.Question[0].Name + " 30 IN A " + ip)
+        m.Answer = append(m.Answer, rr)
+        w.WriteMsg(m)
+    }
+}
+
+func TestValidatingUpstream(t *testing.T) {
+    sawDO := make(chan bool, 1)
+    validating := fakeDNS(t, func(w dns.ResponseWriter, r *dns.Msg) {
+        opt := r.IsEdns0()
+        sawDO <- opt != nil && opt.Do()
+        answerAD("192.0.2.53")(w, r)
+    })
+    p := testProxy(t, "ENABLE_UPSTREAM", "true", "UPSTREAM_DNS", fakeDNS(t, answerAD("192.0.2.1")),
+        "VALIDATING_UPSTREAM", validating)
+
+    r := new(dns.Msg)
+    r.SetQuestion("example.com.", dns.TypeA)
+    r.SetEdns0(1232, true)
+    m, _ := p.dispatch(r)
+    if ip := answerIP(m); ip != "192.0.2.53" {
+        t.Fatalf("DO query answered %q, want 192.0.2.53 from the validating upstream", ip)
+    }
+    if !<-sawDO {
+        t.Error("validating upstream got the query without the DO bit")
+    }
+    if !m.AuthenticatedData {
+        t.Error("AD from the validating upstream not passed on")
+    }
+
+    m = query(p, "example.com.", dns.TypeA)
+    if ip := answerIP(m); ip != "192.0.2.1" {
+        t.Errorf("query without DO answered %q, want 192.0.2.1 from UPSTREAM_DNS", ip)
+    }
+    if m.AuthenticatedData {
+        t.Error("AD passed on from UPSTREAM_DNS")
+    }
+}
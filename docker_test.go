@@ -0,0 +1,309 @@
+package main
+
+import (
+    "context"
+    "net"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "testing"
+    "time"
+
+    "github.com/miekg/dns"
+)
+
+func TestPartialAnswers(t *testing.T) {
+    docker := fakeDNS(t, func(w dns.ResponseWriter, r *dns.Msg) {
+        m := new(dns.Msg)
+        m.SetRcode(r, dns.RcodeServerFailure)
+        rr, _ := dns.NewRR(r.Question[0].Name + " 30 IN A 172.17.0.2")
+        m.Answer = append(m.Answer, rr)
+        w.WriteMsg(m)
+    })
+    for _, tt := range []struct {
+        partial string
+        want    string
+    }{
+        {"true", "172.17.0.2"},
+        {"false", ""},
+    } {
+        p := testProxy(t, "DOCKER_DNS", docker, "USE_PARTIAL_ANSWERS", tt.partial)
+        m := query(p, "web.docker.", dns.TypeA)
+        if ip := answerIP(m); ip != tt.want {
+            t.Errorf("USE_PARTIAL_ANSWERS=%s: answer %q, want %q", tt.partial, ip, tt.want)
+        }
+        if tt.want != "" && m.Rcode != dns.RcodeSuccess {
+            t.Errorf("USE_PARTIAL_ANSWERS=%s: rcode %s, want NOERROR with the partial answers", tt.partial, dns.RcodeToString[m.Rcode])
+        }
+    }
+}
+
+func TestTryFullNameFirst(t *testing.T) {
+    for _, tt := range []struct {
+        full  string
+        asked []string
+    }{
+        {"true", []string{"web.docker."}},
+        {"false", []string{"web."}},
+    } {
+        var mu sync.Mutex
+        var asked []string
+        docker := fakeDNS(t, func(w dns.ResponseWriter, r *dns.Msg) {
+            mu.Lock()
+            asked = append(asked, r.Question[0].Name)
+            mu.Unlock()
+            answerA("172.17.0.2")(w, r)
+        })
+        p := testProxy(t, "DOCKER_DNS", docker, "TRY_FULL_NAME_FIRST", tt.full)
+        if ip := answerIP(query(p, "web.docker.", dns.TypeA)); ip != "172.17.0.2" {
+            t.Errorf("TRY_FULL_NAME_FIRST=%s: answer %q, want 172.17.0.2", tt.full, ip)
+        }
+        mu.Lock()
+        if len(asked) != len(tt.asked) || asked[0] != tt.asked[0] {
+            t.Errorf("TRY_FULL_NAME_FIRST=%s: Docker DNS asked for %q, want %q", tt.full, asked, tt.asked)
+        }
+        mu.Unlock()
+    }
+}
+
+func TestDockerAnswerAlreadySuffixed(t *testing.T) {
+    for _, owner := range []string{"web.", "web.docker.", "WEB.docker."} {
+        owner := owner
+        docker := fakeDNS(t, func(w dns.ResponseWriter, r *dns.Msg) {
+            m := new(dns.Msg)
+            m.SetReply(r)
+            rr, _ := dns.NewRR(owner + " 30 IN A 172.17.0.2")
+            m.Answer = append(m.Answer, rr)
+            w.WriteMsg(m)
+        })
+        p := testProxy(t, "DOCKER_DNS", docker)
+        m := query(p, "web.docker.", dns.TypeA)
+        if m == nil || len(m.Answer) != 1 {
+            t.Fatalf("Docker answering %s: got %v, want one answer", owner, m)
+        }
+        if name := m.Answer[0].Header().Name; !strings.EqualFold(name, "web.docker.") {
+            t.Errorf("Docker answering %s: answer owner %s, want web.docker.", owner, name)
+        }
+        if ip := answerIP(m); ip != "172.17.0.2" {
+            t.Errorf("Docker answering %s: answer %q, want 172.17.0.2", owner, ip)
+        }
+    }
+}
+
+func TestDockerMaxTTL(t *testing.T) {
+    answer := func(w dns.ResponseWriter, r *dns.Msg) {
+        m := new(dns.Msg)
+        m.SetReply(r)
+        rr, _ := dns.NewRR(r.Question[0].Name + " 600 IN A 172.17.0.2")
+        m.Answer = append(m.Answer, rr)
+        w.WriteMsg(m)
+    }
+    p := testProxy(t, "DOCKER_DNS", fakeDNS(t, answer), "ENABLE_UPSTREAM", "true", "UPSTREAM_DNS", fakeDNS(t, answer),
+        "DOCKER_MAX_TTL", "10")
+
+    if m := query(p, "web.docker.", dns.TypeA); len(m.Answer) != 1 || m.Answer[0].Header().Ttl != 10 {
+        t.Errorf("Docker answer %v, want its TTL capped at 10", m.Answer)
+    }
+    if m := query(p, "example.com.", dns.TypeA); len(m.Answer) != 1 || m.Answer[0].Header().Ttl != 600 {
+        t.Errorf("upstream answer %v, want its TTL of 600 untouched", m.Answer)
+    }
+}
+
+func TestStripRepeatedSuffix(t *testing.T) {
+    for _, tt := range []struct {
+        repeated string
+        asked    string
+    }{
+        {"true", "web."},
+        {"false", "web.docker."},
+    } {
+        asked := make(chan string, 1)
+        docker := fakeDNS(t, func(w dns.ResponseWriter, r *dns.Msg) {
+            select {
+            case asked <- r.Question[0].Name:
+            default:
+            }
+            answerA("172.17.0.2")(w, r)
+        })
+        p := testProxy(t, "DOCKER_DNS", docker, "STRIP_REPEATED", tt.repeated)
+        m := query(p, "web.docker.docker.", dns.TypeA)
+        if got := <-asked; got != tt.asked {
+            t.Errorf("STRIP_REPEATED=%s: Docker DNS asked for %s, want %s", tt.repeated, got, tt.asked)
+        }
+        if m == nil || len(m.Answer) != 1 {
+            t.Fatalf("STRIP_REPEATED=%s: got %v, want one answer", tt.repeated, m)
+        }
+        if name := m.Answer[0].Header().Name; name != "web.docker.docker." {
+            t.Errorf("STRIP_REPEATED=%s: answer for %s, want the name asked web.docker.docker.", tt.repeated, name)
+        }
+    }
+}
+
+func TestDockerDNSPerFamily(t *testing.T) {
+    resolver := func(v4, v6 string) string {
+        return fakeDNS(t, func(w dns.ResponseWriter, r *dns.Msg) {
+            m := new(dns.Msg)
+            m.SetReply(r)
+            q := r.Question[0]
+            switch q.Qtype {
+            case dns.TypeA:
+                rr, _ := dns.NewRR(q.Name + " 30 IN A " + v4)
+                m.Answer = append(m.Answer, rr)
+            case dns.TypeAAAA:
+                rr, _ := dns.NewRR(q.Name + " 30 IN AAAA " + v6)
+                m.Answer = append(m.Answer, rr)
+            }
+            w.WriteMsg(m)
+        })
+    }
+    shared := resolver("172.17.0.1", "fd00::1")
+    v4 := resolver("172.17.0.4", "fd00::4")
+    v6 := resolver("172.17.0.6", "fd00::6")
+
+    for _, tt := range []struct {
+        v4, v6   string
+        wantA    string
+        wantAAAA string
+    }{
+        {v4, v6, "172.17.0.4", "fd00::6"},
+        {v4, "", "172.17.0.4", "fd00::1"},
+        {"", "", "172.17.0.1", "fd00::1"},
+    } {
+        p := testProxy(t, "DOCKER_DNS", shared, "DOCKER_DNS_V4", tt.v4, "DOCKER_DNS_V6", tt.v6)
+        if ip := answerIP(query(p, "web.docker.", dns.TypeA)); ip != tt.wantA {
+            t.Errorf("DOCKER_DNS_V4=%q: A answer %q, want %s", tt.v4, ip, tt.wantA)
+        }
+        m := query(p, "web.docker.", dns.TypeAAAA)
+        if m == nil || len(m.Answer) != 1 {
+            t.Fatalf("DOCKER_DNS_V6=%q: got %v, want one AAAA answer", tt.v6, m)
+        }
+        if aaaa, ok := m.Answer[0].(*dns.AAAA); !ok || aaaa.AAAA.String() != tt.wantAAAA {
+            t.Errorf("DOCKER_DNS_V6=%q: AAAA answer %v, want %s", tt.v6, m.Answer[0], tt.wantAAAA)
+        }
+    }
+}
+
+func TestTruncatedReplyRetriedOverTCP(t *testing.T) {
+    server := fakeDNSBoth(t, func(w dns.ResponseWriter, r *dns.Msg) {
+        if isUDP(w.RemoteAddr()) {
+            m := new(dns.Msg)
+            m.SetReply(r)
+            m.Truncated = true
+            w.WriteMsg(m)
+            return
+        }
+        answerA("172.17.0.9")(w, r)
+    })
+    for _, tt := range []struct {
+        path string
+        name string
+        env  []string
+    }{
+        {"Docker DNS", "web.docker.", []string{"DOCKER_DNS", server}},
+        {"upstream", "example.com.", []string{"ENABLE_UPSTREAM", "true", "UPSTREAM_DNS", server}},
+    } {
+        p := testProxy(t, tt.env...)
+        if ip := answerIP(query(p, tt.name, dns.TypeA)); ip != "172.17.0.9" {
+            t.Errorf("%s: answer %q, want 172.17.0.9 from the TCP retry", tt.path, ip)
+        }
+        if n := atomic.LoadInt64(&p.tcpRetries); n != 1 {
+            t.Errorf("%s: %d TCP retries, want 1", tt.path, n)
+        }
+    }
+}
+
+func TestAAAAOverIPv6Listener(t *testing.T) {
+    pc, err := net.ListenPacket("udp6", "[::1]:0")
+    if err != nil {
+        t.Skipf("no IPv6 loopback: %v", err)
+    }
+    docker := fakeDNS(t, func(w dns.ResponseWriter, r *dns.Msg) {
+        m := new(dns.Msg)
+        m.SetReply(r)
+        if r.Question[0].Qtype == dns.TypeAAAA {
+            rr, _ := dns.NewRR(r.Question[0].Name + " 30 IN AAAA fd00::5")
+            m.Answer = append(m.Answer, rr)
+        }
+        w.WriteMsg(m)
+    })
+    p := testProxy(t, "DOCKER_DNS", docker)
+    server := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(p.handleRequest)}
+    go server.ActivateAndServe()
+    t.Cleanup(func() { server.Shutdown() })
+
+    r := new(dns.Msg)
+    r.SetQuestion("web.docker.", dns.TypeAAAA)
+    m, _, err := (&dns.Client{Timeout: 2 * time.Second}).Exchange(r, pc.LocalAddr().String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(m.Answer) != 1 {
+        t.Fatalf("got %v, want one AAAA answer", m)
+    }
+    aaaa, ok := m.Answer[0].(*dns.AAAA)
+    if !ok || aaaa.Hdr.Name != "web.docker." || aaaa.AAAA.String() != "fd00::5" {
+        t.Errorf("answer %v, want web.docker. AAAA fd00::5", m.Answer[0])
+    }
+}
+
+// droppingDNS drops the first drop queries, answers the rest with an A
+// record and counts every query it gets.
+func droppingDNS(t *testing.T, drop int64, count *int64) string {
+    return fakeDNS(t, func(w dns.ResponseWriter, r *dns.Msg) {
+        if atomic.AddInt64(count, 1) <= drop {
+            return
+        }
+        answerA("172.18.0.2")(w, r)
+    })
+}
+
+func TestDockerDNSRetries(t *testing.T) {
+    exchange := func(p *DNSProxy, server string) (*dns.Msg, time.Duration, error) {
+        query := new(dns.Msg)
+        query.SetQuestion("web.", dns.TypeA)
+        start := time.Now()
+        reply, err := p.exchangeDocker(context.Background(), p.config(), query, server)
+        return reply, time.Since(start), err
+    }
+
+    // A dropped query is retried after the timeout and the backoff
+    var count int64
+    p := testProxy(t, "TIMEOUT_SECONDS", "1", "DOCKER_DNS_RETRIES", "3")
+    reply, elapsed, err := exchange(p, droppingDNS(t, 1, &count))
+    if err != nil || len(reply.Answer) != 1 {
+        t.Fatalf("got %v, %v, want the answer to the retry", reply, err)
+    }
+    if n := atomic.LoadInt64(&count); n != 2 {
+        t.Errorf("Docker DNS got %d queries, want 2", n)
+    }
+    if elapsed > dockerRetryBudget*time.Second {
+        t.Errorf("retried answer took %v, want it within the %ds budget", elapsed, dockerRetryBudget)
+    }
+
+    // Retries stop once the budget of twice the timeout is spent, before
+    // DOCKER_DNS_RETRIES runs out
+    atomic.StoreInt64(&count, 0)
+    _, elapsed, err = exchange(p, droppingDNS(t, 100, &count))
+    if err == nil {
+        t.Fatal("got an answer from a server dropping every query")
+    }
+    if n := atomic.LoadInt64(&count); n != 2 {
+        t.Errorf("Docker DNS got %d queries, want 2 within the budget", n)
+    }
+    if elapsed > dockerRetryBudget*time.Second+500*time.Millisecond {
+        t.Errorf("gave up after %v, want about the %ds budget", elapsed, dockerRetryBudget)
+    }
+
+    // A malformed reply is not a network error and is not retried
+    atomic.StoreInt64(&count, 0)
+    malformed := fakeDNS(t, func(w dns.ResponseWriter, r *dns.Msg) {
+        atomic.AddInt64(&count, 1)
+        w.Write([]byte{0, 1, 2})
+    })
+    if _, _, err := exchange(p, malformed); err == nil {
+        t.Fatal("got an answer from a malformed reply")
+    }
+    if n := atomic.LoadInt64(&count); n != 1 {
+        t.Errorf("Docker DNS got %d queries for a malformed reply, want 1", n)
+    }
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+    "crypto/tls"
+    "crypto/x509"
+    "log"
+    "net"
+    "strings"
+
+    "github.com/miekg/dns"
+)
+
+// Values of UPSTREAM_PROTOCOL
+const (
+    protocolUDP = "udp"
+    protocolDoT = "tcp-tls"
+)
+
+// Port used for UPSTREAM_DNS entries without one
+const (
+    dnsPort = "53"
+    dotPort = "853"
+)
+
+func getUpstreamProtocolEnv(key string) string {
+    protocol := strings.ToLower(getEnv(key, protocolUDP))
+    if protocol != protocolUDP && protocol != protocolDoT {
+        log.Printf("Warning: Invalid %s: %s, expected udp or tcp-tls, using udp", key, protocol)
+        return protocolUDP
+    }
+    return protocol
+}
+
+// withDefaultPort adds port to the servers given without one.
+func withDefaultPort(servers []string, port string) []string {
+    for i, server := range servers {
+        if _, _, err := net.SplitHostPort(server); err != nil {
+            servers[i] = net.JoinHostPort(strings.Trim(server, "[]"), port)
+        }
+    }
+    return servers
+}
+
+// addrWithDefaultPort is withDefaultPort for a single server that may be unset.
+func addrWithDefaultPort(server, port string) string {
+    if server == "" {
+        return ""
+    }
+    return withDefaultPort([]string{server}, port)[0]
+}
+
+func (c *Config) upstreamPort() string {
+    if c.UpstreamProtocol == protocolDoT {
+        return dotPort
+    }
+    return dnsPort
+}
+
+func (c *Config) isUpstream(server string) bool {
+    for _, upstream := range c.UpstreamDNS {
+        if upstream == server {
+            return true
+        }
+    }
+    for _, rule := range c.ScheduleRules {
+        for _, upstream := range rule.upstreams {
+            if upstream == server {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+// Roots that DNS over TLS upstream certificates must chain to, nil for the
+// system roots
+var dotRootCAs *x509.CertPool
+
+// clientFor returns the client for exchanges with server: DNS over TLS for
+// UPSTREAM_DNS entries under UPSTREAM_PROTOCOL=tcp-tls, UDP otherwise. The
+// certificate must be valid for UPSTREAM_TLS_SERVERNAME, or for the host of
+// the server address when that is not set.
+func (c *Config) clientFor(server string, qtype uint16) *dns.Client {
+    client := newClient(c)
+    client.Timeout = c.timeoutFor(qtype)
+    if c.UpstreamProtocol != protocolDoT || !c.isUpstream(server) {
+        return client
+    }
+
+    serverName := c.UpstreamTLSServerName
+    if serverName == "" {
+        serverName, _, _ = net.SplitHostPort(server)
+    }
+    client.Net = protocolDoT
+    client.TLSConfig = &tls.Config{ServerName: serverName, RootCAs: dotRootCAs, MinVersion: tls.VersionTLS12}
+    return client
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+    "context"
+    "crypto/tls"
+    "sync"
+    "time"
+
+    "github.com/miekg/dns"
+)
+
+const (
+    // Idle DNS over TLS connections kept per upstream
+    maxIdleDoTConns = 4
+    // Idle connections older than this are closed rather than reused, as
+    // upstreams drop idle clients after a while
+    dotIdleTimeout = 10 * time.Second
+)
+
+type idleConn struct {
+    conn  *dns.Conn
+    since time.Time
+}
+
+// dotPool keeps DNS over TLS connections open between exchanges, so a query
+// to a DoT upstream doesn't cost a TCP and TLS handshake each time. New
+// connections resume earlier TLS sessions where the upstream allows it.
+type dotPool struct {
+    mu       sync.Mutex
+    idle     map[string][]idleConn
+    sessions tls.ClientSessionCache
+}
+
+func newDoTPool() *dotPool {
+    return &dotPool{idle: make(map[string][]idleConn), sessions: tls.NewLRUClientSessionCache(0)}
+}
+
+// exchange sends m to server over a pooled connection, or a new one dialed
+// with client. A pooled connection the upstream has closed in the meantime
+// is retried once on a new connection.
+func (d *dotPool) exchange(ctx context.Context, client *dns.Client, m *dns.Msg, server string) (*dns.Msg, error) {
+    client.TLSConfig.ClientSessionCache = d.sessions
+    key := server + "|" + client.TLSConfig.ServerName
+
+    if conn := d.get(key); conn != nil {
+        reply, _, err := client.ExchangeWithConnContext(ctx, m, conn)
+        if err == nil {
+            d.put(key, conn)
+            return reply, nil
+        }
+        conn.Close()
+        if ctx.Err() != nil {
+            return nil, err
+        }
+    }
+
+    conn, err := client.DialContext(ctx, server)
+    if err != nil {
+        return nil, err
+    }
+    reply, _, err := client.ExchangeWithConnContext(ctx, m, conn)
+    if err != nil {
+        conn.Close()
+        return nil, err
+    }
+    d.put(key, conn)
+    return reply, nil
+}
+
+// get takes the most recently used idle connection for key, closing the
+// ones idle for too long.
+func (d *dotPool) get(key string) *dns.Conn {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+
+    conns := d.idle[key]
+    for len(conns) > 0 {
+        c := conns[len(conns)-1]
+        conns = conns[:len(conns)-1]
+        if time.Since(c.since) < dotIdleTimeout {
+            d.idle[key] = conns
+            return c.conn
+        }
+        c.conn.Close()
+    }
+    delete(d.idle, key)
+    return nil
+}
+
+func (d *dotPool) put(key string, conn *dns.Conn) {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+
+    if len(d.idle[key]) >= maxIdleDoTConns {
+        conn.Close()
+        return
+    }
+    d.idle[key] = append(d.idle[key], idleConn{conn, time.Now()})
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+    "context"
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/tls"
+    "crypto/x509"
+    "math/big"
+    "net"
+    "sync"
+    "testing"
+    "time"
+
+    "github.com/miekg/dns"
+)
+
+// acceptCounter records the connections a listener accepts.
+type acceptCounter struct {
+    net.Listener
+    mu    sync.Mutex
+    conns []net.Conn
+}
+
+func (l *acceptCounter) Accept() (net.Conn, error) {
+    conn, err := l.Listener.Accept()
+    if err == nil {
+        l.mu.Lock()
+        l.conns = append(l.conns, conn)
+        l.mu.Unlock()
+    }
+    return conn, err
+}
+
+func (l *acceptCounter) accepted() int {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    return len(l.conns)
+}
+
+// closeAll drops every accepted connection, like an upstream timing out
+// idle clients.
+func (l *acceptCounter) closeAll() {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    for _, conn := range l.conns {
+        conn.Close()
+    }
+}
+
+// fakeDoT serves handler over TLS on a local port with a certificate for
+// 127.0.0.1 that dotRootCAs trusts for the test.
+func fakeDoT(t *testing.T, handler dns.HandlerFunc) (string, *acceptCounter) {
+    t.Helper()
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        t.Fatal(err)
+    }
+    template := &x509.Certificate{
+        SerialNumber: big.NewInt(1),
+        NotBefore:    time.Now().Add(-time.Hour),
+        NotAfter:     time.Now().Add(time.Hour),
+        IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+        KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+        ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+        IsCA:         true,
+
+        BasicConstraintsValid: true,
+    }
+    der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+    if err != nil {
+        t.Fatal(err)
+    }
+    cert, err := x509.ParseCertificate(der)
+    if err != nil {
+        t.Fatal(err)
+    }
+    roots := x509.NewCertPool()
+    roots.AddCert(cert)
+    dotRootCAs = roots
+    t.Cleanup(func() { dotRootCAs = nil })
+
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    counter := &acceptCounter{Listener: ln}
+    config := &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+    server := &dns.Server{Listener: tls.NewListener(counter, config), Net: "tcp-tls", Handler: handler}
+    go server.ActivateAndServe()
+    t.Cleanup(func() { server.Shutdown() })
+    return ln.Addr().String(), counter
+}
+
+func TestDoTReusesConnections(t *testing.T) {
+    upstream, counter := fakeDoT(t, answerA("192.0.2.1"))
+    p := testProxy(t, "ENABLE_UPSTREAM", "true", "UPSTREAM_PROTOCOL", "tcp-tls", "UPSTREAM_DNS", upstream)
+    cfg := p.config()
+
+    exchange := func() {
+        t.Helper()
+        m := new(dns.Msg)
+        m.SetQuestion("example.com.", dns.TypeA)
+        reply, err := p.exchange(context.Background(), cfg, m, upstream)
+        if err != nil {
+            t.Fatalf("exchange: %v", err)
+        }
+        if len(reply.Answer) != 1 {
+            t.Fatalf("got %v, want one answer", reply)
+        }
+    }
+
+    for i := 0; i < 5; i++ {
+        exchange()
+    }
+    if n := counter.accepted(); n != 1 {
+        t.Errorf("5 exchanges opened %d connections, want 1", n)
+    }
+
+    // A connection the upstream closed is replaced transparently
+    counter.closeAll()
+    exchange()
+    if n := counter.accepted(); n != 2 {
+        t.Errorf("%d connections after the upstream closed the first, want 2", n)
+    }
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+    "fmt"
+    "time"
+
+    "github.com/miekg/dns"
+)
+
+// addEDE attaches an Extended DNS Error (RFC 8914) to m when ENABLE_EDE is
+// set. Only clients that sent an OPT record get one, others couldn't parse
+// it.
+func (c *Config) addEDE(r *dns.Msg, m *dns.Msg, code uint16, text string) {
+    reqOpt := r.IsEdns0()
+    if !c.EnableEDE || reqOpt == nil {
+        return
+    }
+    opt := m.IsEdns0()
+    if opt == nil {
+        m.SetEdns0(reqOpt.UDPSize(), reqOpt.Do())
+        opt = m.IsEdns0()
+    }
+    opt.Option = append(opt.Option, &dns.EDNS0_EDE{InfoCode: code, ExtraText: text})
+}
+
+// retryHint is the EDE text telling a rate-limited client when to come back,
+// like an HTTP Retry-After in whole seconds.
+func retryHint(reason string, wait time.Duration) string {
+    seconds := int((wait + time.Second - 1) / time.Second)
+    if seconds < 1 {
+        seconds = 1
+    }
+    return fmt.Sprintf("%s, retry after %ds", reason, seconds)
+}
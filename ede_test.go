@@ -0,0 +1,72 @@
+package main
+
+import (
+    "net"
+    "testing"
+    "time"
+
+    "github.com/miekg/dns"
+)
+
+// edeOption returns the Extended DNS Error in m, or nil when there is none.
+func edeOption(m *dns.Msg) *dns.EDNS0_EDE {
+    if opt := m.IsEdns0(); opt != nil {
+        for _, o := range opt.Option {
+            if ede, ok := o.(*dns.EDNS0_EDE); ok {
+                return ede
+            }
+        }
+    }
+    return nil
+}
+
+func TestRetryHint(t *testing.T) {
+    for wait, want := range map[time.Duration]string{
+        0:                       "Too many queries, retry after 1s",
+        300 * time.Millisecond:  "Too many queries, retry after 1s",
+        1500 * time.Millisecond: "Too many queries, retry after 2s",
+        3 * time.Second:         "Too many queries, retry after 3s",
+    } {
+        if got := retryHint("Too many queries", wait); got != want {
+            t.Errorf("retryHint(%v) = %q, want %q", wait, got, want)
+        }
+    }
+}
+
+func TestRateLimitedEDE(t *testing.T) {
+    client := &net.UDPAddr{IP: net.IPv4(10, 1, 1, 5), Port: 40000}
+    ask := func(p *DNSProxy) *dns.Msg {
+        r := new(dns.Msg)
+        r.SetQuestion(hostInternalName, dns.TypeA)
+        r.SetEdns0(1232, false)
+        return queryFrom(p, client, r)
+    }
+
+    for _, tt := range []struct {
+        ede  string
+        want bool
+    }{
+        {"true", true},
+        {"false", false},
+    } {
+        p := testProxy(t, "HOST_INTERNAL_IP", "192.0.2.1", "RATE_LIMIT_QPS", "1", "RATE_LIMIT_BURST", "1",
+            "ENABLE_EDE", tt.ede)
+        if m := ask(p); m == nil || m.Rcode != dns.RcodeSuccess || edeOption(m) != nil {
+            t.Fatalf("ENABLE_EDE=%s: first query got %v, want an answer without EDE", tt.ede, m)
+        }
+        m := ask(p)
+        if m == nil || m.Rcode != dns.RcodeRefused {
+            t.Fatalf("ENABLE_EDE=%s: query over the limit got %v, want REFUSED", tt.ede, m)
+        }
+        ede := edeOption(m)
+        if !tt.want {
+            if ede != nil {
+                t.Errorf("ENABLE_EDE=false: REFUSED carries EDE %v", ede)
+            }
+            continue
+        }
+        if ede == nil || ede.InfoCode != dns.ExtendedErrorCodeOther || ede.ExtraText != "Too many queries, retry after 1s" {
+            t.Errorf("ENABLE_EDE=true: EDE %v, want Other with a retry after 1s hint", ede)
+        }
+    }
+}
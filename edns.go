@@ -0,0 +1,133 @@
+package main
+
+import (
+    "log"
+    "sort"
+    "strings"
+
+    "github.com/miekg/dns"
+)
+
+// What happens to a client EDNS option under EDNS_POLICY
+type ednsAction string
+
+const (
+    // Sent on to the upstream with the query (the default)
+    ednsForward ednsAction = "forward"
+    // Not sent upstream, echoed back to the client as received
+    ednsReflect ednsAction = "reflect"
+    // Neither sent upstream nor passed back from the upstream reply
+    ednsStrip ednsAction = "strip"
+)
+
+// Option names accepted in EDNS_POLICY
+var ednsOptionCodes = map[string]uint16{
+    "cookie":  dns.EDNS0COOKIE,
+    "padding": dns.EDNS0PADDING,
+    "nsid":    dns.EDNS0NSID,
+    "ecs":     dns.EDNS0SUBNET,
+}
+
+// getEDNSPolicyEnv parses a comma-separated list of option=action pairs,
+// e.g. `ecs=strip,nsid=reflect`. Options not listed are forwarded.
+func getEDNSPolicyEnv(key string) map[uint16]ednsAction {
+    var policy map[uint16]ednsAction
+    for _, entry := range getListEnv(key, "") {
+        name, action, ok := strings.Cut(strings.ToLower(entry), "=")
+        code, known := ednsOptionCodes[strings.TrimSpace(name)]
+        action = strings.TrimSpace(action)
+        if !ok || !known {
+            log.Printf("Warning: Invalid entry in %s: %s, expected cookie, padding, nsid or ecs=action", key, entry)
+            continue
+        }
+        if a := ednsAction(action); a != ednsForward && a != ednsReflect && a != ednsStrip {
+            log.Printf("Warning: Invalid action in %s: %s, expected forward, reflect or strip", key, action)
+            continue
+        }
+        if policy == nil {
+            policy = make(map[uint16]ednsAction)
+        }
+        policy[code] = ednsAction(action)
+    }
+    return policy
+}
+
+func (c *Config) ednsAction(code uint16) ednsAction {
+    if action, ok := c.EDNSPolicy[code]; ok {
+        return action
+    }
+    return ednsForward
+}
+
+// ednsPolicyString lists the configured policy in EDNS_POLICY form.
+func (c *Config) ednsPolicyString() string {
+    var entries []string
+    for name, code := range ednsOptionCodes {
+        if action, ok := c.EDNSPolicy[code]; ok {
+            entries = append(entries, name+"="+string(action))
+        }
+    }
+    sort.Strings(entries)
+    return strings.Join(entries, ",")
+}
+
+// ednsRequest returns the request to send on, without the client options
+// that are reflected or stripped. r itself is left untouched.
+func (c *Config) ednsRequest(r *dns.Msg) *dns.Msg {
+    opt := r.IsEdns0()
+    if len(c.EDNSPolicy) == 0 || opt == nil {
+        return r
+    }
+
+    req := r.Copy()
+    opt = req.IsEdns0()
+    options := opt.Option[:0]
+    for _, o := range opt.Option {
+        if c.ednsAction(o.Option()) == ednsForward {
+            options = append(options, o)
+        }
+    }
+    opt.Option = options
+    return req
+}
+
+// ednsResponse drops options under a reflect or strip policy from the reply
+// and echoes the reflected ones from the client request r.
+func (c *Config) ednsResponse(r *dns.Msg, m *dns.Msg) {
+    reqOpt := r.IsEdns0()
+    if len(c.EDNSPolicy) == 0 || reqOpt == nil {
+        return
+    }
+
+    opt := m.IsEdns0()
+    if opt != nil {
+        options := opt.Option[:0]
+        for _, o := range opt.Option {
+            if c.ednsAction(o.Option()) == ednsForward {
+                options = append(options, o)
+            }
+        }
+        opt.Option = options
+    }
+
+    for _, o := range reqOpt.Option {
+        if c.ednsAction(o.Option()) != ednsReflect {
+            continue
+        }
+        if opt == nil {
+            m.SetEdns0(reqOpt.UDPSize(), reqOpt.Do())
+            opt = m.IsEdns0()
+        }
+        opt.Option = append(opt.Option, o)
+    }
+}
+
+// echoOPT adds an OPT record to m when the client sent one and the answer
+// carries none, as with answers built from Docker DNS, so the client sees
+// consistent EDNS state (RFC 6891). It echoes the client's buffer size and
+// DO bit; fitUDPSize lowers the size to MAX_CLIENT_UDP_SIZE.
+func echoOPT(r *dns.Msg, m *dns.Msg) {
+    if reqOpt := r.IsEdns0(); reqOpt != nil && m.IsEdns0() == nil {
+        m.SetEdns0(reqOpt.UDPSize(), reqOpt.Do())
+    }
+}
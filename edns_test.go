@@ -0,0 +1,212 @@
+package main
+
+import (
+    "net"
+    "testing"
+
+    "github.com/miekg/dns"
+)
+
+// expireIn returns the EDNS EXPIRE value in m, or -1 when there is none.
+func expireIn(m *dns.Msg) int64 {
+    if v := expireOption(m); v != nil {
+        return int64(*v)
+    }
+    return -1
+}
+
+func TestExpireOptionForwarded(t *testing.T) {
+    upstream := fakeDNS(t, func(w dns.ResponseWriter, r *dns.Msg) {
+        m := new(dns.Msg)
+        m.SetReply(r)
+        rr, _ := dns.NewRR(r.Question[0].Name + " 300 IN A 192.0.2.1")
+        m.Answer = append(m.Answer, rr)
+        m.SetEdns0(1232, false)
+        opt := m.IsEdns0()
+        opt.Option = append(opt.Option, &dns.EDNS0_EXPIRE{Code: dns.EDNS0EXPIRE, Expire: 3600})
+        w.WriteMsg(m)
+    })
+    p := testProxy(t, "ENABLE_UPSTREAM", "true", "UPSTREAM_DNS", upstream, "CACHE_ENABLED", "true")
+
+    r := new(dns.Msg)
+    r.SetQuestion("example.com.", dns.TypeA)
+    r.SetEdns0(1232, false)
+    r.IsEdns0().Option = append(r.IsEdns0().Option, &dns.EDNS0_EXPIRE{Code: dns.EDNS0EXPIRE, Empty: true})
+
+    for _, source := range []string{"upstream", "cache"} {
+        m, _ := p.dispatch(r.Copy())
+        if expire := expireIn(m); expire < 3590 || expire > 3600 {
+            t.Errorf("EXPIRE from the %s is %d, want about 3600", source, expire)
+        }
+    }
+    if hits := p.cache.statsByType()["A"].Hits; hits != 1 {
+        t.Errorf("%d cache hits, want the second answer from the cache", hits)
+    }
+}
+
+func TestMaxClientUDPSize(t *testing.T) {
+    upstream := fakeDNSBoth(t, func(w dns.ResponseWriter, r *dns.Msg) {
+        m := new(dns.Msg)
+        m.SetReply(r)
+        for i := 0; i < 150; i++ {
+            m.Answer = append(m.Answer, &dns.A{
+                Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 30},
+                A:   net.IPv4(10, 0, byte(i>>8), byte(i)),
+            })
+        }
+        m.Compress = true
+        w.WriteMsg(m)
+    })
+    client := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}
+
+    for _, tt := range []struct {
+        max       string
+        truncated bool
+        limit     int
+    }{
+        {"1432", true, 1432},
+        {"0", false, dns.MaxMsgSize},
+    } {
+        p := testProxy(t, "ENABLE_UPSTREAM", "true", "UPSTREAM_DNS", upstream, "MAX_CLIENT_UDP_SIZE", tt.max)
+        r := new(dns.Msg)
+        r.SetQuestion("big.example.com.", dns.TypeA)
+        r.SetEdns0(65535, false)
+        m := queryFrom(p, client, r)
+        if m == nil {
+            t.Fatalf("MAX_CLIENT_UDP_SIZE=%s: no response", tt.max)
+        }
+        packed, err := m.Pack()
+        if err != nil {
+            t.Fatal(err)
+        }
+        if len(packed) > tt.limit {
+            t.Errorf("MAX_CLIENT_UDP_SIZE=%s: %d byte UDP response, want at most %d", tt.max, len(packed), tt.limit)
+        }
+        if m.Truncated != tt.truncated {
+            t.Errorf("MAX_CLIENT_UDP_SIZE=%s: TC %v, want %v", tt.max, m.Truncated, tt.truncated)
+        }
+        if !tt.truncated && len(m.Answer) != 150 {
+            t.Errorf("MAX_CLIENT_UDP_SIZE=%s: %d answers, want all 150", tt.max, len(m.Answer))
+        }
+    }
+}
+
+// ednsCodes returns the options in the OPT record of m by option code.
+func ednsCodes(m *dns.Msg) map[uint16]dns.EDNS0 {
+    codes := make(map[uint16]dns.EDNS0)
+    if opt := m.IsEdns0(); opt != nil {
+        for _, o := range opt.Option {
+            codes[o.Option()] = o
+        }
+    }
+    return codes
+}
+
+func TestEDNSPolicy(t *testing.T) {
+    sent := make(chan map[uint16]dns.EDNS0, 1)
+    upstream := fakeDNS(t, func(w dns.ResponseWriter, r *dns.Msg) {
+        sent <- ednsCodes(r)
+        m := new(dns.Msg)
+        m.SetReply(r)
+        m.SetEdns0(1232, false)
+        opt := m.IsEdns0()
+        opt.Option = append(opt.Option,
+            &dns.EDNS0_NSID{Code: dns.EDNS0NSID, Nsid: "7570"},
+            &dns.EDNS0_PADDING{Padding: make([]byte, 8)},
+            &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, SourceScope: 24, Address: net.IPv4(198, 51, 100, 0)})
+        w.WriteMsg(m)
+    })
+    p := testProxy(t, "ENABLE_UPSTREAM", "true", "UPSTREAM_DNS", upstream,
+        "EDNS_POLICY", "nsid=reflect,padding=strip")
+
+    r := new(dns.Msg)
+    r.SetQuestion("example.com.", dns.TypeA)
+    r.SetEdns0(1232, false)
+    opt := r.IsEdns0()
+    opt.Option = append(opt.Option,
+        &dns.EDNS0_NSID{Code: dns.EDNS0NSID, Nsid: "636c"},
+        &dns.EDNS0_PADDING{Padding: make([]byte, 16)},
+        &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: net.IPv4(198, 51, 100, 0)})
+    m, _ := p.dispatch(r)
+    if m == nil {
+        t.Fatal("no response")
+    }
+
+    upstreamGot := <-sent
+    if _, ok := upstreamGot[dns.EDNS0SUBNET]; !ok {
+        t.Error("ecs not forwarded upstream")
+    }
+    if _, ok := upstreamGot[dns.EDNS0NSID]; ok {
+        t.Error("reflected nsid forwarded upstream")
+    }
+    if _, ok := upstreamGot[dns.EDNS0PADDING]; ok {
+        t.Error("stripped padding forwarded upstream")
+    }
+
+    clientGot := ednsCodes(m)
+    if _, ok := clientGot[dns.EDNS0SUBNET]; !ok {
+        t.Error("upstream ecs not passed back to the client")
+    }
+    if nsid, ok := clientGot[dns.EDNS0NSID].(*dns.EDNS0_NSID); !ok || nsid.Nsid != "636c" {
+        t.Errorf("got nsid %v, want the client's own 636c reflected", clientGot[dns.EDNS0NSID])
+    }
+    if _, ok := clientGot[dns.EDNS0PADDING]; ok {
+        t.Error("stripped padding passed back to the client")
+    }
+}
+
+func TestClientBufferForwarded(t *testing.T) {
+    type seen struct {
+        size uint16
+        do   bool
+    }
+    asked := make(chan seen, 1)
+    server := fakeDNS(t, func(w dns.ResponseWriter, r *dns.Msg) {
+        var s seen
+        if opt := r.IsEdns0(); opt != nil {
+            s = seen{opt.UDPSize(), opt.Do()}
+        }
+        asked <- s
+        m := new(dns.Msg)
+        m.SetReply(r)
+        for i := 0; i < 150; i++ {
+            m.Answer = append(m.Answer, &dns.A{
+                Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 30},
+                A:   net.IPv4(10, 0, byte(i>>8), byte(i)),
+            })
+        }
+        m.SetEdns0(s.size, s.do)
+        m.Compress = true
+        w.WriteMsg(m)
+    })
+    client := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}
+
+    for _, tt := range []struct {
+        path string
+        name string
+        env  []string
+    }{
+        {"Docker DNS", "web.docker.", []string{"DOCKER_DNS", server}},
+        {"upstream", "example.com.", []string{"ENABLE_UPSTREAM", "true", "UPSTREAM_DNS", server}},
+    } {
+        p := testProxy(t, append(tt.env, "MAX_CLIENT_UDP_SIZE", "4096")...)
+        r := new(dns.Msg)
+        r.SetQuestion(tt.name, dns.TypeA)
+        r.SetEdns0(4096, true)
+        m := queryFrom(p, client, r)
+
+        if s := <-asked; s.size != 4096 || !s.do {
+            t.Errorf("%s: got buffer %d and DO %v, want the client's 4096 and DO", tt.path, s.size, s.do)
+        }
+        if m == nil || m.Truncated || len(m.Answer) != 150 {
+            t.Fatalf("%s: got %v, want all 150 answers within the 4096-byte buffer", tt.path, m)
+        }
+        opt := m.IsEdns0()
+        if opt == nil || opt.UDPSize() != 4096 || !opt.Do() {
+            t.Errorf("%s: reply OPT %v, want buffer 4096 and DO", tt.path, opt)
+        }
+        if packed, _ := m.Pack(); len(packed) <= 1432 || len(packed) > 4096 {
+            t.Errorf("%s: %d byte reply, want one past the default 1432 bytes within 4096", tt.path, len(packed))
+        }
+    }
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestGetDurationEnv(t *testing.T) {
+    tests := []struct {
+        value string
+        want  time.Duration
+    }{
+        {"", 4 * time.Second},
+        {"3", 3 * time.Second},
+        {"0", 0},
+        {"soon", 4 * time.Second},
+    }
+    for _, tt := range tests {
+        t.Setenv("TEST_DURATION_SECONDS", tt.value)
+        if got := getDurationEnv("TEST_DURATION_SECONDS", 4); got != tt.want {
+            t.Errorf("getDurationEnv with %q = %v, want %v", tt.value, got, tt.want)
+        }
+    }
+}
+
+func TestDurationSettingsInSeconds(t *testing.T) {
+    t.Setenv("TIMEOUT_SECONDS", "3")
+    t.Setenv("SHUTDOWN_TIMEOUT_SECONDS", "7")
+    config := loadConfig()
+    if config.Timeout != 3*time.Second {
+        t.Errorf("TIMEOUT_SECONDS=3 gave %v, want 3s", config.Timeout)
+    }
+    if config.ShutdownTimeout != 7*time.Second {
+        t.Errorf("SHUTDOWN_TIMEOUT_SECONDS=7 gave %v, want 7s", config.ShutdownTimeout)
+    }
+    if config.RequestTimeout != 5*time.Second {
+        t.Errorf("REQUEST_TIMEOUT_SECONDS default gave %v, want 5s", config.RequestTimeout)
+    }
+}
+
+// A zero or negative timeout would mean no timeout at all in the DNS client,
+// so validate rejects it at startup instead of letting queries hang.
+func TestZeroTimeoutRejected(t *testing.T) {
+    for _, key := range []string{"TIMEOUT_SECONDS", "REQUEST_TIMEOUT_SECONDS"} {
+        for _, value := range []string{"0", "-3"} {
+            t.Run(key+"="+value, func(t *testing.T) {
+                t.Setenv("DOCKER_DNS", "127.0.0.11:53")
+                t.Setenv(key, value)
+                err := loadConfig().validate()
+                if err == nil || !strings.HasPrefix(err.Error(), key+":") {
+                    t.Errorf("validate gave %v, want an error about %s", err, key)
+                }
+            })
+        }
+    }
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+    "strings"
+
+    "github.com/miekg/dns"
+)
+
+// ResponseFilter transforms a response before it is written to the client,
+// e.g. to rewrite TTLs or drop records. req is the query as received.
+type ResponseFilter interface {
+    Apply(req, resp *dns.Msg)
+}
+
+// ResponseFilterFunc adapts a function to a ResponseFilter.
+type ResponseFilterFunc func(req, resp *dns.Msg)
+
+func (f ResponseFilterFunc) Apply(req, resp *dns.Msg) {
+    f(req, resp)
+}
+
+// builtinFilters returns the filters cfg applies to every resolved response,
+// before those added with AddResponseFilter.
+func builtinFilters(cfg *Config) []ResponseFilter {
+    var filters []ResponseFilter
+    if len(cfg.NameRewrites) > 0 {
+        filters = append(filters, ResponseFilterFunc(func(req, resp *dns.Msg) {
+            if target, ok := cfg.NameRewrites[strings.ToLower(req.Question[0].Name)]; ok {
+                restoreName(req, resp, target)
+            }
+        }))
+    }
+    if cfg.NegTTLJitter > 0 {
+        filters = append(filters, ResponseFilterFunc(func(req, resp *dns.Msg) { jitterNegativeTTL(resp, cfg.NegTTLJitter) }))
+    }
+    filters = append(filters, ResponseFilterFunc(func(req, resp *dns.Msg) { dedupeSections(resp) }))
+    if cfg.SortAnswers {
+        filters = append(filters, ResponseFilterFunc(func(req, resp *dns.Msg) { sortAnswers(resp) }))
+    }
+    return filters
+}
+
+// AddResponseFilter appends f to the filters applied to resolved responses.
+// Filters run in the order they were added; register them before the server
+// starts.
+func (p *DNSProxy) AddResponseFilter(f ResponseFilter) {
+    p.filters = append(p.filters, f)
+}
+
+func (p *DNSProxy) applyFilters(cfg *Config, req, resp *dns.Msg) {
+    for _, f := range builtinFilters(cfg) {
+        f.Apply(req, resp)
+    }
+    for _, f := range p.filters {
+        f.Apply(req, resp)
+    }
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+    "fmt"
+    "math/rand"
+    "strings"
+    "testing"
+
+    "github.com/miekg/dns"
+)
+
+func TestResponseFilters(t *testing.T) {
+    docker := fakeDNS(t, func(w dns.ResponseWriter, r *dns.Msg) {
+        m := new(dns.Msg)
+        m.SetReply(r)
+        for _, ip := range []string{"10.0.0.2", "10.0.0.1", "10.0.0.2"} {
+            rr, _ := dns.NewRR(r.Question[0].Name + " 30 IN A " + ip)
+            m.Answer = append(m.Answer, rr)
+        }
+        w.WriteMsg(m)
+    })
+    p := testProxy(t, "DOCKER_DNS", docker, "NAME_REWRITES", "db.docker=postgres.docker", "SORT_ANSWERS", "true")
+
+    // A custom filter runs after the built-in ones and sees their result
+    var seen []string
+    p.AddResponseFilter(ResponseFilterFunc(func(req, resp *dns.Msg) {
+        for _, rr := range resp.Answer {
+            seen = append(seen, rr.String())
+            rr.Header().Ttl = 7
+        }
+    }))
+
+    m := query(p, "db.docker.", dns.TypeA)
+    if m == nil || m.Rcode != dns.RcodeSuccess {
+        t.Fatalf("got %v, want an answer", m)
+    }
+    want := []string{"db.docker.\t30\tIN\tA\t10.0.0.1", "db.docker.\t30\tIN\tA\t10.0.0.2"}
+    if len(seen) != len(want) || seen[0] != want[0] || seen[1] != want[1] {
+        t.Errorf("custom filter saw %q, want %q", seen, want)
+    }
+    if len(m.Answer) != 2 || m.Answer[0].Header().Ttl != 7 || m.Answer[1].Header().Ttl != 7 {
+        t.Errorf("custom filter not applied to the response: %v", m.Answer)
+    }
+    if m.Question[0].Name != "db.docker." {
+        t.Errorf("question %s, want db.docker.", m.Question[0].Name)
+    }
+}
+
+func TestJitterNegativeTTLFilter(t *testing.T) {
+    r := new(dns.Msg)
+    r.SetQuestion("missing.docker.", dns.TypeA)
+    m := new(dns.Msg)
+    m.SetRcode(r, dns.RcodeNameError)
+    soa, _ := dns.NewRR("docker. 100 IN SOA ns.docker. admin.docker. 1 3600 600 86400 100")
+    m.Ns = append(m.Ns, soa)
+
+    for _, f := range builtinFilters(&Config{NegTTLJitter: 0.5}) {
+        f.Apply(r, m)
+    }
+    if ttl := m.Ns[0].Header().Ttl; ttl < 50 || ttl > 100 {
+        t.Errorf("SOA TTL %d after jitter, want between 50 and 100", ttl)
+    }
+}
+
+func TestDedupeSections(t *testing.T) {
+    upstream := fakeDNS(t, func(w dns.ResponseWriter, r *dns.Msg) {
+        m := new(dns.Msg)
+        m.SetReply(r)
+        a, _ := dns.NewRR("example.com. 30 IN A 192.0.2.1")
+        dup, _ := dns.NewRR("example.com. 60 IN A 192.0.2.1")
+        glue, _ := dns.NewRR("ns.example.com. 30 IN A 192.0.2.53")
+        m.Answer = append(m.Answer, a, dup)
+        m.Extra = append(m.Extra, dns.Copy(a), glue, dns.Copy(glue))
+        w.WriteMsg(m)
+    })
+    p := testProxy(t, "ENABLE_UPSTREAM", "true", "UPSTREAM_DNS", upstream)
+
+    m := query(p, "example.com.", dns.TypeA)
+    if len(m.Answer) != 1 || answerIP(m) != "192.0.2.1" {
+        t.Errorf("answers %v, want the A record once", m.Answer)
+    }
+    var extra []string
+    for _, rr := range m.Extra {
+        if rr.Header().Rrtype != dns.TypeOPT {
+            extra = append(extra, rr.Header().Name)
+        }
+    }
+    if len(extra) != 1 || extra[0] != "ns.example.com." {
+        t.Errorf("additional records for %v, want only the glue once", extra)
+    }
+}
+
+func TestNegativeTTLJitterVaries(t *testing.T) {
+    upstream := fakeDNS(t, func(w dns.ResponseWriter, r *dns.Msg) {
+        m := new(dns.Msg)
+        m.SetRcode(r, dns.RcodeNameError)
+        soa, _ := dns.NewRR("example.com. 100 IN SOA ns.example.com. admin.example.com. 1 3600 600 86400 100")
+        m.Ns = append(m.Ns, soa)
+        w.WriteMsg(m)
+    })
+    p := testProxy(t, "ENABLE_UPSTREAM", "true", "UPSTREAM_DNS", upstream, "NEG_TTL_JITTER", "0.2")
+
+    seen := make(map[uint32]bool)
+    for i := 0; i < 50; i++ {
+        m := query(p, fmt.Sprintf("missing%d.example.com.", i), dns.TypeA)
+        if m == nil || m.Rcode != dns.RcodeNameError || len(m.Ns) != 1 {
+            t.Fatalf("got %v, want NXDOMAIN with the SOA", m)
+        }
+        soa := m.Ns[0].(*dns.SOA)
+        if soa.Hdr.Ttl < 80 || soa.Hdr.Ttl > 100 || soa.Minttl < 80 || soa.Minttl > 100 {
+            t.Fatalf("SOA TTL %d and minimum %d, want both between 80 and 100", soa.Hdr.Ttl, soa.Minttl)
+        }
+        seen[soa.Hdr.Ttl] = true
+    }
+    if len(seen) < 2 {
+        t.Errorf("all 50 negative answers got TTL %v, want them spread by the jitter", seen)
+    }
+}
+
+func TestSortAnswers(t *testing.T) {
+    upstream := fakeDNS(t, func(w dns.ResponseWriter, r *dns.Msg) {
+        m := new(dns.Msg)
+        m.SetReply(r)
+        name := r.Question[0].Name
+        for _, data := range []string{"CNAME target.example.com.", "AAAA fd00::2", "A 10.0.0.2", "AAAA fd00::1", "A 10.0.0.10", "A 10.0.0.1"} {
+            rr, _ := dns.NewRR(name + " 30 IN " + data)
+            m.Answer = append(m.Answer, rr)
+        }
+        // Everything after the CNAME in a different order each time
+        rand.Shuffle(len(m.Answer)-1, func(i, j int) {
+            m.Answer[i+1], m.Answer[j+1] = m.Answer[j+1], m.Answer[i+1]
+        })
+        w.WriteMsg(m)
+    })
+    p := testProxy(t, "ENABLE_UPSTREAM", "true", "UPSTREAM_DNS", upstream, "SORT_ANSWERS", "true")
+
+    want := "target.example.com. 10.0.0.1 10.0.0.10 10.0.0.2 fd00::1 fd00::2"
+    for i := 0; i < 10; i++ {
+        m := query(p, fmt.Sprintf("host%d.example.com.", i), dns.TypeA)
+        if m == nil {
+            t.Fatal("no response")
+        }
+        var order []string
+        for _, rr := range m.Answer {
+            order = append(order, strings.TrimPrefix(rr.String(), rr.Header().String()))
+        }
+        if got := strings.Join(order, " "); got != want {
+            t.Fatalf("answers in order %q, want %q", got, want)
+        }
+    }
+}
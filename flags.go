@@ -0,0 +1,106 @@
+package main
+
+import (
+    "flag"
+    "fmt"
+    "os"
+    "strings"
+)
+
+// Set at build time with -ldflags "-X main.version=..."
+var version = "dev"
+
+// Environment variables that can also be given as command-line flags. The
+// flag name is the lower-cased key with dashes, e.g. -listen-port for
+// LISTEN_PORT.
+var configKeys = []string{
+    "CONFIG_FILE", "LISTEN_ADDR", "LISTEN_PORT", "TCP_ENABLED", "MAX_QUERIES_PER_CONN",
+    "LISTENER_RESTART", "DOCKER_DNS", "DOCKER_DNS_FALLBACK", "DOCKER_DNS_V4", "DOCKER_DNS_V6", "DOCKER_MAX_TTL",
+    "DOCKER_DNS_RETRIES", "USE_PARTIAL_ANSWERS", "TRY_FULL_NAME_FIRST", "STRIP_SUFFIX", "STRIP_REPEATED",
+    "NAME_REWRITES", "STRICT_ZONES", "NEG_TTL_JITTER", "SORT_ANSWERS", "SANITY_CHECK", "SYNTHETIC_TTL",
+    "UPSTREAM_DNS", "ENABLE_UPSTREAM", "EMPTY_UPSTREAM_RETRY", "FALLBACK_TO_UPSTREAM",
+    "PARALLEL_RESOLVE", "UPSTREAM_SELECTION", "UPSTREAM_PROTOCOL", "UPSTREAM_TLS_SERVERNAME",
+    "UPSTREAM_MAX_INFLIGHT", "SHADOW_UPSTREAM", "VALIDATING_UPSTREAM", "SCHEDULE_RULES",
+    "UPSTREAM_MAX_ANSWERS", "UPSTREAM_MAX_AUTHORITY", "UPSTREAM_MAX_ADDITIONAL",
+    "BREAKER_THRESHOLD", "BREAKER_OPEN_SECONDS", "UPSTREAM_HEALTHCHECK_INTERVAL",
+    "REGEX_RULES", "PASSTHROUGH_SUFFIXES",
+    "K8S_RESOLVER", "K8S_DOMAIN", "TIMEOUT_SECONDS", "QTYPE_TIMEOUTS", "REQUEST_TIMEOUT_SECONDS",
+    "SHUTDOWN_TIMEOUT_SECONDS", "POOL_SIZE", "POOL_QUEUE",
+    "CACHE_ENABLED", "CACHE_MAX_ENTRIES", "CACHE_MAX_BYTES", "STALE_IF_ERROR_TTL", "NEGATIVE_CACHE_TTL_SECONDS",
+    "CACHE_REFRESH_AHEAD", "PREFETCH_THRESHOLD", "CACHE_PREFERENCE",
+    "CACHE_PREFERENCE_CLIENTS",
+    "HOST_INTERNAL_IP", "GATEWAY_INTERNAL_IP", "HOSTS_FILE", "STATIC_HOSTS", "FALLBACK_IPS",
+    "ALLOWED_CLIENTS", "REQUIRE_TCP_ABOVE", "REQUIRE_TCP_QTYPES", "MAX_CLIENT_UDP_SIZE",
+    "RRL_RESPONSES_PER_SEC", "RRL_SLIP", "RATE_LIMIT_QPS", "RATE_LIMIT_BURST",
+    "TOP_CLIENTS",
+    "EDNS_POLICY", "ENABLE_COOKIES", "COOKIE_SECRET", "ENABLE_EDE",
+    "LOG_LEVEL", "LOG_FORMAT", "LOG_NAME_CASE", "PRINT_CONFIG_JSON", "QUERY_LOG_FILE",
+    "ENABLE_METRICS", "METRICS_ADDR", "METRICS_INTERVAL_SECONDS",
+    "ADMIN_ADDR", "ADMIN_TOKEN", "HEALTH_ADDR", "ENABLE_FEATURES_TXT",
+    "CHAOS_HOSTNAME", "CHAOS_AUTHORS",
+    "MAINTENANCE_MODE", "MAINTENANCE_NAME", "MAINTENANCE_MESSAGE", "MAINTENANCE_SERVFAIL",
+    "FAULT_INJECTION_RATE",
+}
+
+// Keys read with getBoolEnv, whose flags may be given without a value
+var boolConfigKeys = map[string]bool{
+    "TCP_ENABLED": true, "ENABLE_UPSTREAM": true, "ENABLE_METRICS": true, "STRIP_REPEATED": true,
+    "STRICT_ZONES": true, "SORT_ANSWERS": true, "CACHE_ENABLED": true, "EMPTY_UPSTREAM_RETRY": true,
+    "FALLBACK_TO_UPSTREAM": true, "PARALLEL_RESOLVE": true, "USE_PARTIAL_ANSWERS": true, "TRY_FULL_NAME_FIRST": true,
+    "ENABLE_FEATURES_TXT": true, "ENABLE_COOKIES": true, "MAINTENANCE_MODE": true, "MAINTENANCE_SERVFAIL": true,
+    "PRINT_CONFIG_JSON": true, "ENABLE_EDE": true, "SANITY_CHECK": true,
+}
+
+// Values given on the command line, which take precedence over CONFIG_FILE
+// and the environment.
+var flagValues map[string]string
+
+// configFlag stores a flag under its environment variable name, so it goes
+// through the same parsing as the variable.
+type configFlag struct {
+    key    string
+    isBool bool
+}
+
+func (f configFlag) String() string { return flagValues[f.key] }
+
+func (f configFlag) Set(value string) error {
+    flagValues[f.key] = value
+    return nil
+}
+
+// IsBoolFlag lets a bare boolean flag such as -enable-upstream mean true.
+func (f configFlag) IsBoolFlag() bool { return f.isBool }
+
+func flagName(key string) string {
+    return strings.ToLower(strings.ReplaceAll(key, "_", "-"))
+}
+
+// parseFlags reads the command line into flagValues. It exits after
+// printing the version for -version, and the usage for -help.
+func parseFlags(args []string) {
+    flagValues = make(map[string]string)
+    fs := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+    fs.Usage = func() {
+        fmt.Fprintf(fs.Output(), "Usage: %s [flags]\n\n", os.Args[0])
+        fmt.Fprintf(fs.Output(), "Every flag overrides the environment variable of the same name, see README.md.\n")
+        fmt.Fprintf(fs.Output(), "Boolean flags may be given alone, e.g. -enable-upstream, or as -enable-upstream=false.\n\n")
+        fs.PrintDefaults()
+    }
+
+    showVersion := fs.Bool("version", false, "print the version and exit")
+    for _, key := range configKeys {
+        fs.Var(configFlag{key: key, isBool: boolConfigKeys[key]}, flagName(key), "overrides "+key)
+    }
+    fs.Parse(args)
+
+    if *showVersion {
+        fmt.Printf("dns-proxy %s\n", version)
+        os.Exit(0)
+    }
+    if fs.NArg() > 0 {
+        fmt.Fprintf(fs.Output(), "Unexpected arguments: %s\n", strings.Join(fs.Args(), " "))
+        fs.Usage()
+        os.Exit(2)
+    }
+}
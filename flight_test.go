@@ -0,0 +1,91 @@
+package main
+
+import (
+    "context"
+    "sync"
+    "sync/atomic"
+    "testing"
+    "time"
+
+    "github.com/miekg/dns"
+)
+
+// countingDNS answers A queries after delay and counts the queries it got.
+func countingDNS(t *testing.T, delay time.Duration, count *int64) string {
+    return fakeDNS(t, func(w dns.ResponseWriter, r *dns.Msg) {
+        atomic.AddInt64(count, 1)
+        time.Sleep(delay)
+        answerA("192.0.2.1")(w, r)
+    })
+}
+
+func TestExchangeSharesIdenticalQueries(t *testing.T) {
+    var count int64
+    server := countingDNS(t, 200*time.Millisecond, &count)
+    p := testProxy(t)
+    cfg := p.config()
+
+    const callers = 20
+    var wg sync.WaitGroup
+    for i := 0; i < callers; i++ {
+        wg.Add(1)
+        go func(id uint16) {
+            defer wg.Done()
+            m := new(dns.Msg)
+            m.SetQuestion("web.example.", dns.TypeA)
+            m.Id = id
+            reply, err := p.exchange(context.Background(), cfg, m, server)
+            if err != nil {
+                t.Errorf("caller %d: %v", id, err)
+                return
+            }
+            if reply.Id != id {
+                t.Errorf("caller %d got reply ID %d", id, reply.Id)
+            }
+            // Every caller edits its own reply
+            reply.Answer[0].Header().Ttl = uint32(id)
+        }(uint16(i + 1))
+    }
+    wg.Wait()
+
+    if got := atomic.LoadInt64(&count); got != 1 {
+        t.Fatalf("server got %d queries for %d identical callers, want 1", got, callers)
+    }
+}
+
+// A caller giving up must not fail the callers that joined its exchange.
+func TestExchangeOutlivesCancelledCaller(t *testing.T) {
+    var count int64
+    server := countingDNS(t, 200*time.Millisecond, &count)
+    p := testProxy(t)
+    cfg := p.config()
+
+    m := new(dns.Msg)
+    m.SetQuestion("web.example.", dns.TypeA)
+
+    first, cancel := context.WithCancel(context.Background())
+    done := make(chan error, 1)
+    go func() {
+        _, err := p.exchange(first, cfg, m, server)
+        done <- err
+    }()
+    time.Sleep(50 * time.Millisecond)
+
+    joined := make(chan error, 1)
+    go func() {
+        _, err := p.exchange(context.Background(), cfg, m, server)
+        joined <- err
+    }()
+    time.Sleep(50 * time.Millisecond)
+    cancel()
+
+    if err := <-done; err != context.Canceled {
+        t.Errorf("cancelled caller got %v, want context.Canceled", err)
+    }
+    if err := <-joined; err != nil {
+        t.Errorf("joined caller failed with %v after the first caller was cancelled", err)
+    }
+    if got := atomic.LoadInt64(&count); got != 1 {
+        t.Errorf("server got %d queries, want 1", got)
+    }
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+    "context"
+    "net/http"
+    "sync"
+
+    "github.com/miekg/dns"
+)
+
+// healthHandler serves /healthz on HEALTH_ADDR for orchestrator probes.
+func (p *DNSProxy) healthHandler() http.Handler {
+    mux := http.NewServeMux()
+    mux.HandleFunc("/healthz", p.handleHealth)
+    return mux
+}
+
+// probeAll queries the root NS set on every server in parallel and returns
+// "ok" or the error per server. Any response counts, even an error rcode,
+// since only reachability matters.
+func probeAll(ctx context.Context, cfg *Config, servers []string) map[string]string {
+    var mu sync.Mutex
+    var wg sync.WaitGroup
+    results := make(map[string]string, len(servers))
+    for _, server := range servers {
+        wg.Add(1)
+        go func(server string) {
+            defer wg.Done()
+            m := new(dns.Msg)
+            m.SetQuestion(".", dns.TypeNS)
+            result := "ok"
+            if _, _, err := cfg.clientFor(server, dns.TypeNS).ExchangeContext(ctx, m, server); err != nil {
+                result = err.Error()
+            }
+            mu.Lock()
+            results[server] = result
+            mu.Unlock()
+        }(server)
+    }
+    wg.Wait()
+    return results
+}
+
+// handleHealth answers 200 when Docker DNS is reachable within TIMEOUT_SECONDS
+// (at least one server for A and one for AAAA queries) and, while upstream
+// forwarding is on, at least one upstream is too. It answers 503 otherwise.
+// The body lists the result for each server.
+func (p *DNSProxy) handleHealth(w http.ResponseWriter, r *http.Request) {
+    cfg := p.config()
+    ctx, cancel := context.WithTimeout(r.Context(), cfg.Timeout)
+    defer cancel()
+
+    v4, v6 := cfg.dockerDNSFor(dns.TypeA), cfg.dockerDNSFor(dns.TypeAAAA)
+    var upstreams []string
+    if p.upstreamEnabled() {
+        upstreams = cfg.allUpstreams()
+    }
+
+    var servers []string
+    servers = append(servers, v4...)
+    servers = append(servers, v6...)
+    results := probeAll(ctx, cfg, append(servers, upstreams...))
+
+    reachable := func(servers []string) bool {
+        for _, server := range servers {
+            if results[server] == "ok" {
+                return true
+            }
+        }
+        return false
+    }
+    healthy := reachable(v4) && reachable(v6) && (len(upstreams) == 0 || reachable(upstreams))
+
+    docker := make(map[string]string)
+    for _, server := range servers {
+        docker[server] = results[server]
+    }
+    body := map[string]interface{}{"healthy": healthy, "docker": docker}
+    if len(upstreams) > 0 {
+        upstream := make(map[string]string)
+        for _, server := range upstreams {
+            upstream[server] = results[server]
+        }
+        body["upstream"] = upstream
+    }
+    if !healthy {
+        w.Header().Set("Content-Type", "application/json")
+        w.WriteHeader(http.StatusServiceUnavailable)
+    }
+    writeJSON(w, body)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+    "bytes"
+    "log"
+    "net"
+    "os"
+    "sync"
+    "testing"
+
+    "github.com/miekg/dns"
+)
+
+// fakeDNS serves handler on a local UDP port and returns its address.
+func fakeDNS(t *testing.T, handler dns.HandlerFunc) string {
+    t.Helper()
+    pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    server := &dns.Server{PacketConn: pc, Handler: handler}
+    go server.ActivateAndServe()
+    t.Cleanup(func() { server.Shutdown() })
+    return pc.LocalAddr().String()
+}
+
+// fakeDNSBoth serves handler over UDP and TCP on the same local port and
+// returns its address.
+func fakeDNSBoth(t *testing.T, handler dns.HandlerFunc) string {
+    t.Helper()
+    for attempt := 0; attempt < 10; attempt++ {
+        pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+        if err != nil {
+            t.Fatal(err)
+        }
+        ln, err := net.Listen("tcp", pc.LocalAddr().String())
+        if err != nil {
+            pc.Close()
+            continue
+        }
+        udp := &dns.Server{PacketConn: pc, Handler: handler}
+        tcp := &dns.Server{Listener: ln, Handler: handler}
+        go udp.ActivateAndServe()
+        go tcp.ActivateAndServe()
+        t.Cleanup(func() {
+            udp.Shutdown()
+            tcp.Shutdown()
+        })
+        return pc.LocalAddr().String()
+    }
+    t.Fatal("no port free for both UDP and TCP")
+    return ""
+}
+
+// answerA answers every question with an A record for ip.
+func answerA(ip string) dns.HandlerFunc {
+    return func(w dns.ResponseWriter, r *dns.Msg) {
+        m := new(dns.Msg)
+        m.SetReply(r)
+        rr, _ := dns.NewRR(r.Question[0].Name + " 30 IN A " + ip)
+        m.Answer = append(m.Answer, rr)
+        w.WriteMsg(m)
+    }
+}
+
+// testProxy loads the configuration from env, given as key, value pairs, on
+// top of a DOCKER_DNS that nothing listens on.
+func testProxy(t *testing.T, env ...string) *DNSProxy {
+    t.Helper()
+    t.Setenv("DOCKER_DNS", "127.0.0.1:1")
+    for i := 0; i+1 < len(env); i += 2 {
+        t.Setenv(env[i], env[i+1])
+    }
+    return NewDNSProxy(loadConfig())
+}
+
+// query sends a question through dispatch and returns the response.
+func query(p *DNSProxy, name string, qtype uint16) *dns.Msg {
+    r := new(dns.Msg)
+    r.SetQuestion(name, qtype)
+    m, _ := p.dispatch(r)
+    return m
+}
+
+// queryFrom is query for a client at remote, e.g. a *net.UDPAddr for the
+// UDP-only paths.
+func queryFrom(p *DNSProxy, remote net.Addr, r *dns.Msg) *dns.Msg {
+    w := &responseRecorder{local: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}, remote: remote}
+    p.handleRequest(w, r)
+    return w.msg
+}
+
+// logBuffer collects log output, safe for the goroutines still logging.
+type logBuffer struct {
+    mu  sync.Mutex
+    buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    return b.buf.Write(p)
+}
+
+func (b *logBuffer) String() string {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    return b.buf.String()
+}
+
+// captureLog sends the standard logger to a buffer for the rest of the test.
+func captureLog(t *testing.T) *logBuffer {
+    b := &logBuffer{}
+    log.SetOutput(b)
+    t.Cleanup(func() { log.SetOutput(os.Stderr) })
+    return b
+}
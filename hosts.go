@@ -0,0 +1,149 @@
+package main
+
+import (
+    "bufio"
+    "log"
+    "net"
+    "os"
+    "strings"
+
+    "github.com/miekg/dns"
+)
+
+// TTL of answers served from FALLBACK_IPS
+const fallbackTTL = 5
+
+// normalizeHostName reduces a name to the form used as key in the hosts map:
+// lower case, without trailing dot and without a strip suffix, so `web`,
+// `web.docker` and `web.docker.` all refer to the same entry.
+func normalizeHostName(name string, suffixes []string) string {
+    name = strings.TrimSuffix(strings.ToLower(name), ".")
+    for _, suffix := range suffixes {
+        if strings.HasSuffix(name, suffix) && len(name) > len(suffix) {
+            return strings.TrimSuffix(name, suffix)
+        }
+    }
+    return name
+}
+
+// loadHostsFile reads an /etc/hosts style file ("IP name [name...]", with #
+// comments) into a map of normalized name to addresses.
+func loadHostsFile(path string, suffixes []string) map[string][]net.IP {
+    if path == "" {
+        return nil
+    }
+
+    f, err := os.Open(path)
+    if err != nil {
+        log.Printf("Warning: Could not read hosts file %s: %v", path, err)
+        return nil
+    }
+    defer f.Close()
+
+    hosts := make(map[string][]net.IP)
+    scanner := bufio.NewScanner(f)
+    for scanner.Scan() {
+        line := scanner.Text()
+        if i := strings.Index(line, "#"); i >= 0 {
+            line = line[:i]
+        }
+        fields := strings.Fields(line)
+        if len(fields) < 2 {
+            continue
+        }
+
+        ip := net.ParseIP(fields[0])
+        if ip == nil {
+            log.Printf("Warning: Invalid IP in hosts file %s: %s", path, fields[0])
+            continue
+        }
+        for _, name := range fields[1:] {
+            key := normalizeHostName(name, suffixes)
+            hosts[key] = append(hosts[key], ip)
+        }
+    }
+    if err := scanner.Err(); err != nil {
+        log.Printf("Warning: Error reading hosts file %s: %v", path, err)
+    }
+    return hosts
+}
+
+// getHostIPsEnv parses a comma-separated list of name=IP pairs, e.g.
+// `web.docker=10.0.0.99,web.docker=10.0.0.98`, into a map keyed like the
+// hosts file. A name may be listed more than once.
+func getHostIPsEnv(key string, suffixes []string) map[string][]net.IP {
+    var hosts map[string][]net.IP
+    for _, entry := range getListEnv(key, "") {
+        i := strings.Index(entry, "=")
+        if i <= 0 {
+            log.Printf("Warning: Invalid entry in %s: %s, expected name=IP", key, entry)
+            continue
+        }
+        ip := net.ParseIP(strings.TrimSpace(entry[i+1:]))
+        if ip == nil {
+            log.Printf("Warning: Invalid IP in %s: %s", key, entry[i+1:])
+            continue
+        }
+        if hosts == nil {
+            hosts = make(map[string][]net.IP)
+        }
+        name := normalizeHostName(strings.TrimSpace(entry[:i]), suffixes)
+        hosts[name] = append(hosts[name], ip)
+    }
+    return hosts
+}
+
+// answerFallback answers a failed lookup from FALLBACK_IPS, with a short TTL
+// so clients come back once the resolvers recover. It returns nil when the
+// name has no fallback.
+func (p *DNSProxy) answerFallback(cfg *Config, r *dns.Msg) *dns.Msg {
+    question := r.Question[0]
+    ips, ok := cfg.FallbackIPs[normalizeHostName(question.Name, cfg.StripSuffixes)]
+    if !ok {
+        return nil
+    }
+
+    m := new(dns.Msg)
+    m.SetReply(r)
+    m.RecursionAvailable = true
+    for _, ip := range ips {
+        if rr := addressRecord(question.Name, question.Qtype, ip, fallbackTTL); rr != nil {
+            m.Answer = append(m.Answer, rr)
+        }
+    }
+    p.logInfo("Resolvers failed for %s, answering with %d fallback records", question.Name, len(m.Answer))
+    return m
+}
+
+// mergeHosts adds the STATIC_HOSTS entries to those of the hosts file. A
+// name in both gets the addresses of both.
+func mergeHosts(file, static map[string][]net.IP) map[string][]net.IP {
+    if len(static) == 0 {
+        return file
+    }
+    if file == nil {
+        file = make(map[string][]net.IP)
+    }
+    for name, ips := range static {
+        file[name] = append(file[name], ips...)
+    }
+    return file
+}
+
+// answerHosts answers names listed in the hosts file or STATIC_HOSTS. A
+// listed name without addresses of the requested type gets an empty NOERROR
+// answer.
+func (p *DNSProxy) answerHosts(cfg *Config, m *dns.Msg, domain string, qtype uint16) bool {
+    ips, ok := cfg.Hosts[normalizeHostName(domain, cfg.StripSuffixes)]
+    if !ok {
+        return false
+    }
+
+    for _, ip := range ips {
+        if rr := addressRecord(domain, qtype, ip, cfg.SyntheticTTL); rr != nil {
+            m.Answer = append(m.Answer, rr)
+        }
+    }
+    p.logDebug("Answered %s from hosts file with %d records", domain, len(m.Answer))
+    return true
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+    "os"
+    "path/filepath"
+    "testing"
+
+    "github.com/miekg/dns"
+)
+
+func TestNormalizeHostName(t *testing.T) {
+    suffixes := []string{".docker"}
+    for _, name := range []string{"web", "web.", "web.docker", "web.docker.", "WEB.Docker."} {
+        if got := normalizeHostName(name, suffixes); got != "web" {
+            t.Errorf("normalizeHostName(%q) = %q, want web", name, got)
+        }
+    }
+    if got := normalizeHostName(".docker", suffixes); got != ".docker" {
+        t.Errorf("normalizeHostName of the bare suffix = %q, want it kept", got)
+    }
+}
+
+func TestHostsFileNameForms(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "hosts")
+    hosts := "# static records\n10.0.0.5 web\n10.0.0.6 api.docker\n10.0.0.7 DB.docker. # trailing comment\n"
+    if err := os.WriteFile(path, []byte(hosts), 0o644); err != nil {
+        t.Fatal(err)
+    }
+    p := testProxy(t, "HOSTS_FILE", path)
+
+    for _, tt := range []struct{ query, want string }{
+        {"web.docker.", "10.0.0.5"},
+        {"WEB.docker.", "10.0.0.5"},
+        {"api.docker.", "10.0.0.6"},
+        {"db.docker.", "10.0.0.7"},
+    } {
+        if ip := answerIP(query(p, tt.query, dns.TypeA)); ip != tt.want {
+            t.Errorf("%s answered %q, want %s", tt.query, ip, tt.want)
+        }
+    }
+}
+
+func TestFallbackIPsWhenResolversFail(t *testing.T) {
+    p := testProxy(t, "ENABLE_UPSTREAM", "true", "UPSTREAM_DNS", "127.0.0.1:1", "FALLBACK_TO_UPSTREAM", "true",
+        "FALLBACK_IPS", "web.docker=10.9.9.9")
+
+    m := query(p, "web.docker.", dns.TypeA)
+    if ip := answerIP(m); ip != "10.9.9.9" {
+        t.Fatalf("answer %q with every resolver down, want the fallback 10.9.9.9", ip)
+    }
+    if ttl := m.Answer[0].Header().Ttl; ttl != fallbackTTL {
+        t.Errorf("fallback TTL %d, want %d", ttl, fallbackTTL)
+    }
+
+    // Resolvers that answer win over the fallback
+    t.Setenv("DOCKER_DNS", fakeDNS(t, answerA("172.17.0.2")))
+    p = NewDNSProxy(loadConfig())
+    if ip := answerIP(query(p, "web.docker.", dns.TypeA)); ip != "172.17.0.2" {
+        t.Errorf("answer %q with Docker DNS up, want 172.17.0.2", ip)
+    }
+}
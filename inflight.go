@@ -0,0 +1,43 @@
+package main
+
+import "sync"
+
+// inflightLimiter counts outstanding queries per upstream, so a burst can't
+// open more concurrent queries (and UDP source ports) than UPSTREAM_MAX_INFLIGHT.
+type inflightLimiter struct {
+    mu     sync.Mutex
+    counts map[string]int
+}
+
+func newInflightLimiter() *inflightLimiter {
+    return &inflightLimiter{counts: make(map[string]int)}
+}
+
+// acquire reserves a slot for a query to upstream, failing when max queries
+// are already outstanding. A max of 0 means no limit.
+func (l *inflightLimiter) acquire(upstream string, max int) bool {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+
+    if max > 0 && l.counts[upstream] >= max {
+        return false
+    }
+    l.counts[upstream]++
+    return true
+}
+
+func (l *inflightLimiter) release(upstream string) {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+
+    if l.counts[upstream]--; l.counts[upstream] <= 0 {
+        delete(l.counts, upstream)
+    }
+}
+
+func (l *inflightLimiter) current(upstream string) int {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+
+    return l.counts[upstream]
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+    "fmt"
+    "sync"
+    "sync/atomic"
+    "testing"
+    "time"
+
+    "github.com/miekg/dns"
+)
+
+func TestUpstreamMaxInflight(t *testing.T) {
+    var current, peak int64
+    upstream := fakeDNS(t, func(w dns.ResponseWriter, r *dns.Msg) {
+        n := atomic.AddInt64(&current, 1)
+        for {
+            max := atomic.LoadInt64(&peak)
+            if n <= max || atomic.CompareAndSwapInt64(&peak, max, n) {
+                break
+            }
+        }
+        time.Sleep(200 * time.Millisecond)
+        atomic.AddInt64(&current, -1)
+        answerA("192.0.2.1")(w, r)
+    })
+    p := testProxy(t, "ENABLE_UPSTREAM", "true", "UPSTREAM_DNS", upstream, "UPSTREAM_MAX_INFLIGHT", "2")
+
+    const queries = 10
+    var wg sync.WaitGroup
+    var answered, failed int64
+    for i := 0; i < queries; i++ {
+        wg.Add(1)
+        go func(i int) {
+            defer wg.Done()
+            m := query(p, fmt.Sprintf("host%d.example.com.", i), dns.TypeA)
+            switch {
+            case m != nil && m.Rcode == dns.RcodeSuccess && len(m.Answer) == 1:
+                atomic.AddInt64(&answered, 1)
+            case m != nil && m.Rcode == dns.RcodeServerFailure:
+                atomic.AddInt64(&failed, 1)
+            default:
+                t.Errorf("host%d: got %v, want an answer or SERVFAIL", i, m)
+            }
+        }(i)
+    }
+    wg.Wait()
+
+    if n := atomic.LoadInt64(&peak); n > 2 {
+        t.Errorf("upstream saw %d concurrent queries, want at most 2", n)
+    }
+    if answered == 0 || failed == 0 {
+        t.Errorf("%d answered and %d SERVFAIL, want both with the upstream busy", answered, failed)
+    }
+    if n := p.inflight.current(upstream); n != 0 {
+        t.Errorf("%d queries still in flight after all returned", n)
+    }
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+    "context"
+    "log"
+    "sync"
+    "time"
+
+    "github.com/miekg/dns"
+)
+
+// Wait before the first rebind of a failed listener, doubled on each attempt
+const listenerRestartBackoff = time.Second
+
+// A listener that served this long before failing starts its restart count
+// over, so occasional failures don't add up to giving up
+const listenerStableAfter = time.Minute
+
+// listener runs one DNS server. When the server fails at runtime, e.g. its
+// socket is closed out from under it, the listener binds a fresh one up to
+// LISTENER_RESTART times instead of taking the process down.
+type listener struct {
+    net       string
+    newServer func() *dns.Server
+
+    mu      sync.Mutex
+    server  *dns.Server
+    stopped bool
+}
+
+func newListener(newServer func() *dns.Server) *listener {
+    server := newServer()
+    return &listener{net: server.Net, newServer: newServer, server: server}
+}
+
+func (l *listener) current() (*dns.Server, bool) {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+
+    return l.server, l.stopped
+}
+
+// serve runs the server until it is shut down, returning nil, or until it
+// failed and restarts rebinds did not help, returning the last error. A
+// dns.Server can't be started twice, so each rebind uses a new one.
+func (l *listener) serve(restarts int) error {
+    attempt := 0
+    for {
+        server, stopped := l.current()
+        if stopped {
+            return nil
+        }
+        start := time.Now()
+        err := server.ListenAndServe()
+        if _, stopped := l.current(); stopped || err == nil {
+            return nil
+        }
+
+        if time.Since(start) >= listenerStableAfter {
+            attempt = 0
+        }
+        if attempt >= restarts {
+            return err
+        }
+        attempt++
+        wait := listenerRestartBackoff << uint(attempt-1)
+        log.Printf("%s listener on %s failed: %v, rebinding in %v (attempt %d of %d)",
+            l.net, server.Addr, err, wait, attempt, restarts)
+        time.Sleep(wait)
+
+        l.mu.Lock()
+        l.server = l.newServer()
+        l.mu.Unlock()
+    }
+}
+
+// shutdown stops the running server and any further rebinds.
+func (l *listener) shutdown(ctx context.Context) error {
+    l.mu.Lock()
+    l.stopped = true
+    server := l.server
+    l.mu.Unlock()
+
+    return server.ShutdownContext(ctx)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+    "context"
+    "net"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/miekg/dns"
+)
+
+func TestMaxQueriesPerConn(t *testing.T) {
+    p := testProxy(t, "STATIC_HOSTS", "web.docker=10.0.0.99")
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    server := newTCPServer("", dns.HandlerFunc(p.handleRequest), 3)
+    server.Listener = ln
+    go server.ActivateAndServe()
+    t.Cleanup(func() { server.Shutdown() })
+
+    conn, err := dns.Dial("tcp", ln.Addr().String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+    conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+    for i := 1; i <= 4; i++ {
+        r := new(dns.Msg)
+        r.SetQuestion("web.docker.", dns.TypeA)
+        if err := conn.WriteMsg(r); err != nil {
+            if i <= 3 {
+                t.Fatalf("query %d: %v", i, err)
+            }
+            return
+        }
+        m, err := conn.ReadMsg()
+        if i <= 3 {
+            if err != nil || answerIP(m) != "10.0.0.99" {
+                t.Fatalf("query %d: got %v, %v, want an answer", i, m, err)
+            }
+            continue
+        }
+        if err == nil {
+            t.Fatalf("query %d past MAX_QUERIES_PER_CONN 3 answered: %v", i, m)
+        }
+        if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+            t.Fatal("connection left open past MAX_QUERIES_PER_CONN 3")
+        }
+    }
+}
+
+func TestListenerRebindsAfterFailure(t *testing.T) {
+    p := testProxy(t, "STATIC_HOSTS", "web.docker=10.0.0.99")
+    busy, err := net.ListenPacket("udp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer busy.Close()
+    free, err := net.ListenPacket("udp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    freeAddr := free.LocalAddr().String()
+    free.Close()
+
+    // The first server can't bind, the rebind gets a free address
+    var servers int
+    started := make(chan struct{})
+    newServer := func() *dns.Server {
+        servers++
+        addr := busy.LocalAddr().String()
+        if servers > 1 {
+            addr = freeAddr
+        }
+        return &dns.Server{Addr: addr, Net: "udp", Handler: dns.HandlerFunc(p.handleRequest),
+            NotifyStartedFunc: func() { close(started) }}
+    }
+
+    if err := newListener(newServer).serve(0); err == nil {
+        t.Fatal("listener on a busy address served without LISTENER_RESTART")
+    }
+
+    servers = 0
+    logs := captureLog(t)
+    l := newListener(newServer)
+    served := make(chan error, 1)
+    go func() { served <- l.serve(2) }()
+    select {
+    case <-started:
+    case <-time.After(3 * time.Second):
+        t.Fatal("listener never rebound")
+    }
+    if out := logs.String(); !strings.Contains(out, "rebinding in 1s (attempt 1 of 2)") {
+        t.Errorf("rebind attempt not logged:\n%s", out)
+    }
+
+    r := new(dns.Msg)
+    r.SetQuestion("web.docker.", dns.TypeA)
+    if m, _, err := (&dns.Client{Timeout: time.Second}).Exchange(r, freeAddr); err != nil || answerIP(m) != "10.0.0.99" {
+        t.Errorf("rebound listener answered %v, %v", m, err)
+    }
+
+    ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+    defer cancel()
+    if err := l.shutdown(ctx); err != nil {
+        t.Error(err)
+    }
+    if err := <-served; err != nil {
+        t.Errorf("serve after shutdown: %v", err)
+    }
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "log"
+    "os"
+    "time"
+)
+
+// Values of LOG_FORMAT
+const (
+    logFormatText = "text"
+    logFormatJSON = "json"
+)
+
+// JSON lines carry their own timestamp, so they skip the standard flags
+var jsonLogger = log.New(os.Stderr, "", 0)
+
+// logFields are the structured fields of a log line, such as query, qtype,
+// client and latency_ms. Text mode leaves them out, the message already
+// carries the same details.
+type logFields map[string]interface{}
+
+// logEnabled reports whether lines of level pass the current log level.
+func (p *DNSProxy) logEnabled(level string) bool {
+    switch current := p.level(); level {
+    case "DEBUG":
+        return current == "DEBUG"
+    case "INFO":
+        return current == "DEBUG" || current == "INFO"
+    }
+    return true
+}
+
+// logWith logs at level with structured fields for JSON output.
+func (p *DNSProxy) logWith(level string, fields logFields, format string, v ...interface{}) {
+    if p.logEnabled(level) {
+        p.output(2, level, fields, format, v...)
+    }
+}
+
+// output writes one log line in the configured LOG_FORMAT. depth is the
+// number of frames between the caller to report and output, so the file and
+// line in text mode point at the call site rather than at a log helper.
+func (p *DNSProxy) output(depth int, level string, fields logFields, format string, v ...interface{}) {
+    msg := fmt.Sprintf(format, v...)
+
+    if p.config().LogFormat == logFormatJSON {
+        entry := logFields{"time": time.Now().UTC().Format(time.RFC3339Nano), "level": level, "msg": msg}
+        for k, value := range fields {
+            entry[k] = value
+        }
+        // Fields hold only strings and numbers, which always encode
+        line, _ := json.Marshal(entry)
+        jsonLogger.Output(depth+1, string(line))
+        return
+    }
+
+    log.Output(depth+1, "["+level+"] "+msg)
+}
@@ -1,278 +1,2008 @@
 package main
 
 import (
+    "context"
+    "errors"
+    "fmt"
+    "hash/fnv"
     "log"
+    "math/rand"
     "net"
+    "net/http"
     "os"
     "os/signal"
+    "sort"
     "strconv"
     "strings"
+    "sync"
+    "sync/atomic"
     "syscall"
     "time"
 
     "github.com/miekg/dns"
+    "golang.org/x/sync/singleflight"
 )
 
 // Configuration with environment variables and defaults
 type Config struct {
     ListenAddr     string
     ListenPort     string
-    DockerDNS      string
-    UpstreamDNS    string
+    TCPEnabled     bool
+    DockerDNS      []string
+    UpstreamDNS    []string
     EnableUpstream bool
     Timeout        time.Duration
+    RequestTimeout time.Duration
+    QtypeTimeouts  map[uint16]time.Duration
     LogLevel       string
+    LogFormat      string
     EnableMetrics  bool
-    StripSuffix    string
+    MetricsAddr    string
+    StripSuffixes  []string
+    StripRepeated  bool
+    NegTTLJitter   float64
+    StrictZones    bool
+    SortAnswers    bool
+    SanityCheck    bool
+    NameRewrites   map[string]string
+
+    ShutdownTimeout   time.Duration
+    MetricsInterval   time.Duration
+    PoolSize          int
+    PoolQueue         int
+    MaxQueriesPerConn int
+    ListenerRestart   int
+
+    CacheEnabled      bool
+    CacheMaxEntries   int
+    CacheMaxBytes     int
+    StaleIfErrorTTL   time.Duration
+    NegativeCacheTTL  time.Duration
+    CacheRefreshAhead time.Duration
+    PrefetchThreshold float64
+
+    CachePreference        string
+    CachePreferenceClients []*net.IPNet
+
+    HostInternalIP    string
+    GatewayInternalIP string
+
+    HostsFile string
+    Hosts     map[string][]net.IP
+
+    FallbackIPs map[string][]net.IP
+
+    EmptyUpstreamRetry  bool
+    FallbackToUpstream  bool
+    ParallelResolve     bool
+    UpstreamSelection   string
+    UpstreamMaxInflight int
+    ScheduleRules       []scheduleRule
+    ShadowUpstream      string
+    ValidatingUpstream  string
+    RegexRules          []regexRule
+    PassthroughSuffixes []string
+
+    K8sResolver string
+    K8sDomain   string
+
+    BreakerThreshold    int
+    BreakerOpenDuration time.Duration
+
+    UpstreamHealthInterval time.Duration
+
+    UpstreamProtocol      string
+    UpstreamTLSServerName string
+
+    UpstreamMaxAnswers    int
+    UpstreamMaxAuthority  int
+    UpstreamMaxAdditional int
+
+    AllowedClients []*net.IPNet
+
+    RequireTCPAbove  int
+    MaxClientUDPSize int
+    RequireTCPQtypes []uint16
+
+    RRLResponsesPerSec float64
+    RRLSlip            int
+
+    RateLimitQPS   float64
+    RateLimitBurst int
+    TopClients     int
+
+    DockerMaxTTL      uint32
+    DockerDNSRetries  int
+    UsePartialAnswers bool
+    TryFullNameFirst  bool
+    DockerDNSV4       string
+    DockerDNSV6       string
+
+    AdminAddr  string
+    AdminToken string
+    HealthAddr string
+
+    EnableFeaturesTXT bool
+    SyntheticTTL      uint32
+    ChaosHostname     string
+    ChaosAuthors      string
+
+    EDNSPolicy map[uint16]ednsAction
+
+    EnableCookies bool
+    CookieSecret  string
+    EnableEDE     bool
+
+    QueryLogFile    string
+    LogNameCase     string
+    PrintConfigJSON bool
+
+    FaultInjectionRate float64
+
+    MaintenanceMode     bool
+    MaintenanceName     string
+    MaintenanceMessage  string
+    MaintenanceServfail bool
 }
 
 func loadConfig() *Config {
-    return &Config{
-        ListenAddr:     getEnv("LISTEN_ADDR", "127.0.0.1"),
+    configFile := os.Getenv("CONFIG_FILE")
+    if value, ok := flagValues["CONFIG_FILE"]; ok {
+        configFile = value
+    }
+    loadConfigFile(configFile)
+
+    config := &Config{
+        ListenAddr:     getEnvOrEmpty("LISTEN_ADDR", "127.0.0.1"),
         ListenPort:     getEnv("LISTEN_PORT", "5353"),
-        DockerDNS:      getEnv("DOCKER_DNS", "127.0.0.11:53"),
-        UpstreamDNS:    getEnv("UPSTREAM_DNS", "8.8.8.8:53"),
+        TCPEnabled:     getBoolEnv("TCP_ENABLED", true),
+        DockerDNS:      getListEnv("DOCKER_DNS", dockerDNSAuto),
+        UpstreamDNS:    getListEnv("UPSTREAM_DNS", "8.8.8.8"),
         EnableUpstream: getBoolEnv("ENABLE_UPSTREAM", false),
-        Timeout:        getDurationEnv("TIMEOUT_SECONDS", 2) * time.Second,
+        Timeout:        getDurationEnv("TIMEOUT_SECONDS", 2),
+        RequestTimeout: getDurationEnv("REQUEST_TIMEOUT_SECONDS", 5),
+        QtypeTimeouts:  getQtypeTimeoutsEnv("QTYPE_TIMEOUTS"),
         LogLevel:       getEnv("LOG_LEVEL", "INFO"),
+        LogFormat:      strings.ToLower(getEnv("LOG_FORMAT", logFormatText)),
         EnableMetrics:  getBoolEnv("ENABLE_METRICS", false),
-        StripSuffix:    getEnv("STRIP_SUFFIX", ".docker"),
+        MetricsAddr:    getEnv("METRICS_ADDR", "127.0.0.1:9153"),
+        StripSuffixes:  getStripSuffixesEnv("STRIP_SUFFIX", ".docker"),
+        StripRepeated:  getBoolEnv("STRIP_REPEATED", false),
+        NameRewrites:   getNameRewritesEnv("NAME_REWRITES"),
+        NegTTLJitter:   getFloatEnv("NEG_TTL_JITTER", 0),
+        StrictZones:    getBoolEnv("STRICT_ZONES", false),
+        SortAnswers:    getBoolEnv("SORT_ANSWERS", false),
+        SanityCheck:    getBoolEnv("SANITY_CHECK", true),
+
+        ShutdownTimeout:   getDurationEnv("SHUTDOWN_TIMEOUT_SECONDS", 5),
+        MetricsInterval:   getDurationEnv("METRICS_INTERVAL_SECONDS", 30),
+        PoolSize:          getIntEnv("POOL_SIZE", 0),
+        PoolQueue:         getIntEnv("POOL_QUEUE", 256),
+        MaxQueriesPerConn: getIntEnv("MAX_QUERIES_PER_CONN", 128),
+        ListenerRestart:   getIntEnv("LISTENER_RESTART", 3),
+
+        CacheEnabled:      getBoolEnv("CACHE_ENABLED", false),
+        CacheMaxEntries:   getIntEnv("CACHE_MAX_ENTRIES", 10000),
+        CacheMaxBytes:     getIntEnv("CACHE_MAX_BYTES", 0),
+        StaleIfErrorTTL:   getDurationEnv("STALE_IF_ERROR_TTL", 0),
+        NegativeCacheTTL:  getDurationEnv("NEGATIVE_CACHE_TTL_SECONDS", 0),
+        CacheRefreshAhead: getDurationEnv("CACHE_REFRESH_AHEAD", 0),
+        PrefetchThreshold: getFloatEnv("PREFETCH_THRESHOLD", 0),
+
+        CachePreference:        strings.ToLower(getEnv("CACHE_PREFERENCE", preferFresh)),
+        CachePreferenceClients: getCIDRListEnv("CACHE_PREFERENCE_CLIENTS"),
+
+        HostInternalIP:    getEnv("HOST_INTERNAL_IP", ""),
+        GatewayInternalIP: getEnv("GATEWAY_INTERNAL_IP", ""),
+
+        HostsFile: getEnv("HOSTS_FILE", ""),
+
+        EmptyUpstreamRetry:  getBoolEnv("EMPTY_UPSTREAM_RETRY", false),
+        FallbackToUpstream:  getBoolEnv("FALLBACK_TO_UPSTREAM", false),
+        ParallelResolve:     getBoolEnv("PARALLEL_RESOLVE", false),
+        UpstreamSelection:   strings.ToLower(getEnv("UPSTREAM_SELECTION", selectionOrdered)),
+        UpstreamMaxInflight: getIntEnv("UPSTREAM_MAX_INFLIGHT", 0),
+        ShadowUpstream:      getEnv("SHADOW_UPSTREAM", ""),
+        ValidatingUpstream:  getEnv("VALIDATING_UPSTREAM", ""),
+        RegexRules:          getRegexRulesEnv("REGEX_RULES"),
+        PassthroughSuffixes: getSuffixListEnv("PASSTHROUGH_SUFFIXES"),
+
+        K8sResolver: getEnv("K8S_RESOLVER", ""),
+        K8sDomain:   getEnv("K8S_DOMAIN", "cluster.local"),
+
+        BreakerThreshold:    getIntEnv("BREAKER_THRESHOLD", 5),
+        BreakerOpenDuration: getDurationEnv("BREAKER_OPEN_SECONDS", 30),
+
+        UpstreamHealthInterval: getDurationEnv("UPSTREAM_HEALTHCHECK_INTERVAL", 0),
+
+        UpstreamProtocol:      getUpstreamProtocolEnv("UPSTREAM_PROTOCOL"),
+        UpstreamTLSServerName: getEnv("UPSTREAM_TLS_SERVERNAME", ""),
+
+        UpstreamMaxAnswers:    getIntEnv("UPSTREAM_MAX_ANSWERS", 256),
+        UpstreamMaxAuthority:  getIntEnv("UPSTREAM_MAX_AUTHORITY", 256),
+        UpstreamMaxAdditional: getIntEnv("UPSTREAM_MAX_ADDITIONAL", 256),
+
+        AllowedClients: getCIDRListEnv("ALLOWED_CLIENTS"),
+
+        RequireTCPAbove:  getIntEnv("REQUIRE_TCP_ABOVE", 0),
+        MaxClientUDPSize: getIntEnv("MAX_CLIENT_UDP_SIZE", 1432),
+        RequireTCPQtypes: getQtypeListEnv("REQUIRE_TCP_QTYPES"),
+
+        RRLResponsesPerSec: getFloatEnv("RRL_RESPONSES_PER_SEC", 0),
+        RRLSlip:            getIntEnv("RRL_SLIP", 2),
+
+        RateLimitQPS:   getFloatEnv("RATE_LIMIT_QPS", 0),
+        RateLimitBurst: getIntEnv("RATE_LIMIT_BURST", 0),
+        TopClients:     getIntEnv("TOP_CLIENTS", 0),
+
+        DockerMaxTTL:      uint32(getIntEnv("DOCKER_MAX_TTL", 0)),
+        DockerDNSRetries:  getIntEnv("DOCKER_DNS_RETRIES", 1),
+        DockerDNSV4:       getEnv("DOCKER_DNS_V4", ""),
+        DockerDNSV6:       getEnv("DOCKER_DNS_V6", ""),
+        UsePartialAnswers: getBoolEnv("USE_PARTIAL_ANSWERS", false),
+        TryFullNameFirst:  getBoolEnv("TRY_FULL_NAME_FIRST", false),
+
+        AdminAddr:  getEnv("ADMIN_ADDR", ""),
+        AdminToken: getEnv("ADMIN_TOKEN", ""),
+        HealthAddr: getEnv("HEALTH_ADDR", ""),
+
+        EnableFeaturesTXT: getBoolEnv("ENABLE_FEATURES_TXT", false),
+        SyntheticTTL:      uint32(getIntEnv("SYNTHETIC_TTL", 60)),
+        ChaosHostname:     getEnvOrEmpty("CHAOS_HOSTNAME", defaultHostname()),
+        ChaosAuthors:      getEnv("CHAOS_AUTHORS", ""),
+
+        EDNSPolicy: getEDNSPolicyEnv("EDNS_POLICY"),
+
+        EnableCookies: getBoolEnv("ENABLE_COOKIES", false),
+        CookieSecret:  getEnv("COOKIE_SECRET", ""),
+        EnableEDE:     getBoolEnv("ENABLE_EDE", false),
+
+        QueryLogFile:    getEnv("QUERY_LOG_FILE", ""),
+        LogNameCase:     strings.ToLower(getEnv("LOG_NAME_CASE", nameCaseLower)),
+        PrintConfigJSON: getBoolEnv("PRINT_CONFIG_JSON", false),
+
+        FaultInjectionRate: getFloatEnv("FAULT_INJECTION_RATE", 0),
+
+        MaintenanceMode:     getBoolEnv("MAINTENANCE_MODE", false),
+        MaintenanceName:     getEnv("MAINTENANCE_NAME", ""),
+        MaintenanceMessage:  getEnv("MAINTENANCE_MESSAGE", "maintenance in progress"),
+        MaintenanceServfail: getBoolEnv("MAINTENANCE_SERVFAIL", false),
+    }
+
+    if config.FaultInjectionRate < 0 || config.FaultInjectionRate > 1 {
+        log.Printf("Warning: FAULT_INJECTION_RATE must be between 0 and 1, disabling fault injection")
+        config.FaultInjectionRate = 0
+    }
+    if config.LogFormat != logFormatText && config.LogFormat != logFormatJSON {
+        log.Printf("Warning: Unknown LOG_FORMAT %s, using %s", config.LogFormat, logFormatText)
+        config.LogFormat = logFormatText
+    }
+    if config.LogNameCase != nameCaseLower && config.LogNameCase != nameCaseOriginal {
+        log.Printf("Warning: Unknown LOG_NAME_CASE %s, using %s", config.LogNameCase, nameCaseLower)
+        config.LogNameCase = nameCaseLower
+    }
+    if config.UpstreamSelection != selectionOrdered && config.UpstreamSelection != selectionConsistentHash {
+        log.Printf("Warning: Unknown UPSTREAM_SELECTION %s, using %s", config.UpstreamSelection, selectionOrdered)
+        config.UpstreamSelection = selectionOrdered
+    }
+    if config.MaxClientUDPSize > 0 && config.MaxClientUDPSize < dns.MinMsgSize {
+        log.Printf("Warning: MAX_CLIENT_UDP_SIZE below %d, using %d", dns.MinMsgSize, dns.MinMsgSize)
+        config.MaxClientUDPSize = dns.MinMsgSize
+    }
+    if config.NegTTLJitter < 0 || config.NegTTLJitter >= 1 {
+        log.Printf("Warning: NEG_TTL_JITTER must be between 0 and 1, disabling jitter")
+        config.NegTTLJitter = 0
+    }
+    if config.CachePreference != preferFresh && config.CachePreference != preferCached {
+        log.Printf("Warning: Unknown CACHE_PREFERENCE %s, using %s", config.CachePreference, preferFresh)
+        config.CachePreference = preferFresh
+    }
+    if config.PoolQueue < 0 {
+        config.PoolQueue = 0
+    }
+    if config.MaxQueriesPerConn < 0 {
+        config.MaxQueriesPerConn = 0
+    }
+    if config.ListenerRestart < 0 {
+        config.ListenerRestart = 0
+    }
+    if config.DockerDNSRetries < 0 {
+        config.DockerDNSRetries = 0
+    }
+    if config.MetricsInterval < 0 {
+        config.MetricsInterval = 0
+    }
+    if config.PrefetchThreshold < 0 || config.PrefetchThreshold >= 1 {
+        log.Printf("Warning: PREFETCH_THRESHOLD must be between 0 and 1, disabling prefetch")
+        config.PrefetchThreshold = 0
+    }
+
+    for i, server := range config.DockerDNS {
+        if server == dockerDNSAuto {
+            config.DockerDNS[i] = detectDockerDNS(getEnv("DOCKER_DNS_FALLBACK", ""), "/etc/resolv.conf")
+        }
+    }
+
+    config.UpstreamDNS = withDefaultPort(config.UpstreamDNS, config.upstreamPort())
+    config.DockerDNSV4 = addrWithDefaultPort(config.DockerDNSV4, dnsPort)
+    config.DockerDNSV6 = addrWithDefaultPort(config.DockerDNSV6, dnsPort)
+    config.ShadowUpstream = addrWithDefaultPort(config.ShadowUpstream, dnsPort)
+    config.ValidatingUpstream = addrWithDefaultPort(config.ValidatingUpstream, dnsPort)
+    config.K8sResolver = addrWithDefaultPort(config.K8sResolver, dnsPort)
+    config.ScheduleRules = getScheduleRulesEnv("SCHEDULE_RULES", config.upstreamPort())
+
+    config.Hosts = mergeHosts(loadHostsFile(config.HostsFile, config.StripSuffixes),
+        getHostIPsEnv("STATIC_HOSTS", config.StripSuffixes))
+    config.FallbackIPs = getHostIPsEnv("FALLBACK_IPS", config.StripSuffixes)
+    return config
+}
+
+// Shortest timeout accepted. A zero timeout would mean no timeout at all in
+// the DNS client.
+const minTimeout = 100 * time.Millisecond
+
+func clampTimeout(key string, timeout time.Duration) time.Duration {
+    if timeout < minTimeout {
+        log.Printf("Warning: %s of %v is below the minimum, using %v", key, timeout, minTimeout)
+        return minTimeout
+    }
+    return timeout
+}
+
+// Values read from CONFIG_FILE, which take precedence over the environment
+// but not over command-line flags.
+// The file is re-read on every loadConfig so SIGHUP can pick up changes.
+var configFileValues map[string]string
+
+func loadConfigFile(path string) {
+    configFileValues = nil
+    if path == "" {
+        return
+    }
+
+    data, err := os.ReadFile(path)
+    if err != nil {
+        log.Printf("Warning: Could not read config file %s: %v", path, err)
+        return
+    }
+
+    configFileValues = make(map[string]string)
+    for _, line := range strings.Split(string(data), "\n") {
+        line = strings.TrimSpace(line)
+        if line == "" || strings.HasPrefix(line, "#") {
+            continue
+        }
+        key, value, ok := strings.Cut(line, "=")
+        if !ok {
+            log.Printf("Warning: Ignoring malformed line in %s: %s", path, line)
+            continue
+        }
+        configFileValues[strings.TrimSpace(key)] = strings.Trim(strings.TrimSpace(value), `"'`)
+    }
+}
+
+func lookupEnv(key string) string {
+    value, _ := lookupEnvSet(key)
+    return value
+}
+
+// lookupEnvSet is lookupEnv that also reports whether key was given at all.
+func lookupEnvSet(key string) (string, bool) {
+    if value, ok := flagValues[key]; ok {
+        return value, true
+    }
+    if value, ok := configFileValues[key]; ok {
+        return value, true
+    }
+    return os.LookupEnv(key)
+}
+
+func getEnv(key, defaultValue string) string {
+    if value := lookupEnv(key); value != "" {
+        return value
+    }
+    return defaultValue
+}
+
+// getEnvOrEmpty is getEnv for settings where an empty value means something,
+// falling back to defaultValue only when key is not set.
+func getEnvOrEmpty(key, defaultValue string) string {
+    if value, ok := lookupEnvSet(key); ok {
+        return strings.TrimSpace(value)
+    }
+    return defaultValue
+}
+
+// getListEnv splits a comma-separated value, dropping empty entries.
+func getListEnv(key, defaultValue string) []string {
+    var list []string
+    for _, item := range strings.Split(getEnv(key, defaultValue), ",") {
+        if item = strings.TrimSpace(item); item != "" {
+            list = append(list, item)
+        }
+    }
+    return list
+}
+
+// getStripSuffixesEnv parses a comma-separated list of suffixes into the
+// form ".docker", so `docker`, `.docker` and `.docker.` are all accepted.
+func getStripSuffixesEnv(key, defaultValue string) []string {
+    var suffixes []string
+    for _, suffix := range getListEnv(key, defaultValue) {
+        if suffix = strings.ToLower(strings.Trim(suffix, ".")); suffix != "" {
+            suffixes = append(suffixes, "."+suffix)
+        }
+    }
+    return suffixes
+}
+
+// getSuffixListEnv parses a comma-separated list of domain suffixes into the
+// form ".example.docker." used to match fully qualified query names.
+func getSuffixListEnv(key string) []string {
+    var suffixes []string
+    for _, suffix := range getListEnv(key, "") {
+        suffix = strings.ToLower(dns.Fqdn(suffix))
+        if !strings.HasPrefix(suffix, ".") {
+            suffix = "." + suffix
+        }
+        suffixes = append(suffixes, suffix)
+    }
+    return suffixes
+}
+
+// getQtypeListEnv parses a comma-separated list of record types like "ANY,TXT".
+func getQtypeListEnv(key string) []uint16 {
+    var qtypes []uint16
+    for _, name := range getListEnv(key, "") {
+        qtype, ok := dns.StringToType[strings.ToUpper(name)]
+        if !ok {
+            log.Printf("Warning: Unknown record type in %s: %s", key, name)
+            continue
+        }
+        qtypes = append(qtypes, qtype)
+    }
+    return qtypes
+}
+
+// getQtypeTimeoutsEnv parses a comma-separated list of type=seconds pairs
+// like "AAAA=1,TXT=3".
+func getQtypeTimeoutsEnv(key string) map[uint16]time.Duration {
+    var timeouts map[uint16]time.Duration
+    for _, entry := range getListEnv(key, "") {
+        name, value, _ := strings.Cut(entry, "=")
+        qtype, ok := dns.StringToType[strings.ToUpper(strings.TrimSpace(name))]
+        seconds, err := strconv.Atoi(strings.TrimSpace(value))
+        if !ok || err != nil {
+            log.Printf("Warning: Invalid entry in %s: %s, expected type=seconds", key, entry)
+            continue
+        }
+        if timeouts == nil {
+            timeouts = make(map[uint16]time.Duration)
+        }
+        timeouts[qtype] = clampTimeout(key, time.Duration(seconds)*time.Second)
+    }
+    return timeouts
+}
+
+func getBoolEnv(key string, defaultValue bool) bool {
+    if value := lookupEnv(key); value != "" {
+        if parsed, err := strconv.ParseBool(value); err == nil {
+            return parsed
+        }
+        log.Printf("Warning: Invalid boolean value for %s: %s, using default: %v", key, value, defaultValue)
+    }
+    return defaultValue
+}
+
+func getIntEnv(key string, defaultValue int) int {
+    if value := lookupEnv(key); value != "" {
+        if parsed, err := strconv.Atoi(value); err == nil {
+            return parsed
+        }
+        log.Printf("Warning: Invalid integer value for %s: %s, using default: %d", key, value, defaultValue)
+    }
+    return defaultValue
+}
+
+func getFloatEnv(key string, defaultValue float64) float64 {
+    if value := lookupEnv(key); value != "" {
+        if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+            return parsed
+        }
+        log.Printf("Warning: Invalid number value for %s: %s, using default: %v", key, value, defaultValue)
+    }
+    return defaultValue
+}
+
+// getDurationEnv reads a whole number of seconds.
+func getDurationEnv(key string, defaultSeconds int) time.Duration {
+    if value := lookupEnv(key); value != "" {
+        if parsed, err := strconv.Atoi(value); err == nil {
+            return time.Duration(parsed) * time.Second
+        }
+        log.Printf("Warning: Invalid duration value for %s: %s, using default: %d", key, value, defaultSeconds)
+    }
+    return time.Duration(defaultSeconds) * time.Second
+}
+
+type DNSProxy struct {
+    current     atomic.Value // *Config, replaced on reload
+    logLevel    atomic.Value // string, may be changed at runtime
+    maintenance int32        // 1 while in maintenance mode, toggled at runtime
+    upstream    int32        // 1 while upstream forwarding is on, toggled at runtime
+    draining    int32        // 1 once shutdown has begun
+    active      int64        // queries being answered
+    cache       *answerCache
+    queryCount  int64        // updated atomically, handlers run concurrently
+    errorCount  int64        // updated atomically
+
+    breakersMu sync.Mutex
+    breakers   map[string]*circuitBreaker
+    inflight   *inflightLimiter
+    dot        *dotPool
+    flight     singleflight.Group // identical exchanges in flight share one query
+
+    healthMu  sync.Mutex
+    unhealthy map[string]bool // upstreams whose last health check failed
+
+    cookieSecret []byte
+    started      time.Time
+    queryLog     queryLog
+
+    rrl        *responseLimiter
+    rrlDropped int64
+    rrlSlipped int64
+
+    clientLimiter    *clientLimiter
+    rateLimitedCount int64
+    topClients       *topClients
+
+    shadowQueries    int64
+    shadowMismatches int64
+    tcpRetries       int64
+    firstQueryNanos  int64 // latency of the first query, 0 until it is answered
+
+    filters []ResponseFilter
+    pool    *workerPool // set when POOL_SIZE bounds concurrent queries
+    metrics *metrics
+}
+
+func NewDNSProxy(config *Config) *DNSProxy {
+    p := &DNSProxy{
+        cache:    newAnswerCache(config.CacheMaxEntries, config.CacheMaxBytes),
+        breakers: make(map[string]*circuitBreaker),
+        inflight: newInflightLimiter(),
+        dot:      newDoTPool(),
+
+        unhealthy: make(map[string]bool),
+
+        cookieSecret: cookieSecret(config.CookieSecret),
+        started:      time.Now(),
+
+        clientLimiter: newClientLimiter(),
+        topClients:    newTopClients(config.TopClients),
+
+        rrl:     newResponseLimiter(),
+        metrics: newMetrics(),
+    }
+    p.current.Store(config)
+    p.logLevel.Store(strings.ToUpper(config.LogLevel))
+    p.setMaintenance(config.MaintenanceMode)
+    p.setUpstream(config.EnableUpstream)
+    if err := p.queryLog.reopen(config.QueryLogFile); err != nil {
+        log.Printf("Warning: Could not open query log %s: %v", config.QueryLogFile, err)
+    }
+    return p
+}
+
+// config returns the active configuration. Request handling loads it once and
+// passes it down, so a reload never mixes old and new values in one query.
+func (p *DNSProxy) config() *Config {
+    return p.current.Load().(*Config)
+}
+
+// reload swaps in a freshly loaded configuration. The listen address can't
+// change without restarting the server, so the running one is kept.
+func (p *DNSProxy) reload(config *Config) error {
+    old := p.config()
+    if config.ListenAddr != old.ListenAddr || config.ListenPort != old.ListenPort {
+        return fmt.Errorf("listen address can't change on reload (%s:%s -> %s:%s)",
+            old.ListenAddr, old.ListenPort, config.ListenAddr, config.ListenPort)
+    }
+    p.cache.setLimits(config.CacheMaxEntries, config.CacheMaxBytes)
+    p.topClients.setSize(config.TopClients)
+    p.current.Store(config)
+    p.logLevel.Store(strings.ToUpper(config.LogLevel))
+    p.setMaintenance(config.MaintenanceMode)
+    p.setUpstream(config.EnableUpstream)
+    return nil
+}
+
+func (p *DNSProxy) upstreamEnabled() bool {
+    return atomic.LoadInt32(&p.upstream) == 1
+}
+
+// setUpstream turns upstream forwarding on or off until the next reload.
+func (p *DNSProxy) setUpstream(enabled bool) {
+    var v int32
+    if enabled {
+        v = 1
+    }
+    if atomic.SwapInt32(&p.upstream, v) != v {
+        log.Printf("Upstream DNS enabled: %v", enabled)
+    }
+}
+
+// requestConfig returns the configuration to use for one query: the active
+// configuration with runtime toggles applied.
+func (p *DNSProxy) requestConfig() *Config {
+    cfg := p.config()
+    if enabled := p.upstreamEnabled(); enabled != cfg.EnableUpstream {
+        overridden := *cfg
+        overridden.EnableUpstream = enabled
+        cfg = &overridden
+    }
+    return cfg
+}
+
+// Log levels accepted by LOG_LEVEL and the runtime log level controls
+var logLevels = map[string]bool{"DEBUG": true, "INFO": true, "ERROR": true}
+
+func (p *DNSProxy) level() string {
+    return p.logLevel.Load().(string)
+}
+
+// setLevel changes the log level until the next reload.
+func (p *DNSProxy) setLevel(level string) error {
+    level = strings.ToUpper(level)
+    if !logLevels[level] {
+        return fmt.Errorf("unknown log level %q", level)
+    }
+    p.logLevel.Store(level)
+    log.Printf("Log level set to %s", level)
+    return nil
+}
+
+// toggleDebug switches between DEBUG and the configured log level.
+func (p *DNSProxy) toggleDebug() {
+    level := "DEBUG"
+    if p.level() == "DEBUG" {
+        level = strings.ToUpper(p.config().LogLevel)
+        if level == "DEBUG" {
+            level = "INFO"
+        }
+    }
+    p.setLevel(level)
+}
+
+// timeoutFor returns the timeout of a single exchange for qtype: its
+// QTYPE_TIMEOUTS entry, or TIMEOUT_SECONDS.
+func (c *Config) timeoutFor(qtype uint16) time.Duration {
+    if timeout, ok := c.QtypeTimeouts[qtype]; ok {
+        return timeout
+    }
+    return c.Timeout
+}
+
+// qtypeTimeoutsString lists QTYPE_TIMEOUTS in its own form, sorted by type.
+func (c *Config) qtypeTimeoutsString() string {
+    var entries []string
+    for qtype, timeout := range c.QtypeTimeouts {
+        entries = append(entries, fmt.Sprintf("%s=%v", qtypeName(qtype), timeout))
+    }
+    sort.Strings(entries)
+    return strings.Join(entries, ",")
+}
+
+func newClient(config *Config) *dns.Client {
+    return &dns.Client{
+        Net:     "udp",
+        Timeout: config.Timeout,
+    }
+}
+
+// exchange sends m to server, sharing one exchange between concurrent
+// callers sending the same message to the same server. Under bursts this
+// keeps identical queries from piling up on Docker DNS or an upstream. The
+// shared exchange runs on its own timeout, not the context of whichever
+// caller started it, so one caller giving up doesn't fail the others; each
+// caller stops waiting when its own ctx is done. The callers get their own
+// copy of the reply, since they go on to edit it.
+func (p *DNSProxy) exchange(ctx context.Context, cfg *Config, m *dns.Msg, server string) (*dns.Msg, error) {
+    // The key is the packed message without its ID, so only queries with the
+    // same question, flags and EDNS options are merged
+    query := *m
+    query.Id = 0
+    packed, err := query.Pack()
+    if err != nil {
+        return p.exchangeOnce(ctx, cfg, m, server)
+    }
+
+    shared := m.Copy()
+    results := p.flight.DoChan(server+"|"+string(packed), func() (interface{}, error) {
+        ctx, cancel := context.WithTimeout(context.Background(), cfg.timeoutFor(shared.Question[0].Qtype))
+        defer cancel()
+        return p.exchangeOnce(ctx, cfg, shared, server)
+    })
+
+    select {
+    case result := <-results:
+        if result.Err != nil {
+            return nil, result.Err
+        }
+        reply := result.Val.(*dns.Msg)
+        if result.Shared {
+            reply = reply.Copy()
+            reply.Id = m.Id
+        }
+        return reply, nil
+    case <-ctx.Done():
+        return nil, ctx.Err()
+    }
+}
+
+func (p *DNSProxy) exchangeOnce(ctx context.Context, cfg *Config, m *dns.Msg, server string) (*dns.Msg, error) {
+    client := cfg.clientFor(server, m.Question[0].Qtype)
+    if client.Net == protocolDoT {
+        return p.dot.exchange(ctx, client, m, server)
+    }
+    reply, _, err := client.ExchangeContext(ctx, m, server)
+    if err != nil || !reply.Truncated || !cfg.TCPEnabled || client.Net != "udp" {
+        return reply, err
+    }
+
+    atomic.AddInt64(&p.tcpRetries, 1)
+    p.logDebug("Reply from %s for %s is truncated, retrying over TCP", server, m.Question[0].Name)
+    client.Net = "tcp"
+    reply, _, err = client.ExchangeContext(ctx, m, server)
+    return reply, err
+}
+
+func (p *DNSProxy) logDebug(format string, v ...interface{}) {
+    if p.logEnabled("DEBUG") {
+        p.output(2, "DEBUG", nil, format, v...)
+    }
+}
+
+func (p *DNSProxy) logInfo(format string, v ...interface{}) {
+    if p.logEnabled("INFO") {
+        p.output(2, "INFO", nil, format, v...)
+    }
+}
+
+func (p *DNSProxy) logError(format string, v ...interface{}) {
+    p.output(2, "ERROR", nil, format, v...)
+    atomic.AddInt64(&p.errorCount, 1)
+    p.metrics.errors.Inc()
+}
+
+// handleRequest does the work done once per client message: admission
+// (draining, ACL, rate limit), metrics, logging, response rate limiting and
+// fitting the reply to the UDP size. The questions themselves are answered
+// by answerQuestion.
+func (p *DNSProxy) handleRequest(w dns.ResponseWriter, r *dns.Msg) {
+    atomic.AddInt64(&p.active, 1)
+    defer atomic.AddInt64(&p.active, -1)
+
+    queryNum := atomic.AddInt64(&p.queryCount, 1)
+    p.metrics.queries.Inc()
+    cfg := p.requestConfig()
+    client := formatClient(w.RemoteAddr())
+
+    if p.isDraining() {
+        m := new(dns.Msg)
+        m.SetRcode(r, dns.RcodeRefused)
+        p.writeResponse(w, m)
+        return
+    }
+    
+    if len(r.Question) == 0 {
+        p.logError("Received query with no questions")
+        dns.HandleFailed(w, r)
+        return
+    }
+    if len(r.Question) > maxQuestions {
+        p.logError("Rejected query with %d questions from %s", len(r.Question), client)
+        m := new(dns.Msg)
+        m.SetRcodeFormatError(r)
+        p.writeResponse(w, m)
+        return
+    }
+
+    for _, question := range r.Question {
+        if !validQueryName(question.Name) {
+            p.logError("Rejected query with control characters in name from %s", client)
+            m := new(dns.Msg)
+            m.SetRcodeFormatError(r)
+            p.writeResponse(w, m)
+            return
+        }
+    }
+
+    if !cfg.clientAllowed(clientIP(w.RemoteAddr())) {
+        p.logDebug("Refusing query from %s, client not in ALLOWED_CLIENTS", client)
+        m := new(dns.Msg)
+        m.SetRcode(r, dns.RcodeRefused)
+        p.writeResponse(w, m)
+        return
+    }
+
+    if cfg.TopClients > 0 {
+        p.topClients.record(clientIP(w.RemoteAddr()).String())
+    }
+
+    if cfg.RateLimitQPS > 0 {
+        allowed, wait := p.clientLimiter.allow(clientIP(w.RemoteAddr()).String(), cfg.RateLimitQPS, cfg.rateLimitBurst(), time.Now())
+        if !allowed {
+            atomic.AddInt64(&p.rateLimitedCount, 1)
+            p.metrics.rateLimited.Inc()
+            p.logDebug("Refusing query from %s, over RATE_LIMIT_QPS", client)
+            m := new(dns.Msg)
+            m.SetRcode(r, dns.RcodeRefused)
+            cfg.addEDE(r, m, dns.ExtendedErrorCodeOther, retryHint("Too many queries", wait))
+            p.writeResponse(w, m)
+            return
+        }
+    }
+
+    logName, qtype := cfg.logQuestions(r)
+    p.logWith("INFO", logFields{"query": logName, "qtype": qtype, "client": client, "id": queryNum},
+        "Query #%d for: %s (type: %s) from %s", queryNum, logName, qtype, client)
+
+    // All lookups for this query share one deadline
+    start := time.Now()
+    ctx, cancel := context.WithTimeout(context.Background(), cfg.RequestTimeout)
+    defer cancel()
+
+    udp := isUDP(w.RemoteAddr())
+    var m *dns.Msg
+    if len(r.Question) > 1 {
+        m = p.answerQuestions(ctx, cfg, r, udp, clientIP(w.RemoteAddr()))
+    } else {
+        var resolved bool
+        m, resolved = p.answerQuestion(ctx, cfg, r, udp, clientIP(w.RemoteAddr()))
+        if !resolved {
+            p.writeResponse(w, m)
+            return
+        }
+    }
+
+    if cfg.EnableCookies {
+        p.addCookie(r, m, clientIP(w.RemoteAddr()))
+    }
+    if udp && cfg.RequireTCPAbove > 0 && m.Len() > cfg.RequireTCPAbove {
+        p.logDebug("Response for %s is %d bytes, above REQUIRE_TCP_ABOVE, truncating UDP response", logName, m.Len())
+        m = truncatedReply(r)
+    }
+    if cfg.SanityCheck {
+        if err := checkResponse(r, m); err != nil {
+            p.logError("Replacing malformed response for %s with SERVFAIL: %v", logName, err)
+            m = new(dns.Msg)
+            m.SetRcode(r, dns.RcodeServerFailure)
+        }
+    }
+    took := time.Since(start)
+    p.recordLatency(took)
+    p.queryLog.write(client, logName, qtype, m, took)
+    p.logWith("DEBUG", logFields{"query": logName, "qtype": qtype, "client": client, "id": queryNum,
+        "rcode": dns.RcodeToString[m.Rcode], "answers": len(m.Answer), "latency_ms": took.Milliseconds()},
+        "Answered query #%d for %s with %s, %d answers in %v", queryNum, logName, dns.RcodeToString[m.Rcode], len(m.Answer), took)
+
+    // Rate limit identical responses over UDP, where the source can be spoofed
+    if udp && cfg.RRLResponsesPerSec > 0 {
+        key := rrlKey(clientSubnet(clientIP(w.RemoteAddr())), m)
+        switch p.rrl.check(key, cfg.RRLResponsesPerSec, cfg.RRLSlip, time.Now()) {
+        case rrlDrop:
+            atomic.AddInt64(&p.rrlDropped, 1)
+            p.logDebug("Response rate limit exceeded for %s from %s, dropping", logName, client)
+            return
+        case rrlSlip:
+            atomic.AddInt64(&p.rrlSlipped, 1)
+            p.logDebug("Response rate limit exceeded for %s from %s, truncating", logName, client)
+            m = truncatedReply(r)
+            cfg.addEDE(r, m, dns.ExtendedErrorCodeOther, "Response rate limited, retry over TCP")
+        }
+    }
+    if udp {
+        fitUDPSize(cfg, r, m)
+    }
+    p.writeResponse(w, m)
+}
+
+// answerQuestion answers r, which carries a single question. resolved is
+// false for replies given without a lookup (TCP required, maintenance,
+// CHAOS, fault injection), which a lone question sends as they are.
+func (p *DNSProxy) answerQuestion(ctx context.Context, cfg *Config, r *dns.Msg, udp bool, client net.IP) (m *dns.Msg, resolved bool) {
+    question := r.Question[0]
+    domain := strings.ToLower(question.Name)
+    logName := cfg.logName(question.Name)
+
+    if udp && cfg.requiresTCP(question.Qtype) {
+        p.logDebug("Type %s requires TCP, truncating UDP response for: %s", dns.TypeToString[question.Qtype], logName)
+        return truncatedReply(r), false
+    }
+
+    if m := p.answerMaintenance(cfg, r, domain); m != nil {
+        return m, false
+    }
+
+    if m := p.answerChaos(cfg, r); m != nil {
+        return m, false
+    }
+
+    if cfg.FaultInjectionRate > 0 && rand.Float64() < cfg.FaultInjectionRate {
+        p.logInfo("Fault injection: returning SERVFAIL for %s", logName)
+        m := new(dns.Msg)
+        m.SetRcode(r, dns.RcodeServerFailure)
+        return m, false
+    }
+
+    req, rewritten := cfg.rewriteRequest(cfg.ednsRequest(r))
+    if rewritten != "" {
+        p.logDebug("Rewriting query %s to %s", logName, rewritten)
+    }
+    m = p.resolve(ctx, cfg, req, client)
+    cfg.ednsResponse(r, m)
+    echoOPT(r, m)
+    p.applyFilters(cfg, r, m)
+    return m, true
+}
+
+// fitUDPSize truncates a UDP response to the buffer size the client
+// advertised, clamped to MAX_CLIENT_UDP_SIZE so a client claiming a huge
+// buffer can't make us send large (amplifying) UDP responses.
+func fitUDPSize(cfg *Config, r *dns.Msg, m *dns.Msg) {
+    size := dns.MinMsgSize
+    if opt := r.IsEdns0(); opt != nil {
+        size = int(opt.UDPSize())
+        if cfg.MaxClientUDPSize > 0 && size > cfg.MaxClientUDPSize {
+            size = cfg.MaxClientUDPSize
+        }
+        if reply := m.IsEdns0(); reply != nil && int(reply.UDPSize()) > size {
+            reply.SetUDPSize(uint16(size))
+        }
+    }
+    m.Truncate(size)
+}
+
+// jitterNegativeTTL lowers the SOA TTL and minimum of a negative response
+// by a random amount of up to jitter (a fraction), so negative cache entries
+// created at the same time don't all expire together.
+func jitterNegativeTTL(m *dns.Msg, jitter float64) {
+    if len(m.Answer) > 0 || (m.Rcode != dns.RcodeSuccess && m.Rcode != dns.RcodeNameError) {
+        return
+    }
+    for _, rr := range m.Ns {
+        if soa, ok := rr.(*dns.SOA); ok {
+            cut := 1 - rand.Float64()*jitter
+            soa.Hdr.Ttl = uint32(float64(soa.Hdr.Ttl) * cut)
+            soa.Minttl = uint32(float64(soa.Minttl) * cut)
+        }
+    }
+}
+
+// dedupeSections removes duplicate records within the answer and additional
+// sections, and additional records that already appear as answers.
+func dedupeSections(m *dns.Msg) {
+    m.Answer = dns.Dedup(m.Answer, nil)
+    if len(m.Extra) == 0 {
+        return
+    }
+
+    extra := m.Extra[:0]
+    for _, rr := range dns.Dedup(m.Extra, nil) {
+        duplicate := false
+        for _, answer := range m.Answer {
+            if dns.IsDuplicate(rr, answer) {
+                duplicate = true
+                break
+            }
+        }
+        if !duplicate {
+            extra = append(extra, rr)
+        }
+    }
+    m.Extra = extra
+}
+
+// sortAnswers puts the answer section in a stable order, by type and then
+// rdata, so the same records always come back the same way. CNAME and DNAME
+// records stay first in the order received, since they lead to the rest.
+func sortAnswers(m *dns.Msg) {
+    rank := func(rr dns.RR) int {
+        if t := rr.Header().Rrtype; t == dns.TypeCNAME || t == dns.TypeDNAME {
+            return 0
+        }
+        return 1
+    }
+    rdata := func(rr dns.RR) string {
+        return strings.TrimPrefix(rr.String(), rr.Header().String())
+    }
+    sort.SliceStable(m.Answer, func(i, j int) bool {
+        a, b := m.Answer[i], m.Answer[j]
+        if rank(a) != rank(b) || rank(a) == 0 {
+            return rank(a) < rank(b)
+        }
+        if a.Header().Rrtype != b.Header().Rrtype {
+            return a.Header().Rrtype < b.Header().Rrtype
+        }
+        return rdata(a) < rdata(b)
+    })
+}
+
+func isUDP(addr net.Addr) bool {
+    _, ok := addr.(*net.UDPAddr)
+    return ok
+}
+
+// truncatedReply is an empty response with the TC bit set, telling the client
+// to retry over TCP.
+func truncatedReply(r *dns.Msg) *dns.Msg {
+    m := new(dns.Msg)
+    m.SetReply(r)
+    // SetReply keeps only the first question
+    m.Question = append([]dns.Question(nil), r.Question...)
+    m.RecursionAvailable = true
+    m.Truncated = true
+    return m
+}
+
+func (c *Config) requiresTCP(qtype uint16) bool {
+    for _, t := range c.RequireTCPQtypes {
+        if t == qtype {
+            return true
+        }
+    }
+    return false
+}
+
+func (p *DNSProxy) writeResponse(w dns.ResponseWriter, m *dns.Msg) {
+    err := w.WriteMsg(m)
+    if err != nil {
+        p.logError("Error writing response: %v", err)
+    }
+}
+
+// validQueryName reports whether name is free of control characters, either
+// raw or in the \DDD escaped form used when unpacking names from the wire.
+func validQueryName(name string) bool {
+    for i := 0; i < len(name); i++ {
+        c := int(name[i])
+        if c == '\\' && i+3 < len(name) && isDigit(name[i+1]) && isDigit(name[i+2]) && isDigit(name[i+3]) {
+            c = int(name[i+1]-'0')*100 + int(name[i+2]-'0')*10 + int(name[i+3]-'0')
+            i += 3
+        } else if c == '\\' && i+1 < len(name) {
+            c = int(name[i+1])
+            i++
+        }
+        if c < ' ' || c == 0x7f {
+            return false
+        }
+    }
+    return true
+}
+
+func isDigit(c byte) bool {
+    return c >= '0' && c <= '9'
+}
+
+// resolve answers the request from the cache when possible, falling back to
+// a fresh lookup and keeping the cache up to date.
+func (p *DNSProxy) resolve(ctx context.Context, cfg *Config, r *dns.Msg, client net.IP) *dns.Msg {
+    // The cache keeps neither the AD bit nor the DO flag, so validated
+    // answers always go to the validating upstream
+    if !cfg.CacheEnabled || cfg.wantsValidation(r) {
+        m, failed := p.lookup(ctx, cfg, r)
+        if failed {
+            if fallback := p.answerFallback(cfg, r); fallback != nil {
+                return fallback
+            }
+        }
+        return m
+    }
+
+    question := r.Question[0]
+    key := cacheKey{name: strings.ToLower(question.Name), qtype: question.Qtype, qclass: question.Qclass}
+    now := time.Now()
+
+    entry := p.cache.get(key)
+    if entry != nil && entry.fresh(now) {
+        if m := entry.reply(r, now); m != nil {
+            p.recordCache(key.qtype, true)
+            p.logDebug("Cache hit for %s (type: %s)", key.name, dns.TypeToString[key.qtype])
+            if cfg.PrefetchThreshold > 0 && p.cache.startPrefetch(key, now, cfg.PrefetchThreshold) {
+                go p.refreshEntry(key)
+            }
+            return m
+        }
+    }
+
+    if entry != nil && cfg.prefersCache(client) && entry.usableIfError(now, cfg.StaleIfErrorTTL) {
+        if stale := entry.reply(r, now); stale != nil {
+            p.recordCache(key.qtype, true)
+            p.logDebug("Serving stale answer for %s to latency-sensitive client, refreshing", key.name)
+            if p.cache.startRefresh(key) {
+                go p.refreshEntry(key)
+            }
+            return stale
+        }
+    }
+
+    p.recordCache(key.qtype, false)
+    m, failed := p.lookup(ctx, cfg, r)
+    if failed && entry != nil && entry.usableIfError(now, cfg.StaleIfErrorTTL) {
+        if stale := entry.reply(r, now); stale != nil {
+            p.logInfo("Serving stale answer for %s after lookup failure", key.name)
+            return stale
+        }
+    }
+    if failed {
+        if fallback := p.answerFallback(cfg, r); fallback != nil {
+            return fallback
+        }
+    }
+    if m.Rcode == dns.RcodeSuccess && len(m.Answer) > 0 && !m.Truncated {
+        p.cache.set(key, m, now)
+    } else if m.Rcode == dns.RcodeNameError && !failed && cfg.NegativeCacheTTL > 0 {
+        p.cache.setNegative(key, m, now, cfg.NegativeCacheTTL)
     }
+    return m
 }
 
-func getEnv(key, defaultValue string) string {
-    if value := os.Getenv(key); value != "" {
-        return value
+// lookup resolves the request against Docker DNS or upstream. The second
+// return value reports whether the resolver itself failed, as opposed to
+// answering that the name does not exist.
+func (p *DNSProxy) lookup(ctx context.Context, cfg *Config, r *dns.Msg) (*dns.Msg, bool) {
+    question := r.Question[0]
+    domain := strings.ToLower(question.Name)
+
+    m := new(dns.Msg)
+    m.SetReply(r)
+    m.Authoritative = false
+    m.RecursionAvailable = true
+
+    if p.answerFeatures(cfg, m, domain, question.Qtype) {
+        return m, false
     }
-    return defaultValue
-}
 
-func getBoolEnv(key string, defaultValue bool) bool {
-    if value := os.Getenv(key); value != "" {
-        if parsed, err := strconv.ParseBool(value); err == nil {
-            return parsed
+    if handled, failed := p.answerInternalName(ctx, cfg, m, domain, question.Qtype, r.IsEdns0()); handled {
+        return m, failed
+    }
+
+    if p.answerHosts(cfg, m, domain, question.Qtype) {
+        p.traceSources(ctx, cfg, m, r, domain)
+        return m, false
+    }
+
+    if rule := cfg.matchRegexRule(domain); rule != nil {
+        m, failed := p.applyRegexRule(ctx, cfg, rule, m, r, domain)
+        p.traceRoute(m, "regex "+rule.pattern.String(), cfg.resolvers(rule.action, domain, question.Qtype))
+        return m, failed
+    }
+
+    if cfg.K8sResolver != "" && strings.HasSuffix(domain, cfg.k8sServiceSuffix()) {
+        p.logDebug("Kubernetes service name %s, forwarding to %s", domain, cfg.K8sResolver)
+        failed := p.forwardToResolver(ctx, cfg, m, r, cfg.K8sResolver) != nil
+        p.traceRoute(m, "k8s "+cfg.k8sServiceSuffix(), []string{cfg.K8sResolver})
+        return m, failed
+    }
+
+    if suffix := cfg.passthroughSuffix(domain); suffix != "" {
+        p.logDebug("Name %s matches passthrough suffix %s, forwarding to upstream DNS", domain, suffix)
+        failed := p.forwardToUpstream(ctx, cfg, m, r) != nil
+        p.traceRoute(m, "passthrough "+suffix, cfg.resolvers(ruleUpstream, domain, question.Qtype))
+        return m, failed
+    }
+
+    // Reverse names never carry a STRIP_SUFFIX, ask Docker DNS as they are
+    if question.Qtype == dns.TypePTR && isReverseName(domain) {
+        m, failed := p.resolvePTR(ctx, cfg, m, r, domain)
+        p.traceRoute(m, "reverse", cfg.resolvers(ruleDocker, domain, question.Qtype))
+        return m, failed
+    }
+
+    // Check if domain ends with one of our configured suffixes
+    if suffix := cfg.stripSuffix(domain); suffix != "" {
+        hostname := strings.TrimSuffix(domain, suffix+".")
+        if cfg.StripRepeated {
+            // Search domains can append the suffix more than once
+            for strings.HasSuffix(hostname, suffix) && len(hostname) > len(suffix) {
+                hostname = strings.TrimSuffix(hostname, suffix)
+            }
         }
-        log.Printf("Warning: Invalid boolean value for %s: %s, using default: %v", key, value, defaultValue)
+        if hostname == "" {
+            p.logError("Empty hostname after stripping suffix from: %s", domain)
+            m.SetRcode(r, dns.RcodeServerFailure)
+            return m, false
+        }
+
+        if cfg.TryFullNameFirst {
+            p.logDebug("Trying full name %s against Docker DNS before stripping", domain)
+            if found, _ := p.queryDockerDNS(ctx, cfg, m, domain, question.Qtype, r.IsEdns0()); found {
+                return m, false
+            }
+        }
+
+        p.logDebug("Stripping suffix '%s' from '%s', querying Docker DNS for: %s", 
+            suffix, domain, hostname)
+        m, failed := p.resolveDocker(ctx, cfg, m, r, domain, hostname)
+        p.traceRoute(m, "suffix "+suffix, cfg.resolvers(ruleDocker, domain, question.Qtype))
+        return m, failed
+    } else if cfg.StrictZones {
+        p.logDebug("Name %s is outside the configured zones, refusing", domain)
+        m.SetRcode(r, dns.RcodeRefused)
+        return m, false
+    } else if cfg.EnableUpstream {
+        p.logDebug("Forwarding to upstream DNS: %s", domain)
+        failed := p.forwardToUpstream(ctx, cfg, m, r) != nil
+        p.traceRoute(m, "default", cfg.resolvers(ruleUpstream, domain, question.Qtype))
+        return m, failed
     }
-    return defaultValue
+
+    p.logDebug("Upstream DNS disabled, returning NXDOMAIN for: %s", domain)
+    m.SetRcode(r, dns.RcodeNameError)
+    return m, false
 }
 
-func getDurationEnv(key string, defaultSeconds int) time.Duration {
-    if value := os.Getenv(key); value != "" {
-        if parsed, err := strconv.Atoi(value); err == nil {
-            return time.Duration(parsed)
+// stripSuffix returns the first STRIP_SUFFIX entry the fully qualified,
+// lower-cased domain ends with, or "" if there is none.
+func (c *Config) stripSuffix(domain string) string {
+    for _, suffix := range c.StripSuffixes {
+        if strings.HasSuffix(domain, suffix+".") {
+            return suffix
         }
-        log.Printf("Warning: Invalid duration value for %s: %s, using default: %d", key, value, defaultSeconds)
     }
-    return time.Duration(defaultSeconds)
+    return ""
 }
 
-type DNSProxy struct {
-    config         *Config
-    dockerClient   *dns.Client
-    upstreamClient *dns.Client
-    queryCount     int64
-    errorCount     int64
+// primarySuffix is the first STRIP_SUFFIX entry, used to build names such as
+// the maintenance name.
+func (c *Config) primarySuffix() string {
+    if len(c.StripSuffixes) == 0 {
+        return ""
+    }
+    return c.StripSuffixes[0]
 }
 
-func NewDNSProxy(config *Config) *DNSProxy {
-    return &DNSProxy{
-        config: config,
-        dockerClient: &dns.Client{
-            Net:     "udp",
-            Timeout: config.Timeout,
-        },
-        upstreamClient: &dns.Client{
-            Net:     "udp",
-            Timeout: config.Timeout,
-        },
+// passthroughSuffix returns the PASSTHROUGH_SUFFIXES entry matching domain,
+// or "" if there is none.
+func (c *Config) passthroughSuffix(domain string) string {
+    for _, suffix := range c.PassthroughSuffixes {
+        if strings.HasSuffix(domain, suffix) || domain == suffix[1:] {
+            return suffix
+        }
     }
+    return ""
 }
 
-func (p *DNSProxy) logDebug(format string, v ...interface{}) {
-    if p.config.LogLevel == "DEBUG" {
-        log.Printf("[DEBUG] "+format, v...)
+// resolveDocker answers domain by querying Docker DNS for hostname, renaming
+// the answers back to the name the client asked for.
+func (p *DNSProxy) resolveDocker(ctx context.Context, cfg *Config, m *dns.Msg, r *dns.Msg, domain, hostname string) (*dns.Msg, bool) {
+    if cfg.ParallelResolve && cfg.FallbackToUpstream && cfg.EnableUpstream {
+        return p.resolveParallel(ctx, cfg, m, r, domain, hostname)
     }
-}
 
-func (p *DNSProxy) logInfo(format string, v ...interface{}) {
-    if p.config.LogLevel == "DEBUG" || p.config.LogLevel == "INFO" {
-        log.Printf("[INFO] "+format, v...)
+    found, err := p.queryDockerDNS(ctx, cfg, m, hostname, r.Question[0].Qtype, r.IsEdns0())
+    if found {
+        renameAnswers(m, domain)
+        p.logDebug("Successfully resolved %s via Docker DNS", domain)
+    } else if err == nil && cfg.FallbackToUpstream && cfg.EnableUpstream {
+        // Forward the name as the client asked for it, suffix included
+        p.logInfo("No answer from Docker DNS for %s, falling back to upstream DNS for %s", hostname, domain)
+        return m, p.forwardToUpstream(ctx, cfg, m, r) != nil
+    } else {
+        p.logDebug("No answer from Docker DNS for: %s", hostname)
+        m.SetRcode(r, dns.RcodeNameError)
     }
+    return m, err != nil
 }
 
-func (p *DNSProxy) logError(format string, v ...interface{}) {
-    log.Printf("[ERROR] "+format, v...)
-    p.errorCount++
+// renameAnswers gives the answer records the name the client asked for,
+// leaving records Docker already returned under that name untouched.
+func renameAnswers(m *dns.Msg, domain string) {
+    for i := range m.Answer {
+        if hdr := m.Answer[i].Header(); !strings.EqualFold(hdr.Name, domain) {
+            hdr.Name = domain
+        }
+    }
 }
 
-func (p *DNSProxy) handleRequest(w dns.ResponseWriter, r *dns.Msg) {
-    p.queryCount++
-    
-    if len(r.Question) == 0 {
-        p.logError("Received query with no questions")
-        dns.HandleFailed(w, r)
-        return
+// dockerDNSFor returns the Docker DNS servers for qtype: DOCKER_DNS_V4 for
+// A and DOCKER_DNS_V6 for AAAA queries when set, DOCKER_DNS otherwise.
+func (c *Config) dockerDNSFor(qtype uint16) []string {
+    if qtype == dns.TypeA && c.DockerDNSV4 != "" {
+        return []string{c.DockerDNSV4}
     }
+    if qtype == dns.TypeAAAA && c.DockerDNSV6 != "" {
+        return []string{c.DockerDNSV6}
+    }
+    return c.DockerDNS
+}
 
-    question := r.Question[0]
-    domain := strings.ToLower(question.Name)
-    
-    p.logInfo("Query #%d for: %s (type: %s) from %s", 
-        p.queryCount, domain, dns.TypeToString[question.Qtype], w.RemoteAddr())
+// Returned when DOCKER_DNS lists no server
+var errNoDockerDNS = errors.New("no Docker DNS server configured")
 
-    m := new(dns.Msg)
-    m.SetReply(r)
-    m.Authoritative = false
-    m.RecursionAvailable = true
+// Pause before the first retry of a Docker DNS query, growing by as much for
+// each further retry
+const dockerRetryBackoff = 50 * time.Millisecond
 
-    // Check if domain ends with our configured suffix
-    suffix := p.config.StripSuffix + "."
-    if strings.HasSuffix(domain, suffix) {
-        hostname := strings.TrimSuffix(domain, suffix)
-        if hostname == "" {
-            p.logError("Empty hostname after stripping suffix from: %s", domain)
-            dns.HandleFailed(w, r)
-            return
+// Timeouts a Docker DNS server gets for a query, retries included
+const dockerRetryBudget = 2
+
+// exchangeDocker sends query to a Docker DNS server, retrying up to
+// DOCKER_DNS_RETRIES times after a timeout or network error, since a single
+// lost UDP packet would otherwise fail the lookup. A reply, NXDOMAIN
+// included, is never retried.
+func (p *DNSProxy) exchangeDocker(ctx context.Context, cfg *Config, query *dns.Msg, server string) (*dns.Msg, error) {
+    if cfg.DockerDNSRetries > 0 {
+        var cancel context.CancelFunc
+        ctx, cancel = context.WithTimeout(ctx, dockerRetryBudget*cfg.timeoutFor(query.Question[0].Qtype))
+        defer cancel()
+    }
+
+    for attempt := 1; ; attempt++ {
+        reply, err := p.exchange(ctx, cfg, query, server)
+        var netErr net.Error
+        if err == nil || attempt > cfg.DockerDNSRetries || !errors.As(err, &netErr) || ctx.Err() != nil {
+            return reply, err
         }
 
-        p.logDebug("Stripping suffix '%s' from '%s', querying Docker DNS for: %s", 
-            p.config.StripSuffix, domain, hostname)
-        
-        if p.queryDockerDNS(m, hostname, question.Qtype) {
-            // Update the answer records to have original domain name
-            for i := range m.Answer {
-                m.Answer[i].Header().Name = domain
-            }
-            p.logDebug("Successfully resolved %s via Docker DNS", domain)
-        } else {
-            p.logDebug("No answer from Docker DNS for: %s", hostname)
-            m.SetRcode(r, dns.RcodeNameError)
+        backoff := time.Duration(attempt) * dockerRetryBackoff
+        p.logDebug("Docker DNS %s query failed for %s, retry %d in %v: %v", server, query.Question[0].Name, attempt, backoff, err)
+        select {
+        case <-time.After(backoff):
+        case <-ctx.Done():
+            return nil, err
         }
-    } else if p.config.EnableUpstream {
-        p.logDebug("Forwarding to upstream DNS: %s", domain)
-        p.forwardToUpstream(m, r)
-    } else {
-        p.logDebug("Upstream DNS disabled, returning NXDOMAIN for: %s", domain)
-        m.SetRcode(r, dns.RcodeNameError)
     }
+}
 
-    err := w.WriteMsg(m)
+// queryDockerDNS asks each Docker DNS server in turn until one has an answer.
+// It fails only when no server could be reached; a query that fails on every
+// server is logged, and counted as an error, once. opt is the client's OPT
+// record, if any, sent along so Docker DNS sees its buffer size and DO bit.
+func (p *DNSProxy) queryDockerDNS(ctx context.Context, cfg *Config, response *dns.Msg, hostname string, qtype uint16, opt *dns.OPT) (bool, error) {
+    found, err := p.lookupDockerDNS(ctx, cfg, response, hostname, qtype, opt)
     if err != nil {
-        p.logError("Error writing response: %v", err)
+        p.logError("Docker DNS query failed for %s on %d servers: %v", hostname, len(cfg.dockerDNSFor(qtype)), err)
     }
+    return found, err
 }
 
-func (p *DNSProxy) queryDockerDNS(response *dns.Msg, hostname string, qtype uint16) bool {
+// lookupDockerDNS is queryDockerDNS without logging or counting a failure.
+func (p *DNSProxy) lookupDockerDNS(ctx context.Context, cfg *Config, response *dns.Msg, hostname string, qtype uint16, opt *dns.OPT) (bool, error) {
     query := new(dns.Msg)
     query.SetQuestion(dns.Fqdn(hostname), qtype)
     query.RecursionDesired = true
+    if opt != nil {
+        query.Extra = append(query.Extra, dns.Copy(opt))
+    }
 
-    p.logDebug("Querying Docker DNS %s for: %s", p.config.DockerDNS, hostname)
-    reply, _, err := p.dockerClient.Exchange(query, p.config.DockerDNS)
-    if err != nil {
-        p.logError("Docker DNS query failed for %s: %v", hostname, err)
-        return false
+    servers := cfg.dockerDNSFor(qtype)
+    err := errNoDockerDNS
+    answered := false
+    for _, server := range servers {
+        p.logDebug("Querying Docker DNS %s for: %s", server, hostname)
+        start := time.Now()
+        reply, exchangeErr := p.exchangeDocker(ctx, cfg, query, server)
+        p.metrics.observeLookup("docker", start)
+        if exchangeErr != nil {
+            p.logDebug("Docker DNS %s query failed for %s: %v", server, hostname, exchangeErr)
+            err = exchangeErr
+            continue
+        }
+
+        answered = true
+        if p.acceptDockerReply(cfg, response, reply, server, hostname) {
+            return true, nil
+        }
     }
 
-    if reply.Rcode != dns.RcodeSuccess {
-        p.logDebug("Docker DNS returned error for %s: %s", hostname, dns.RcodeToString[reply.Rcode])
+    if answered {
+        return false, nil
+    }
+    return false, err
+}
+
+// acceptDockerReply copies a usable reply from server into response and
+// reports whether it had answers.
+func (p *DNSProxy) acceptDockerReply(cfg *Config, response *dns.Msg, reply *dns.Msg, server, hostname string) bool {
+    if reply.Rcode == dns.RcodeServerFailure && cfg.UsePartialAnswers && len(reply.Answer) > 0 {
+        p.logDebug("Docker DNS %s returned SERVFAIL with %d answers for %s, using partial answers",
+            server, len(reply.Answer), hostname)
+    } else if reply.Rcode != dns.RcodeSuccess {
+        p.logDebug("Docker DNS %s returned error for %s: %s", server, hostname, dns.RcodeToString[reply.Rcode])
         return false
     }
 
     if len(reply.Answer) == 0 {
-        p.logDebug("No answer from Docker DNS for: %s", hostname)
+        p.logDebug("No answer from Docker DNS %s for: %s", server, hostname)
         return false
     }
 
+    if cfg.DockerMaxTTL > 0 {
+        for _, rr := range reply.Answer {
+            if rr.Header().Ttl > cfg.DockerMaxTTL {
+                rr.Header().Ttl = cfg.DockerMaxTTL
+            }
+        }
+    }
+
     response.Answer = make([]dns.RR, len(reply.Answer))
     copy(response.Answer, reply.Answer)
-    
-    p.logDebug("Got %d answers from Docker DNS for %s", len(reply.Answer), hostname)
+    // Still truncated when TCP is disabled, let the client know
+    response.Truncated = reply.Truncated
+
+    p.logDebug("Got %d answers from Docker DNS %s for %s", len(reply.Answer), server, hostname)
     return true
 }
 
-func (p *DNSProxy) forwardToUpstream(response *dns.Msg, request *dns.Msg) {
+// Returned when every upstream is skipped because its circuit breaker is open
+var errAllUpstreamsOpen = errors.New("all upstream circuit breakers are open")
+
+var errUpstreamsBusy = errors.New("all upstreams are at their in-flight query limit or open")
+
+var errUpstreamsUnhealthy = errors.New("all upstreams failed their health check or are open")
+
+// Values of UPSTREAM_SELECTION
+const (
+    selectionOrdered        = "ordered"
+    selectionConsistentHash = "consistent-hash"
+)
+
+// upstreamsFor returns the upstreams in the order they are tried for domain.
+// With consistent-hash selection each name is ranked by rendezvous hashing,
+// so a name keeps going to the same upstream (and its cache) and only moves
+// when that upstream is removed or fails.
+func (c *Config) upstreamsFor(domain string) []string {
+    servers := c.scheduledUpstreams(time.Now())
+    if c.UpstreamSelection != selectionConsistentHash || len(servers) < 2 {
+        return servers
+    }
+
+    name := strings.ToLower(domain)
+    weights := make(map[string]uint64, len(servers))
+    for _, upstream := range servers {
+        h := fnv.New64a()
+        h.Write([]byte(name))
+        h.Write([]byte{0})
+        h.Write([]byte(upstream))
+        weights[upstream] = h.Sum64()
+    }
+
+    upstreams := append([]string(nil), servers...)
+    sort.SliceStable(upstreams, func(i, j int) bool {
+        return weights[upstreams[i]] > weights[upstreams[j]]
+    })
+    return upstreams
+}
+
+func (p *DNSProxy) forwardToUpstream(ctx context.Context, cfg *Config, response *dns.Msg, request *dns.Msg) error {
+    if cfg.wantsValidation(request) {
+        return p.forwardToValidating(ctx, cfg, response, request)
+    }
+
     domain := request.Question[0].Name
-    p.logDebug("Querying upstream DNS %s for: %s", p.config.UpstreamDNS, domain)
-    
-    reply, _, err := p.upstreamClient.Exchange(request, p.config.UpstreamDNS)
+    upstreams := cfg.upstreamsFor(domain)
+
+    var reply *dns.Msg
+    var err error
+    busy, unhealthy := false, false
+    for i, upstream := range upstreams {
+        if ctx.Err() != nil {
+            p.logDebug("Request deadline reached before trying upstream DNS %s for %s", upstream, domain)
+            if err == nil {
+                err = ctx.Err()
+            }
+            break
+        }
+
+        if cfg.UpstreamHealthInterval > 0 && !p.upstreamHealthy(upstream) {
+            p.logDebug("Skipping upstream DNS %s for %s, failed its last health check", upstream, domain)
+            unhealthy = true
+            continue
+        }
+
+        breaker := p.breaker(upstream)
+        if cfg.BreakerThreshold > 0 && !breaker.allow(time.Now(), cfg.BreakerOpenDuration) {
+            p.logDebug("Skipping upstream DNS %s for %s, circuit breaker is %s", upstream, domain, breaker.current())
+            continue
+        }
+
+        if !p.inflight.acquire(upstream, cfg.UpstreamMaxInflight) {
+            p.logDebug("Skipping upstream DNS %s for %s, %d queries in flight", upstream, domain, cfg.UpstreamMaxInflight)
+            breaker.release()
+            busy = true
+            continue
+        }
+
+        p.logDebug("Querying upstream DNS %s for: %s", upstream, domain)
+
+        var r *dns.Msg
+        start := time.Now()
+        r, err = p.exchange(ctx, cfg, request, upstream)
+        p.metrics.observeLookup("upstream", start)
+        p.inflight.release(upstream)
+        if err != nil && ctx.Err() == context.Canceled {
+            // The caller no longer wants the answer, e.g. PARALLEL_RESOLVE
+            // got one from Docker DNS first; not the upstream's fault, and
+            // if this was the half-open probe the next query probes instead
+            p.logDebug("Upstream DNS %s query for %s cancelled", upstream, domain)
+            breaker.release()
+            break
+        }
+        if err != nil {
+            p.logError("Upstream DNS %s query failed for %s: %v", upstream, domain, err)
+            if cfg.BreakerThreshold > 0 {
+                breaker.failure(time.Now(), cfg.BreakerThreshold)
+            }
+            continue
+        }
+        breaker.success()
+
+        reply = r
+        if cfg.EmptyUpstreamRetry && r.Rcode == dns.RcodeSuccess && len(r.Answer) == 0 && i < len(upstreams)-1 {
+            p.logDebug("Upstream DNS %s returned no records for %s, trying next upstream", upstream, domain)
+            continue
+        }
+        break
+    }
+
+    if reply == nil {
+        if err == nil && busy {
+            // Nothing was sent, every upstream is open or at its in-flight cap
+            err = errUpstreamsBusy
+            p.logInfo("All upstreams are busy or unavailable, failing fast for %s", domain)
+        } else if err == nil && unhealthy {
+            // Nothing was sent, every upstream failed its health check or is open
+            err = errUpstreamsUnhealthy
+            p.logInfo("All upstreams are unhealthy or unavailable, failing fast for %s", domain)
+        } else if err == nil {
+            // Nothing was sent, every upstream is skipped by its breaker
+            err = errAllUpstreamsOpen
+            p.logInfo("All upstream circuit breakers are open, failing fast for %s", domain)
+        }
+        response.SetRcode(request, dns.RcodeServerFailure)
+        return err
+    }
+
+    p.copyReply(cfg, response, request, reply)
+    if cfg.ShadowUpstream != "" {
+        go p.queryShadow(cfg, request.Copy(), answerSummary(reply))
+    }
+
+    p.logDebug("Upstream DNS returned %d answers for %s", len(reply.Answer), domain)
+    return nil
+}
+
+// forwardToResolver sends the request to a single resolver, such as the one
+// configured for a zone, and copies its reply into response.
+func (p *DNSProxy) forwardToResolver(ctx context.Context, cfg *Config, response *dns.Msg, request *dns.Msg, server string) error {
+    domain := request.Question[0].Name
+    p.logDebug("Querying resolver %s for: %s", server, domain)
+
+    start := time.Now()
+    reply, err := p.exchange(ctx, cfg, request, server)
+    p.metrics.observeLookup("resolver", start)
     if err != nil {
-        p.logError("Upstream DNS query failed for %s: %v", domain, err)
+        p.logError("Resolver %s query failed for %s: %v", server, domain, err)
         response.SetRcode(request, dns.RcodeServerFailure)
-        return
+        return err
     }
 
-    response.Answer = reply.Answer
-    response.Ns = reply.Ns
-    response.Extra = reply.Extra
+    p.copyReply(cfg, response, request, reply)
+    return nil
+}
+
+// copyReply copies the sections and rcode of a forwarded reply into response.
+func (p *DNSProxy) copyReply(cfg *Config, response *dns.Msg, request *dns.Msg, reply *dns.Msg) {
+    domain := request.Question[0].Name
+    response.Answer = p.capRecords(reply.Answer, cfg.UpstreamMaxAnswers, "answer", domain)
+    response.Ns = p.capRecords(reply.Ns, cfg.UpstreamMaxAuthority, "authority", domain)
+    response.Extra = p.capRecords(reply.Extra, cfg.UpstreamMaxAdditional, "additional", domain)
     response.SetRcode(request, reply.Rcode)
-    
-    p.logDebug("Upstream DNS returned %d answers for %s", len(reply.Answer), domain)
+    response.Truncated = reply.Truncated
+}
+
+// capRecords limits a section of an upstream reply to max records, guarding
+// clients against a misbehaving upstream. The OPT pseudo-record is always
+// kept. A max of 0 disables the limit.
+func (p *DNSProxy) capRecords(section []dns.RR, max int, name, domain string) []dns.RR {
+    if max <= 0 || len(section) <= max {
+        return section
+    }
+
+    capped := make([]dns.RR, 0, max+1)
+    count := 0
+    for _, rr := range section {
+        if rr.Header().Rrtype == dns.TypeOPT {
+            capped = append(capped, rr)
+        } else if count < max {
+            capped = append(capped, rr)
+            count++
+        }
+    }
+    if dropped := len(section) - len(capped); dropped > 0 {
+        p.logInfo("Upstream %s section for %s had %d records, dropped %d over the limit of %d",
+            name, domain, len(section), dropped, max)
+    }
+    return capped
 }
 
 func (p *DNSProxy) printStats() {
-    if p.config.EnableMetrics {
-        log.Printf("[METRICS] Total queries: %d, Errors: %d", p.queryCount, p.errorCount)
+    cfg := p.config()
+    if cfg.EnableMetrics {
+        log.Printf("[METRICS] Total queries: %d, Errors: %d",
+            atomic.LoadInt64(&p.queryCount), atomic.LoadInt64(&p.errorCount))
+        log.Printf("[METRICS] Truncated replies retried over TCP: %d", atomic.LoadInt64(&p.tcpRetries))
+        if first := atomic.LoadInt64(&p.firstQueryNanos); first > 0 {
+            log.Printf("[METRICS] First query latency: %v", time.Duration(first))
+        }
+        if p.pool != nil {
+            log.Printf("[METRICS] Worker pool: %d queued, %d dropped", len(p.pool.jobs), atomic.LoadInt64(&p.pool.dropped))
+        }
+        if cfg.RRLResponsesPerSec > 0 {
+            log.Printf("[METRICS] Rate limited responses: %d dropped, %d truncated",
+                atomic.LoadInt64(&p.rrlDropped), atomic.LoadInt64(&p.rrlSlipped))
+        }
+        if cfg.RateLimitQPS > 0 {
+            log.Printf("[METRICS] Rate limited queries: %d refused", atomic.LoadInt64(&p.rateLimitedCount))
+        }
+        if cfg.ShadowUpstream != "" {
+            log.Printf("[METRICS] Shadow upstream %s: %d queries, %d mismatches", cfg.ShadowUpstream,
+                atomic.LoadInt64(&p.shadowQueries), atomic.LoadInt64(&p.shadowMismatches))
+        }
+        if cfg.CacheEnabled {
+            log.Printf("[METRICS] Cache entries: %d of %d", p.cache.len(), cfg.CacheMaxEntries)
+            if cfg.CacheMaxBytes > 0 {
+                log.Printf("[METRICS] Cache size: %d of %d bytes", p.cache.usage(), cfg.CacheMaxBytes)
+            }
+            stats := p.cache.statsByType()
+            qtypes := make([]string, 0, len(stats))
+            for qtype := range stats {
+                qtypes = append(qtypes, qtype)
+            }
+            sort.Strings(qtypes)
+            for _, qtype := range qtypes {
+                log.Printf("[METRICS] Cache %s: %d hits, %d misses", qtype, stats[qtype].Hits, stats[qtype].Misses)
+            }
+        }
+        if cfg.EnableUpstream {
+            for _, upstream := range cfg.allUpstreams() {
+                if cfg.BreakerThreshold > 0 {
+                    log.Printf("[METRICS] Upstream %s circuit breaker: %s", upstream, p.breaker(upstream).current())
+                }
+                log.Printf("[METRICS] Upstream %s queries in flight: %d", upstream, p.inflight.current(upstream))
+                if cfg.UpstreamHealthInterval > 0 {
+                    log.Printf("[METRICS] Upstream %s health: %s", upstream, healthString(p.upstreamHealthy(upstream)))
+                }
+            }
+        }
     }
 }
 
 func printConfig(config *Config) {
     log.Printf("=== DNS Proxy Configuration ===")
-    log.Printf("Listen Address:    %s:%s", config.ListenAddr, config.ListenPort)
-    log.Printf("Docker DNS:        %s", config.DockerDNS)
+    log.Printf("Version:           %s", version)
+    if config.ListenAddr == "" {
+        log.Printf("Listen Address:    *:%s (all interfaces, IPv4 and IPv6)", config.ListenPort)
+    } else {
+        log.Printf("Listen Address:    %s", net.JoinHostPort(config.ListenAddr, config.ListenPort))
+    }
+    log.Printf("TCP:               %v", config.TCPEnabled)
+    if config.TCPEnabled && config.MaxQueriesPerConn > 0 {
+        log.Printf("Queries per Conn:  %d", config.MaxQueriesPerConn)
+    }
+    log.Printf("Listener Restarts: %d", config.ListenerRestart)
+    if config.PoolSize > 0 {
+        log.Printf("Worker Pool:       %d workers, queue %d", config.PoolSize, config.PoolQueue)
+    }
+    log.Printf("Docker DNS:        %s", strings.Join(config.DockerDNS, ", "))
+    log.Printf("Docker Retries:    %d", config.DockerDNSRetries)
+    if config.DockerDNSV4 != "" || config.DockerDNSV6 != "" {
+        log.Printf("Docker DNS A/AAAA: %s / %s", strings.Join(config.dockerDNSFor(dns.TypeA), ", "),
+            strings.Join(config.dockerDNSFor(dns.TypeAAAA), ", "))
+    }
     if config.EnableUpstream {
-        log.Printf("Upstream DNS:      %s", config.UpstreamDNS)
+        log.Printf("Upstream DNS:      %s", strings.Join(config.UpstreamDNS, ", "))
+        if config.UpstreamProtocol == protocolDoT {
+            serverName := config.UpstreamTLSServerName
+            if serverName == "" {
+                serverName = "host of each server"
+            }
+            log.Printf("Upstream TLS:      DNS over TLS, verifying %s", serverName)
+        }
+        log.Printf("Empty Retry:       %v", config.EmptyUpstreamRetry)
+        log.Printf("Docker Fallback:   %v", config.FallbackToUpstream)
+        if config.FallbackToUpstream {
+            log.Printf("Parallel Resolve:  %v", config.ParallelResolve)
+        }
+        log.Printf("Selection:         %s", config.UpstreamSelection)
+        for _, rule := range config.ScheduleRules {
+            log.Printf("Schedule Rule:     %s -> %s", rule.window, strings.Join(rule.upstreams, ", "))
+        }
+        if config.UpstreamMaxInflight > 0 {
+            log.Printf("Max In Flight:     %d per upstream", config.UpstreamMaxInflight)
+        }
+        if config.ShadowUpstream != "" {
+            log.Printf("Shadow Upstream:   %s", config.ShadowUpstream)
+        }
+        if config.ValidatingUpstream != "" {
+            log.Printf("Validating DNS:    %s", config.ValidatingUpstream)
+        }
+        if config.BreakerThreshold > 0 {
+            log.Printf("Circuit Breaker:   %d failures, open for %v", config.BreakerThreshold, config.BreakerOpenDuration)
+        }
+        if config.UpstreamHealthInterval > 0 {
+            log.Printf("Health Checks:     every %v", config.UpstreamHealthInterval)
+        }
     } else {
         log.Printf("Upstream DNS:      DISABLED")
     }
-    log.Printf("Timeout:           %v", config.Timeout)
+    log.Printf("Timeout:           %v (per request %v)", config.Timeout, config.RequestTimeout)
+    if len(config.QtypeTimeouts) > 0 {
+        log.Printf("Type Timeouts:     %s", config.qtypeTimeoutsString())
+    }
     log.Printf("Log Level:         %s", config.LogLevel)
-    log.Printf("Strip Suffix:      %s", config.StripSuffix)
+    log.Printf("Log Format:        %s", config.LogFormat)
+    if config.QueryLogFile != "" {
+        log.Printf("Query Log:         %s", config.QueryLogFile)
+    }
+    log.Printf("Strip Suffixes:    %s (repeated: %v)", strings.Join(config.StripSuffixes, ", "), config.StripRepeated)
+    if config.SortAnswers {
+        log.Printf("Sort Answers:      %v", config.SortAnswers)
+    }
+    if !config.SanityCheck {
+        log.Printf("Sanity Check:      DISABLED")
+    }
+    if config.StrictZones {
+        log.Printf("Strict Zones:      names outside the suffix and zone resolvers get REFUSED")
+    }
     log.Printf("Enable Metrics:    %v", config.EnableMetrics)
+    if config.EnableMetrics && config.MetricsAddr != "" {
+        log.Printf("Metrics Address:   %s", config.MetricsAddr)
+    }
+    if config.EnableMetrics {
+        if config.MetricsInterval > 0 {
+            log.Printf("Stats Interval:    %v", config.MetricsInterval)
+        } else {
+            log.Printf("Stats Interval:    DISABLED, stats are logged on shutdown")
+        }
+    }
+    if config.HostInternalIP != "" {
+        log.Printf("Host Internal IP:  %s", config.HostInternalIP)
+    }
+    if config.GatewayInternalIP != "" {
+        log.Printf("Gateway IP:        %s", config.GatewayInternalIP)
+    }
+    if config.HostsFile != "" {
+        log.Printf("Hosts File:        %s (%d names with STATIC_HOSTS)", config.HostsFile, len(config.Hosts))
+    } else if len(config.Hosts) > 0 {
+        log.Printf("Static Hosts:      %d names", len(config.Hosts))
+    }
+    if len(config.FallbackIPs) > 0 {
+        log.Printf("Fallback IPs:      %d names", len(config.FallbackIPs))
+    }
+    if config.CacheEnabled {
+        log.Printf("Cache:             %d entries, stale-if-error %v, refresh ahead %v, prefetch threshold %v",
+            config.CacheMaxEntries, config.StaleIfErrorTTL, config.CacheRefreshAhead, config.PrefetchThreshold)
+        if config.CacheMaxBytes > 0 {
+            log.Printf("Cache Budget:      %d bytes", config.CacheMaxBytes)
+        }
+        log.Printf("Cache Preference:  %s", config.CachePreference)
+        if config.NegativeCacheTTL > 0 {
+            log.Printf("Negative Cache:    %v without SOA", config.NegativeCacheTTL)
+        }
+    } else {
+        log.Printf("Cache:             DISABLED")
+    }
+    if config.RRLResponsesPerSec > 0 {
+        log.Printf("Response Limit:    %v/s per client subnet, slip %d", config.RRLResponsesPerSec, config.RRLSlip)
+    }
+    if config.RateLimitQPS > 0 {
+        log.Printf("Client Rate Limit: %v/s per client IP, burst %v", config.RateLimitQPS, config.rateLimitBurst())
+    }
+    if config.TopClients > 0 {
+        log.Printf("Top Clients:       %d busiest clients tracked", config.TopClients)
+    }
+    if len(config.AllowedClients) > 0 {
+        allowed := make([]string, len(config.AllowedClients))
+        for i, n := range config.AllowedClients {
+            allowed[i] = n.String()
+        }
+        log.Printf("Allowed Clients:   %s", strings.Join(allowed, ", "))
+    }
+    if config.K8sResolver != "" {
+        log.Printf("Kubernetes DNS:    %s for *%s", config.K8sResolver, config.k8sServiceSuffix())
+    }
+    for from, to := range config.NameRewrites {
+        log.Printf("Name Rewrite:      %s -> %s", from, to)
+    }
+    if len(config.EDNSPolicy) > 0 {
+        log.Printf("EDNS Policy:       %s", config.ednsPolicyString())
+    }
+    for _, rule := range config.RegexRules {
+        log.Printf("Regex Rule:        %s -> %s", rule.pattern, rule.action)
+    }
+    if config.MaintenanceMode {
+        log.Printf("Maintenance Mode:  ENABLED (%s)", config.maintenanceName())
+    }
+    if config.FaultInjectionRate > 0 {
+        log.Printf("Fault Injection:   ENABLED, %.1f%% of queries get SERVFAIL", config.FaultInjectionRate*100)
+    }
+    if config.AdminAddr != "" {
+        log.Printf("Admin API:         %s", config.AdminAddr)
+    }
+    if config.HealthAddr != "" {
+        log.Printf("Health Check:      %s", config.HealthAddr)
+    }
+    if config.ChaosHostname != "" {
+        log.Printf("CHAOS Hostname:    %s", config.ChaosHostname)
+    }
     log.Printf("==============================")
+    if config.PrintConfigJSON {
+        printConfigJSON(config)
+    }
+}
+
+// newTCPServer returns a TCP server for addr that closes a connection after
+// maxQueries queries, MAX_QUERIES_PER_CONN, or never when it is 0.
+func newTCPServer(addr string, handler dns.Handler, maxQueries int) *dns.Server {
+    // miekg/dns treats 0 as its own default and -1 as unlimited
+    if maxQueries == 0 {
+        maxQueries = -1
+    }
+    return &dns.Server{Addr: addr, Net: "tcp", Handler: handler, MaxTCPQueries: maxQueries,
+        MsgAcceptFunc: acceptQuery}
 }
 
 func main() {
     log.SetFlags(log.LstdFlags | log.Lshortfile)
+    parseFlags(os.Args[1:])
     
     config := loadConfig()
+    if err := config.validate(); err != nil {
+        log.Fatalf("Invalid configuration: %v", err)
+    }
     printConfig(config)
 
     proxy := NewDNSProxy(config)
-    dns.HandleFunc(".", proxy.handleRequest)
+    var handler dns.Handler = dns.HandlerFunc(proxy.handleRequest)
+    if config.PoolSize > 0 {
+        proxy.pool = newWorkerPool(config.PoolSize, config.PoolQueue, handler)
+        handler = proxy.pool
+    }
 
-    server := &dns.Server{
-        Addr: net.JoinHostPort(config.ListenAddr, config.ListenPort),
-        Net:  "udp",
+    addr := net.JoinHostPort(config.ListenAddr, config.ListenPort)
+    servers := []*listener{newListener(func() *dns.Server {
+        return &dns.Server{Addr: addr, Net: "udp", Handler: handler, MsgAcceptFunc: acceptQuery}
+    })}
+    if config.TCPEnabled {
+        servers = append(servers, newListener(func() *dns.Server {
+            return newTCPServer(addr, handler, config.MaxQueriesPerConn)
+        }))
     }
 
     // Graceful shutdown
     c := make(chan os.Signal, 1)
     signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 
+    // Background tasks stop when this context is cancelled on shutdown
+    background, stopBackground := context.WithCancel(context.Background())
+    go proxy.refreshCache(background)
+    go proxy.checkUpstreams(background)
+
     // Optional metrics ticker
-    if config.EnableMetrics {
-        ticker := time.NewTicker(30 * time.Second)
+    if config.EnableMetrics && config.MetricsInterval > 0 {
+        go func() {
+            ticker := time.NewTicker(config.MetricsInterval)
+            defer ticker.Stop()
+            for {
+                select {
+                case <-ticker.C:
+                    proxy.printStats()
+                case <-background.Done():
+                    return
+                }
+            }
+        }()
+    }
+
+    // Optional admin HTTP API
+    var adminServer *http.Server
+    if config.AdminAddr != "" {
+        if config.AdminToken == "" {
+            log.Printf("Warning: ADMIN_TOKEN is not set, admin endpoints will refuse all requests")
+        }
+        adminServer = &http.Server{Addr: config.AdminAddr, Handler: proxy.adminHandler()}
+        go func() {
+            if err := adminServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+                log.Printf("Admin API failed: %v", err)
+            }
+        }()
+    }
+
+    // Optional health check endpoint, unauthenticated for orchestrators
+    var healthServer *http.Server
+    if config.HealthAddr != "" {
+        healthServer = &http.Server{Addr: config.HealthAddr, Handler: proxy.healthHandler()}
+        go func() {
+            if err := healthServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+                log.Printf("Health check endpoint failed: %v", err)
+            }
+        }()
+    }
+
+    // Optional Prometheus metrics endpoint
+    var metricsServer *http.Server
+    if config.EnableMetrics && config.MetricsAddr != "" {
+        mux := http.NewServeMux()
+        mux.Handle("/metrics", proxy.metrics.handler())
+        metricsServer = &http.Server{Addr: config.MetricsAddr, Handler: mux}
         go func() {
-            for range ticker.C {
-                proxy.printStats()
+            if err := metricsServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+                log.Printf("Metrics endpoint failed: %v", err)
             }
         }()
     }
 
+    // Toggle maintenance mode on SIGUSR2
+    usr2 := make(chan os.Signal, 1)
+    signal.Notify(usr2, syscall.SIGUSR2)
+    go func() {
+        for range usr2 {
+            proxy.setMaintenance(!proxy.inMaintenance())
+        }
+    }()
+
+    // Reload configuration on SIGHUP
+    hup := make(chan os.Signal, 1)
+    signal.Notify(hup, syscall.SIGHUP)
+    // Toggle debug logging on SIGUSR1
+    usr1 := make(chan os.Signal, 1)
+    signal.Notify(usr1, syscall.SIGUSR1)
+    go func() {
+        for range usr1 {
+            proxy.toggleDebug()
+        }
+    }()
+
+    go func() {
+        for range hup {
+            log.Println("Received SIGHUP, reloading configuration...")
+            config := loadConfig()
+            // Reopen the query log even if the rest of the reload fails,
+            // so rotated files are released
+            if err := proxy.queryLog.reopen(config.QueryLogFile); err != nil {
+                log.Printf("Could not reopen query log %s: %v", config.QueryLogFile, err)
+            }
+            if err := config.validate(); err != nil {
+                log.Printf("Reload failed, keeping current configuration: %v", err)
+                continue
+            }
+            if err := proxy.reload(config); err != nil {
+                log.Printf("Reload failed, keeping current configuration: %v", err)
+                continue
+            }
+            printConfig(config)
+        }
+    }()
+
+    done := make(chan struct{})
     go func() {
         <-c
         log.Println("Received shutdown signal...")
-        proxy.printStats()
-        log.Println("Shutting down DNS server...")
-        server.Shutdown()
-        os.Exit(0)
+        proxy.shutdown(config.ShutdownTimeout, servers, []*http.Server{adminServer, healthServer, metricsServer}, stopBackground)
+        close(done)
     }()
 
-    log.Printf("DNS proxy server starting on %s:%s", config.ListenAddr, config.ListenPort)
-    err := server.ListenAndServe()
-    if err != nil {
-        log.Fatalf("Failed to start server: %v", err)
+    for _, server := range servers {
+        log.Printf("DNS proxy server starting on %s (%s)", addr, server.net)
+        go func(server *listener) {
+            if err := server.serve(config.ListenerRestart); err != nil {
+                log.Fatalf("Failed to start %s server: %v", server.net, err)
+            }
+        }(server)
     }
+    <-done
 }
\ No newline at end of file
@@ -0,0 +1,123 @@
+package main
+
+import (
+    "net/http"
+    "sync/atomic"
+    "time"
+
+    "github.com/miekg/dns"
+    "github.com/prometheus/client_golang/prometheus"
+    "github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metrics are the Prometheus metrics served on METRICS_ADDR.
+type metrics struct {
+    registry *prometheus.Registry
+
+    queries     prometheus.Counter
+    errors      prometheus.Counter
+    rateLimited prometheus.Counter
+    cacheHits   *prometheus.CounterVec
+    cacheMisses *prometheus.CounterVec
+    lookups     *prometheus.HistogramVec
+    answers     prometheus.Histogram
+    firstQuery  prometheus.Gauge
+
+    upstreamHealthy *prometheus.GaugeVec
+}
+
+func newMetrics() *metrics {
+    m := &metrics{
+        registry: prometheus.NewRegistry(),
+        queries: prometheus.NewCounter(prometheus.CounterOpts{
+            Name: "dns_queries_total",
+            Help: "Queries received.",
+        }),
+        errors: prometheus.NewCounter(prometheus.CounterOpts{
+            Name: "dns_errors_total",
+            Help: "Errors logged while answering queries.",
+        }),
+        rateLimited: prometheus.NewCounter(prometheus.CounterOpts{
+            Name: "dns_rate_limited_total",
+            Help: "Queries refused because the client exceeded RATE_LIMIT_QPS.",
+        }),
+        cacheHits: prometheus.NewCounterVec(prometheus.CounterOpts{
+            Name: "dns_cache_hits_total",
+            Help: "Queries answered from the cache.",
+        }, []string{"qtype"}),
+        cacheMisses: prometheus.NewCounterVec(prometheus.CounterOpts{
+            Name: "dns_cache_misses_total",
+            Help: "Queries not found in the cache.",
+        }, []string{"qtype"}),
+        lookups: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+            Name:    "dns_lookup_duration_seconds",
+            Help:    "Duration of queries to Docker DNS and upstream resolvers.",
+            Buckets: prometheus.ExponentialBuckets(0.0005, 2, 14),
+        }, []string{"target"}),
+        answers: prometheus.NewHistogram(prometheus.HistogramOpts{
+            Name:    "dns_query_duration_seconds",
+            Help:    "Time to answer a query, apart from the first one after startup.",
+            Buckets: prometheus.ExponentialBuckets(0.0005, 2, 14),
+        }),
+        firstQuery: prometheus.NewGauge(prometheus.GaugeOpts{
+            Name: "dns_first_query_duration_seconds",
+            Help: "Time to answer the first query after startup, which pays for cold connections and caches.",
+        }),
+        upstreamHealthy: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+            Name: "dns_upstream_healthy",
+            Help: "Whether the last health check of the upstream succeeded (1) or failed (0).",
+        }, []string{"upstream"}),
+    }
+    m.registry.MustRegister(m.queries, m.errors, m.rateLimited, m.cacheHits, m.cacheMisses, m.lookups,
+        m.answers, m.firstQuery, m.upstreamHealthy)
+    return m
+}
+
+func (m *metrics) handler() http.Handler {
+    return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// observeLookup records how long a query to target (docker, upstream or
+// resolver) took since start.
+func (m *metrics) observeLookup(target string, start time.Time) {
+    m.lookups.WithLabelValues(target).Observe(time.Since(start).Seconds())
+}
+
+func (m *metrics) setUpstreamHealth(upstream string, healthy bool) {
+    v := 0.0
+    if healthy {
+        v = 1
+    }
+    m.upstreamHealthy.WithLabelValues(upstream).Set(v)
+}
+
+// recordLatency records how long a query took to answer. The first query
+// after startup is kept apart, in its own gauge and log line, so its setup
+// costs don't pass for steady-state slowness.
+func (p *DNSProxy) recordLatency(took time.Duration) {
+    if took <= 0 {
+        took = 1
+    }
+    if !atomic.CompareAndSwapInt64(&p.firstQueryNanos, 0, int64(took)) {
+        p.metrics.answers.Observe(took.Seconds())
+        return
+    }
+    p.metrics.firstQuery.Set(took.Seconds())
+    p.logInfo("First query answered in %v, including cold-start costs", took)
+}
+
+// recordCache counts a cache lookup both in the per-type stats and in the
+// Prometheus metrics.
+func (p *DNSProxy) recordCache(qtype uint16, hit bool) {
+    p.cache.record(qtype, hit)
+    // Unknown types share a label to bound the number of series
+    name, ok := dns.TypeToString[qtype]
+    if !ok {
+        name = "OTHER"
+    }
+    if hit {
+        p.metrics.cacheHits.WithLabelValues(name).Inc()
+    } else {
+        p.metrics.cacheMisses.WithLabelValues(name).Inc()
+    }
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+    "bufio"
+    "net"
+    "net/http"
+    "net/http/httptest"
+    "strconv"
+    "strings"
+    "sync/atomic"
+    "testing"
+    "time"
+
+    "github.com/miekg/dns"
+)
+
+// scrape returns the samples served on /metrics by name, labels included.
+func scrape(t *testing.T, p *DNSProxy) map[string]float64 {
+    t.Helper()
+    w := httptest.NewRecorder()
+    p.metrics.handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+    samples := make(map[string]float64)
+    scanner := bufio.NewScanner(w.Body)
+    for scanner.Scan() {
+        line := scanner.Text()
+        i := strings.LastIndex(line, " ")
+        if strings.HasPrefix(line, "#") || i < 0 {
+            continue
+        }
+        value, err := strconv.ParseFloat(line[i+1:], 64)
+        if err != nil {
+            t.Fatalf("bad sample %q: %v", line, err)
+        }
+        samples[line[:i]] = value
+    }
+    return samples
+}
+
+func TestFirstQueryLatency(t *testing.T) {
+    var count int64
+    docker := fakeDNS(t, func(w dns.ResponseWriter, r *dns.Msg) {
+        // Only the first lookup pays a cold start
+        if atomic.AddInt64(&count, 1) == 1 {
+            time.Sleep(200 * time.Millisecond)
+        }
+        answerA("172.17.0.2")(w, r)
+    })
+    p := testProxy(t, "DOCKER_DNS", docker)
+
+    for i := 0; i < 4; i++ {
+        query(p, "web.docker.", dns.TypeA)
+    }
+
+    first := time.Duration(atomic.LoadInt64(&p.firstQueryNanos))
+    if first < 200*time.Millisecond {
+        t.Errorf("first query latency %v, want the 200ms cold start", first)
+    }
+    samples := scrape(t, p)
+    if got := samples["dns_first_query_duration_seconds"]; got != first.Seconds() {
+        t.Errorf("first query gauge %v, want %v", got, first.Seconds())
+    }
+    if got := samples["dns_query_duration_seconds_count"]; got != 3 {
+        t.Errorf("query duration histogram counts %v queries, want the 3 after the first", got)
+    }
+    if got := samples["dns_query_duration_seconds_sum"]; got >= 0.2 {
+        t.Errorf("query duration histogram sums to %vs, want the cold start left out", got)
+    }
+}
+
+// The counters and histograms served on /metrics move with the queries.
+func TestMetricsEndpoint(t *testing.T) {
+    docker := fakeDNS(t, func(w dns.ResponseWriter, r *dns.Msg) {
+        if strings.HasPrefix(r.Question[0].Name, "broken.") {
+            w.Write([]byte{0, 1, 2})
+            return
+        }
+        answerA("172.17.0.2")(w, r)
+    })
+    p := testProxy(t, "DOCKER_DNS", docker, "CACHE_ENABLED", "true")
+    remote := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}
+    send := func(name string) {
+        r := new(dns.Msg)
+        r.SetQuestion(name, dns.TypeA)
+        queryFrom(p, remote, r)
+    }
+
+    before := scrape(t, p)
+    send("web.docker.")
+    send("web.docker.")
+    send("broken.docker.")
+    after := scrape(t, p)
+
+    for _, tt := range []struct {
+        sample string
+        want   float64
+    }{
+        {"dns_queries_total", 3},
+        {"dns_errors_total", 1},
+        {`dns_cache_misses_total{qtype="A"}`, 2},
+        {`dns_cache_hits_total{qtype="A"}`, 1},
+        {`dns_lookup_duration_seconds_count{target="docker"}`, 2},
+        // The first query goes to the first query gauge instead
+        {"dns_query_duration_seconds_count", 2},
+    } {
+        if got := after[tt.sample] - before[tt.sample]; got != tt.want {
+            t.Errorf("%s went up by %v, want %v", tt.sample, got, tt.want)
+        }
+    }
+    if after[`dns_lookup_duration_seconds_sum{target="docker"}`] <= 0 {
+        t.Error("Docker DNS lookup durations sum to nothing")
+    }
+    if after["dns_first_query_duration_seconds"] <= 0 {
+        t.Error("first query gauge was not set")
+    }
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+    "context"
+    "net"
+
+    "github.com/miekg/dns"
+)
+
+// Most questions accepted in one message, each is resolved separately
+const maxQuestions = 8
+
+// acceptQuery is the servers' MsgAcceptFunc. It applies the library's checks
+// but lets through up to maxQuestions questions, where the default insists
+// on exactly one.
+func acceptQuery(dh dns.Header) dns.MsgAcceptAction {
+    if dh.Qdcount > 1 && dh.Qdcount <= maxQuestions {
+        dh.Qdcount = 1
+    }
+    return dns.DefaultMsgAcceptFunc(dh)
+}
+
+// answerQuestions answers a message carrying more than one question by
+// resolving each on its own through answerQuestion, as if the client had
+// sent them separately, and merging the replies into one. The work done
+// once per message stays with handleRequest.
+func (p *DNSProxy) answerQuestions(ctx context.Context, cfg *Config, r *dns.Msg, udp bool, client net.IP) *dns.Msg {
+    m := new(dns.Msg)
+    m.SetReply(r)
+    // SetReply keeps only the first question
+    m.Question = append([]dns.Question(nil), r.Question...)
+    m.RecursionAvailable = true
+
+    answered := 0
+    rcode := dns.RcodeSuccess
+    var opt *dns.OPT
+    for _, question := range r.Question {
+        single := r.Copy()
+        single.Question = []dns.Question{question}
+        reply, _ := p.answerQuestion(ctx, cfg, single, udp, client)
+
+        m.Answer = append(m.Answer, reply.Answer...)
+        m.Ns = append(m.Ns, reply.Ns...)
+        for _, rr := range reply.Extra {
+            if o, ok := rr.(*dns.OPT); ok {
+                // A message carries at most one OPT record
+                if opt == nil {
+                    opt = o
+                }
+                continue
+            }
+            m.Extra = append(m.Extra, rr)
+        }
+        m.Truncated = m.Truncated || reply.Truncated
+
+        // Any answered question makes the whole reply a success, otherwise
+        // the first error is reported
+        if reply.Rcode == dns.RcodeSuccess {
+            answered++
+        } else if rcode == dns.RcodeSuccess {
+            rcode = reply.Rcode
+        }
+    }
+    if opt != nil {
+        m.Extra = append(m.Extra, opt)
+    }
+    if answered == 0 {
+        m.Rcode = rcode
+    }
+
+    dedupeSections(m)
+    return m
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+    "net"
+    "sync/atomic"
+    "testing"
+    "time"
+
+    "github.com/miekg/dns"
+)
+
+// twoQuestions returns a query asking for the A records of both names.
+func twoQuestions(first, second string) *dns.Msg {
+    r := new(dns.Msg)
+    r.SetQuestion(first, dns.TypeA)
+    r.Question = append(r.Question, dns.Question{Name: second, Qtype: dns.TypeA, Qclass: dns.ClassINET})
+    return r
+}
+
+func TestMultipleQuestions(t *testing.T) {
+    docker := fakeDNS(t, func(w dns.ResponseWriter, r *dns.Msg) {
+        switch r.Question[0].Name {
+        case "web.":
+            answerA("172.17.0.2")(w, r)
+        case "db.":
+            answerA("172.17.0.3")(w, r)
+        default:
+            m := new(dns.Msg)
+            m.SetRcode(r, dns.RcodeNameError)
+            w.WriteMsg(m)
+        }
+    })
+    p := testProxy(t, "DOCKER_DNS", docker)
+
+    for _, tt := range []struct {
+        first, second string
+        rcode         int
+        answers       []string
+    }{
+        {"web.docker.", "db.docker.", dns.RcodeSuccess, []string{"172.17.0.2", "172.17.0.3"}},
+        {"web.docker.", "missing.docker.", dns.RcodeSuccess, []string{"172.17.0.2"}},
+        {"missing.docker.", "gone.docker.", dns.RcodeNameError, nil},
+    } {
+        m, err := p.dispatch(twoQuestions(tt.first, tt.second))
+        if err != nil {
+            t.Fatal(err)
+        }
+        if len(m.Question) != 2 || m.Rcode != tt.rcode {
+            t.Errorf("%s and %s: got %d questions and %s, want 2 and %s", tt.first, tt.second,
+                len(m.Question), dns.RcodeToString[m.Rcode], dns.RcodeToString[tt.rcode])
+        }
+        if len(m.Answer) != len(tt.answers) {
+            t.Errorf("%s and %s: got answers %v, want %v", tt.first, tt.second, m.Answer, tt.answers)
+            continue
+        }
+        for i, want := range tt.answers {
+            if ip := m.Answer[i].(*dns.A).A.String(); ip != want {
+                t.Errorf("%s and %s: answer %d is %s, want %s", tt.first, tt.second, i, ip, want)
+            }
+        }
+    }
+}
+
+func TestMultipleQuestionsOverTheWire(t *testing.T) {
+    p := testProxy(t, "STATIC_HOSTS", "web.docker=10.0.0.98,db.docker=10.0.0.99")
+    pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    server := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(p.handleRequest), MsgAcceptFunc: acceptQuery}
+    go server.ActivateAndServe()
+    t.Cleanup(func() { server.Shutdown() })
+
+    m, _, err := (&dns.Client{Timeout: 2 * time.Second}).Exchange(twoQuestions("web.docker.", "db.docker."), pc.LocalAddr().String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(m.Question) != 2 || len(m.Answer) != 2 {
+        t.Errorf("got %d questions and answers %v, want both", len(m.Question), m.Answer)
+    }
+}
+
+// A message with several questions is one query to the client-facing limits
+// and counters, however many lookups it takes.
+func TestMultipleQuestionsCountOnce(t *testing.T) {
+    p := testProxy(t, "STATIC_HOSTS", "web.docker=10.0.0.98,db.docker=10.0.0.99",
+        "RATE_LIMIT_QPS", "2")
+    remote := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 10), Port: 5353}
+
+    for i := 1; i <= 2; i++ {
+        m := queryFrom(p, remote, twoQuestions("web.docker.", "db.docker."))
+        if m == nil || m.Rcode != dns.RcodeSuccess || len(m.Answer) != 2 {
+            t.Fatalf("message %d: got %v, want both answers within RATE_LIMIT_QPS 2", i, m)
+        }
+    }
+    if n := atomic.LoadInt64(&p.queryCount); n != 2 {
+        t.Errorf("queryCount = %d after two messages, want 2", n)
+    }
+    if m := queryFrom(p, remote, twoQuestions("web.docker.", "db.docker.")); m == nil || m.Rcode != dns.RcodeRefused {
+        t.Errorf("third message got %v, want REFUSED over RATE_LIMIT_QPS", m)
+    }
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+    "context"
+
+    "github.com/miekg/dns"
+)
+
+type upstreamResult struct {
+    m   *dns.Msg
+    err error
+}
+
+// resolveParallel is resolveDocker for PARALLEL_RESOLVE: the upstream query
+// for domain starts alongside the Docker DNS query for hostname instead of
+// after it misses. A Docker answer cancels the upstream query; otherwise the
+// upstream reply is used, even when the Docker DNS query failed, and only
+// when both fail is the name reported missing. TIMEOUT_SECONDS bounds the
+// whole race.
+func (p *DNSProxy) resolveParallel(ctx context.Context, cfg *Config, m *dns.Msg, r *dns.Msg, domain, hostname string) (*dns.Msg, bool) {
+    ctx, cancel := context.WithTimeout(ctx, cfg.Timeout)
+    defer cancel()
+
+    upstream := make(chan upstreamResult, 1)
+    um := m.Copy()
+    go func() {
+        upstream <- upstreamResult{um, p.forwardToUpstream(ctx, cfg, um, r)}
+    }()
+
+    found, dockerErr := p.queryDockerDNS(ctx, cfg, m, hostname, r.Question[0].Qtype, r.IsEdns0())
+    if found {
+        renameAnswers(m, domain)
+        p.logDebug("Successfully resolved %s via Docker DNS, cancelling upstream query", domain)
+        return m, false
+    }
+
+    result := <-upstream
+    if dockerErr != nil && result.err != nil {
+        p.logDebug("Neither Docker DNS nor upstream DNS answered for: %s", domain)
+        m.SetRcode(r, dns.RcodeNameError)
+        return m, true
+    }
+    p.logInfo("No answer from Docker DNS for %s, using upstream DNS answer for %s", hostname, domain)
+    return result.m, result.err != nil
+}
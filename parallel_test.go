@@ -0,0 +1,88 @@
+package main
+
+import (
+    "context"
+    "testing"
+    "time"
+
+    "github.com/miekg/dns"
+)
+
+// When Docker DNS wins a PARALLEL_RESOLVE race the cancelled upstream query
+// must give back the breaker's probe slot if it held it.
+func TestParallelResolveReleasesProbe(t *testing.T) {
+    // The upstream never answers, so its query ends after the race is lost
+    silent := fakeDNS(t, func(w dns.ResponseWriter, r *dns.Msg) {})
+    p := testProxy(t,
+        "DOCKER_DNS", fakeDNS(t, func(w dns.ResponseWriter, r *dns.Msg) {
+            // Late enough for the upstream query to be under way
+            time.Sleep(100 * time.Millisecond)
+            answerA("172.18.0.2")(w, r)
+        }),
+        "ENABLE_UPSTREAM", "true", "UPSTREAM_DNS", silent, "TIMEOUT_SECONDS", "1",
+        "FALLBACK_TO_UPSTREAM", "true", "PARALLEL_RESOLVE", "true",
+        "BREAKER_THRESHOLD", "1")
+
+    breaker := p.breaker(silent)
+    breaker.failure(time.Now().Add(-time.Hour), 1)
+
+    m := query(p, "web.docker.", dns.TypeA)
+    if len(m.Answer) != 1 || m.Answer[0].(*dns.A).A.String() != "172.18.0.2" {
+        t.Fatalf("got %v, want the Docker DNS answer", m.Answer)
+    }
+
+    deadline := time.Now().Add(3 * time.Second)
+    for {
+        breaker.mu.Lock()
+        probing := breaker.probing
+        breaker.mu.Unlock()
+        if !probing {
+            break
+        }
+        if time.Now().After(deadline) {
+            t.Fatal("breaker still holds the probe of the cancelled upstream query")
+        }
+        time.Sleep(10 * time.Millisecond)
+    }
+}
+
+// Unlike resolveDocker, the parallel race uses the upstream answer when the
+// Docker DNS query fails, and reports the name missing only if both fail.
+func TestParallelResolveDockerError(t *testing.T) {
+    // DOCKER_DNS stays on the port nothing listens on
+    p := testProxy(t, "ENABLE_UPSTREAM", "true", "UPSTREAM_DNS", fakeDNS(t, answerA("203.0.113.7")),
+        "FALLBACK_TO_UPSTREAM", "true", "PARALLEL_RESOLVE", "true")
+    m := query(p, "web.docker.", dns.TypeA)
+    if len(m.Answer) != 1 || m.Answer[0].(*dns.A).A.String() != "203.0.113.7" {
+        t.Errorf("got %v, want the upstream answer after a Docker DNS error", m.Answer)
+    }
+
+    p = testProxy(t, "ENABLE_UPSTREAM", "true", "UPSTREAM_DNS", "127.0.0.1:1",
+        "FALLBACK_TO_UPSTREAM", "true", "PARALLEL_RESOLVE", "true")
+    r := new(dns.Msg)
+    r.SetQuestion("web.docker.", dns.TypeA)
+    m, failed := p.lookup(context.Background(), p.config(), r)
+    if m.Rcode != dns.RcodeNameError || !failed {
+        t.Errorf("got %s, failed %v with both failing, want NXDOMAIN and failed", dns.RcodeToString[m.Rcode], failed)
+    }
+}
+
+// TIMEOUT_SECONDS bounds the whole race, so an upstream that times out
+// leaves no time for the next one even within the request deadline.
+func TestParallelResolveTimeout(t *testing.T) {
+    silent := fakeDNS(t, func(w dns.ResponseWriter, r *dns.Msg) {})
+    p := testProxy(t,
+        "DOCKER_DNS", fakeDNS(t, answerEmpty),
+        "ENABLE_UPSTREAM", "true", "UPSTREAM_DNS", silent+","+fakeDNS(t, answerA("203.0.113.7")),
+        "TIMEOUT_SECONDS", "1", "REQUEST_TIMEOUT_SECONDS", "5",
+        "FALLBACK_TO_UPSTREAM", "true", "PARALLEL_RESOLVE", "true")
+
+    start := time.Now()
+    m := query(p, "web.docker.", dns.TypeA)
+    if took := time.Since(start); took > 2*time.Second {
+        t.Errorf("lookup took %v, want it cut off at TIMEOUT_SECONDS 1s", took)
+    }
+    if len(m.Answer) != 0 {
+        t.Errorf("got %v, want no answer from the upstream after the deadline", m.Answer)
+    }
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+    "sync/atomic"
+
+    "github.com/miekg/dns"
+)
+
+type poolJob struct {
+    w    dns.ResponseWriter
+    r    *dns.Msg
+    done chan struct{}
+}
+
+// workerPool answers queries on a fixed number of workers. The server still
+// starts a goroutine per packet, but those only wait in a bounded queue, and
+// queries arriving while it is full are dropped, so work and memory stay
+// bounded under a flood.
+type workerPool struct {
+    jobs    chan poolJob
+    handler dns.Handler
+    dropped int64
+    pending int64 // queries from being queued until answered
+}
+
+func newWorkerPool(size, queue int, handler dns.Handler) *workerPool {
+    wp := &workerPool{
+        jobs:    make(chan poolJob, queue),
+        handler: handler,
+    }
+    for i := 0; i < size; i++ {
+        go wp.work()
+    }
+    return wp
+}
+
+func (wp *workerPool) work() {
+    for job := range wp.jobs {
+        wp.handler.ServeDNS(job.w, job.r)
+        close(job.done)
+    }
+}
+
+// ServeDNS queues the query and waits for a worker to answer it, as the
+// ResponseWriter is only valid until ServeDNS returns.
+func (wp *workerPool) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+    job := poolJob{w: w, r: r, done: make(chan struct{})}
+    // Counted before it is queued, so a drain can't miss it in the queue
+    atomic.AddInt64(&wp.pending, 1)
+    defer atomic.AddInt64(&wp.pending, -1)
+    select {
+    case wp.jobs <- job:
+        <-job.done
+    default:
+        atomic.AddInt64(&wp.dropped, 1)
+    }
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+    "net"
+    "sync"
+    "sync/atomic"
+    "testing"
+    "time"
+
+    "github.com/miekg/dns"
+)
+
+func TestWorkerPoolBoundsHandlers(t *testing.T) {
+    var current, peak, handled int64
+    wp := newWorkerPool(3, 100, dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+        n := atomic.AddInt64(&current, 1)
+        for {
+            max := atomic.LoadInt64(&peak)
+            if n <= max || atomic.CompareAndSwapInt64(&peak, max, n) {
+                break
+            }
+        }
+        time.Sleep(10 * time.Millisecond)
+        atomic.AddInt64(&current, -1)
+        atomic.AddInt64(&handled, 1)
+    }))
+
+    var wg sync.WaitGroup
+    for i := 0; i < 50; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            r := new(dns.Msg)
+            r.SetQuestion("web.docker.", dns.TypeA)
+            wp.ServeDNS(&responseRecorder{}, r)
+        }()
+    }
+    wg.Wait()
+
+    if n := atomic.LoadInt64(&peak); n > 3 {
+        t.Errorf("%d handlers ran at once, want at most POOL_SIZE 3", n)
+    }
+    if n := atomic.LoadInt64(&handled); n != 50 {
+        t.Errorf("%d queries handled, want all 50 within the queue", n)
+    }
+}
+
+func TestWorkerPoolDropsWhenQueueFull(t *testing.T) {
+    entered := make(chan struct{}, 1)
+    release := make(chan struct{})
+    wp := newWorkerPool(1, 1, dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+        entered <- struct{}{}
+        <-release
+    }))
+    serve := func() {
+        r := new(dns.Msg)
+        r.SetQuestion("web.docker.", dns.TypeA)
+        wp.ServeDNS(&responseRecorder{}, r)
+    }
+
+    var wg sync.WaitGroup
+    wg.Add(2)
+    go func() { defer wg.Done(); serve() }()
+    <-entered
+    go func() { defer wg.Done(); serve() }()
+    for len(wp.jobs) == 0 {
+        time.Sleep(time.Millisecond)
+    }
+
+    // One query with the worker, one queued: the next is dropped at once
+    serve()
+    if n := atomic.LoadInt64(&wp.dropped); n != 1 {
+        t.Errorf("%d queries dropped, want 1", n)
+    }
+    close(release)
+    <-entered
+    wg.Wait()
+}
+
+// A drain waits for the queries still queued for a worker, not only those
+// being answered.
+func TestDrainWaitsForQueuedQueries(t *testing.T) {
+    p := testProxy(t)
+    entered := make(chan struct{}, 2)
+    release := make(chan struct{})
+    p.pool = newWorkerPool(1, 1, dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+        entered <- struct{}{}
+        <-release
+        p.handleRequest(w, r)
+    }))
+
+    answered := make(chan *dns.Msg, 2)
+    for i := 0; i < 2; i++ {
+        go func() {
+            w := &responseRecorder{}
+            r := new(dns.Msg)
+            r.SetQuestion("web.docker.", dns.TypeA)
+            p.pool.ServeDNS(w, r)
+            answered <- w.msg
+        }()
+    }
+    <-entered
+    for len(p.pool.jobs) == 0 {
+        time.Sleep(time.Millisecond)
+    }
+
+    if p.drain(50 * time.Millisecond) {
+        t.Fatal("drain finished with one query answering and one queued")
+    }
+    close(release)
+    if !p.drain(2 * time.Second) {
+        t.Error("drain timed out after the queries were released")
+    }
+    for i := 0; i < 2; i++ {
+        if m := <-answered; m == nil {
+            t.Error("a query got no response")
+        }
+    }
+}
+
+// benchmarkServe answers queries for a static host from parallel goroutines,
+// directly or through a pool of POOL_SIZE workers.
+func benchmarkServe(b *testing.B, poolSize int) {
+    b.Setenv("DOCKER_DNS", "127.0.0.1:1")
+    b.Setenv("STATIC_HOSTS", "web.docker=10.0.0.99")
+    b.Setenv("LOG_LEVEL", "ERROR")
+    p := NewDNSProxy(loadConfig())
+    var handler dns.Handler = dns.HandlerFunc(p.handleRequest)
+    if poolSize > 0 {
+        handler = newWorkerPool(poolSize, 256, handler)
+    }
+
+    remote := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}
+    b.ResetTimer()
+    b.RunParallel(func(pb *testing.PB) {
+        for pb.Next() {
+            r := new(dns.Msg)
+            r.SetQuestion("web.docker.", dns.TypeA)
+            handler.ServeDNS(&responseRecorder{remote: remote}, r)
+        }
+    })
+}
+
+func BenchmarkGoroutinePerQuery(b *testing.B) { benchmarkServe(b, 0) }
+func BenchmarkWorkerPool(b *testing.B)        { benchmarkServe(b, 8) }
@@ -0,0 +1,81 @@
+package main
+
+import (
+    "context"
+    "net"
+    "strings"
+
+    "github.com/miekg/dns"
+)
+
+// Docker's default bridge network. It is inside 172.16.0.0/12 already, but
+// listed so the intent is plain.
+var dockerBridgeNet = &net.IPNet{IP: net.IPv4(172, 17, 0, 0), Mask: net.CIDRMask(16, 32)}
+
+// reverseIP returns the address a PTR name such as 4.3.2.1.in-addr.arpa.
+// refers to, or nil when the name isn't a complete reverse name.
+func reverseIP(name string) net.IP {
+    name = strings.ToLower(name)
+    if rest := strings.TrimSuffix(name, ".in-addr.arpa."); rest != name {
+        labels := strings.Split(rest, ".")
+        if len(labels) != 4 {
+            return nil
+        }
+        for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+            labels[i], labels[j] = labels[j], labels[i]
+        }
+        return net.ParseIP(strings.Join(labels, ".")).To4()
+    }
+    if rest := strings.TrimSuffix(name, ".ip6.arpa."); rest != name {
+        nibbles := strings.Split(rest, ".")
+        if len(nibbles) != 32 {
+            return nil
+        }
+        var b strings.Builder
+        for i := len(nibbles) - 1; i >= 0; i-- {
+            if len(nibbles[i]) != 1 {
+                return nil
+            }
+            b.WriteString(nibbles[i])
+            if i%4 == 0 && i > 0 {
+                b.WriteByte(':')
+            }
+        }
+        return net.ParseIP(b.String())
+    }
+    return nil
+}
+
+// isReverseName reports whether name lies in the reverse DNS trees.
+func isReverseName(name string) bool {
+    return strings.HasSuffix(name, ".in-addr.arpa.") || strings.HasSuffix(name, ".ip6.arpa.")
+}
+
+// internalIP reports whether ip belongs to a private range (RFC 1918 and
+// RFC 4193), Docker's default bridge, loopback or link-local, whose names
+// must not be asked of public resolvers.
+func internalIP(ip net.IP) bool {
+    return ip.IsPrivate() || dockerBridgeNet.Contains(ip) || ip.IsLoopback() ||
+        ip.IsLinkLocalUnicast() || ip.IsUnspecified()
+}
+
+// resolvePTR answers reverse lookups from Docker DNS, which knows the names
+// of containers on its networks. Only public addresses it can't answer are
+// forwarded upstream, so internal addresses don't leak to public resolvers.
+func (p *DNSProxy) resolvePTR(ctx context.Context, cfg *Config, m *dns.Msg, r *dns.Msg, domain string) (*dns.Msg, bool) {
+    found, err := p.queryDockerDNS(ctx, cfg, m, domain, dns.TypePTR, r.IsEdns0())
+    if found {
+        p.logDebug("Resolved reverse name %s via Docker DNS", domain)
+        return m, false
+    }
+
+    ip := reverseIP(domain)
+    if ip != nil && !internalIP(ip) && cfg.EnableUpstream {
+        p.logDebug("No reverse name for public address %s in Docker DNS, forwarding to upstream DNS", ip)
+        return m, p.forwardToUpstream(ctx, cfg, m, r) != nil
+    }
+
+    p.logDebug("No reverse name for %s in Docker DNS, not forwarding internal address", domain)
+    m.SetRcode(r, dns.RcodeNameError)
+    return m, err != nil
+}
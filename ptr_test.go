@@ -0,0 +1,69 @@
+package main
+
+import (
+    "net"
+    "sync/atomic"
+    "testing"
+
+    "github.com/miekg/dns"
+)
+
+// Reverse names of internal addresses, and names that aren't a complete
+// reverse name, are answered NXDOMAIN without asking the upstream.
+func TestReverseLookupNotForwarded(t *testing.T) {
+    var forwarded int64
+    upstream := fakeDNS(t, func(w dns.ResponseWriter, r *dns.Msg) {
+        atomic.AddInt64(&forwarded, 1)
+        m := new(dns.Msg)
+        m.SetReply(r)
+        rr, _ := dns.NewRR(r.Question[0].Name + " 60 IN PTR dns.example.")
+        m.Answer = append(m.Answer, rr)
+        w.WriteMsg(m)
+    })
+    p := testProxy(t, "DOCKER_DNS", fakeDNS(t, answerEmpty),
+        "ENABLE_UPSTREAM", "true", "UPSTREAM_DNS", upstream)
+
+    for _, name := range []string{
+        "2.0.0.10.in-addr.arpa.",
+        "5.0.17.172.in-addr.arpa.",
+        "1.0.0.127.in-addr.arpa.",
+        "1.1.168.192.in-addr.arpa.",
+        // Malformed: too few labels, a label that isn't a number
+        "0.10.in-addr.arpa.",
+        "x.0.0.10.in-addr.arpa.",
+        "300.0.0.8.in-addr.arpa.",
+    } {
+        m := query(p, name, dns.TypePTR)
+        if m.Rcode != dns.RcodeNameError || len(m.Answer) != 0 {
+            t.Errorf("%s: got %s with %v, want NXDOMAIN", name, dns.RcodeToString[m.Rcode], m.Answer)
+        }
+    }
+    if n := atomic.LoadInt64(&forwarded); n != 0 {
+        t.Fatalf("upstream got %d reverse queries, want 0", n)
+    }
+
+    // A public address Docker DNS doesn't know is forwarded
+    if m := query(p, "8.8.8.8.in-addr.arpa.", dns.TypePTR); len(m.Answer) != 1 {
+        t.Errorf("got %v, want the upstream PTR for a public address", m.Answer)
+    }
+    if n := atomic.LoadInt64(&forwarded); n != 1 {
+        t.Errorf("upstream got %d reverse queries, want 1", n)
+    }
+}
+
+func TestReverseIP(t *testing.T) {
+    for name, want := range map[string]string{
+        "4.3.2.1.in-addr.arpa.": "1.2.3.4",
+        "4.3.2.1.IN-ADDR.ARPA.": "1.2.3.4",
+        "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa.": "fd00::1",
+    } {
+        if ip := reverseIP(name); !ip.Equal(net.ParseIP(want)) {
+            t.Errorf("reverseIP(%q) = %v, want %s", name, ip, want)
+        }
+    }
+    for _, name := range []string{"3.2.1.in-addr.arpa.", "a.3.2.1.in-addr.arpa.", "1.0.d.f.ip6.arpa.", "example.com."} {
+        if ip := reverseIP(name); ip != nil {
+            t.Errorf("reverseIP(%q) = %v, want nil", name, ip)
+        }
+    }
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+    "fmt"
+    "log"
+    "os"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/miekg/dns"
+)
+
+// Values of LOG_NAME_CASE
+const (
+    nameCaseLower    = "lower"
+    nameCaseOriginal = "original"
+)
+
+// logName returns the query name as it should appear in logs. Matching and
+// resolution always use the lower-cased name regardless of this policy.
+func (c *Config) logName(name string) string {
+    if c.LogNameCase == nameCaseOriginal {
+        return name
+    }
+    return strings.ToLower(name)
+}
+
+// logQuestions returns the names and types of r's questions for logs, comma
+// separated when there are several.
+func (c *Config) logQuestions(r *dns.Msg) (names, qtypes string) {
+    for i, q := range r.Question {
+        if i > 0 {
+            names += ","
+            qtypes += ","
+        }
+        names += c.logName(q.Name)
+        qtypes += dns.TypeToString[q.Qtype]
+    }
+    return names, qtypes
+}
+
+// queryLog appends one line per answered query to QUERY_LOG_FILE. It is
+// reopened on SIGHUP so external rotation (logrotate) takes effect.
+type queryLog struct {
+    mu   sync.Mutex
+    path string
+    f    *os.File
+}
+
+// reopen closes the current file and opens path, which may be empty to stop
+// logging queries.
+func (l *queryLog) reopen(path string) error {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+
+    if l.f != nil {
+        l.f.Close()
+        l.f = nil
+    }
+    l.path = path
+    if path == "" {
+        return nil
+    }
+
+    f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+    if err != nil {
+        return err
+    }
+    l.f = f
+    return nil
+}
+
+func (l *queryLog) write(client, name, qtype string, m *dns.Msg, took time.Duration) {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+
+    if l.f == nil {
+        return
+    }
+    _, err := fmt.Fprintf(l.f, "%s %s %s %s %s %d %dms\n",
+        time.Now().UTC().Format(time.RFC3339), client, name, qtype,
+        dns.RcodeToString[m.Rcode], len(m.Answer), took.Milliseconds())
+    if err != nil {
+        log.Printf("[ERROR] Failed to write query log %s: %v", l.path, err)
+    }
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+
+    "github.com/miekg/dns"
+)
+
+func TestQueryLogReopenAfterRotation(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "queries.log")
+    p := testProxy(t, "QUERY_LOG_FILE", path, "HOST_INTERNAL_IP", "192.0.2.1", "GATEWAY_INTERNAL_IP", "192.0.2.2")
+    t.Cleanup(func() { p.queryLog.reopen("") })
+
+    query(p, hostInternalName, dns.TypeA)
+    if err := os.Rename(path, path+".1"); err != nil {
+        t.Fatal(err)
+    }
+    // Until reopened, lines still go to the rotated file
+    query(p, hostInternalName, dns.TypeAAAA)
+    if err := p.queryLog.reopen(path); err != nil {
+        t.Fatal(err)
+    }
+    query(p, gatewayInternalName, dns.TypeA)
+
+    read := func(path string) string {
+        data, err := os.ReadFile(path)
+        if err != nil {
+            t.Fatal(err)
+        }
+        return string(data)
+    }
+    rotated, current := read(path+".1"), read(path)
+    if n := strings.Count(rotated, "\n"); n != 2 || !strings.Contains(rotated, hostInternalName+" AAAA") {
+        t.Errorf("rotated file has %d lines, want the 2 from before the reopen:\n%s", n, rotated)
+    }
+    if n := strings.Count(current, "\n"); n != 1 || !strings.Contains(current, gatewayInternalName+" A NOERROR 1") {
+        t.Errorf("new file has %d lines, want the 1 from after the reopen:\n%s", n, current)
+    }
+}
+
+func TestLogNameCase(t *testing.T) {
+    for _, tt := range []struct {
+        policy, logged, unwanted string
+    }{
+        {"lower", "host.docker.internal.", "Host.Docker.Internal."},
+        {"original", "Host.Docker.Internal.", "host.docker.internal."},
+    } {
+        path := filepath.Join(t.TempDir(), "queries.log")
+        p := testProxy(t, "LOG_NAME_CASE", tt.policy, "LOG_LEVEL", "INFO",
+            "QUERY_LOG_FILE", path, "HOST_INTERNAL_IP", "192.0.2.1")
+        logs := captureLog(t)
+
+        m := query(p, "Host.Docker.Internal.", dns.TypeA)
+        p.queryLog.reopen("")
+        if ip := answerIP(m); ip != "192.0.2.1" {
+            t.Fatalf("LOG_NAME_CASE=%s: answer %q, want 192.0.2.1 whatever the case", tt.policy, ip)
+        }
+        data, err := os.ReadFile(path)
+        if err != nil {
+            t.Fatal(err)
+        }
+        for source, out := range map[string]string{"log": logs.String(), "query log": string(data)} {
+            if !strings.Contains(out, tt.logged) || strings.Contains(out, tt.unwanted) {
+                t.Errorf("LOG_NAME_CASE=%s: %s does not show the name as %s:\n%s", tt.policy, source, tt.logged, out)
+            }
+        }
+    }
+}
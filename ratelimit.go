@@ -0,0 +1,70 @@
+package main
+
+import (
+    "math"
+    "sync"
+    "time"
+)
+
+// Idle time after which a client's bucket is forgotten
+const clientLimitIdleTimeout = time.Minute
+
+type clientBucket struct {
+    tokens float64
+    last   time.Time
+}
+
+// clientLimiter limits the queries each client IP may send with a token
+// bucket refilled at RATE_LIMIT_QPS and holding up to RATE_LIMIT_BURST
+// tokens, so one client retrying in a tight loop can't flood the proxy and
+// Docker DNS behind it.
+type clientLimiter struct {
+    mu        sync.Mutex
+    buckets   map[string]*clientBucket
+    lastSweep time.Time
+}
+
+func newClientLimiter() *clientLimiter {
+    return &clientLimiter{buckets: make(map[string]*clientBucket)}
+}
+
+// rateLimitBurst is the bucket size: RATE_LIMIT_BURST, or one second worth
+// of queries when it is not set.
+func (c *Config) rateLimitBurst() float64 {
+    if c.RateLimitBurst > 0 {
+        return float64(c.RateLimitBurst)
+    }
+    return math.Max(1, math.Ceil(c.RateLimitQPS))
+}
+
+// allow takes a token for client and reports whether it had one, and if not
+// how long until the next one. Buckets idle for a while are dropped on the
+// way, since a full bucket is what a new client starts with anyway.
+func (l *clientLimiter) allow(client string, rate, burst float64, now time.Time) (bool, time.Duration) {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+
+    if now.Sub(l.lastSweep) > clientLimitIdleTimeout {
+        for k, b := range l.buckets {
+            if now.Sub(b.last) > clientLimitIdleTimeout {
+                delete(l.buckets, k)
+            }
+        }
+        l.lastSweep = now
+    }
+
+    b, ok := l.buckets[client]
+    if !ok {
+        b = &clientBucket{tokens: burst, last: now}
+        l.buckets[client] = b
+    }
+
+    b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+    b.last = now
+
+    if b.tokens >= 1 {
+        b.tokens--
+        return true, 0
+    }
+    return false, time.Duration((1 - b.tokens) / rate * float64(time.Second))
+}
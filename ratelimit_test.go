@@ -0,0 +1,49 @@
+package main
+
+import (
+    "fmt"
+    "testing"
+    "time"
+)
+
+func TestClientLimiterBucket(t *testing.T) {
+    l := newClientLimiter()
+    now := time.Now()
+    for i := 0; i < 3; i++ {
+        if ok, _ := l.allow("192.0.2.1", 2, 3, now); !ok {
+            t.Fatalf("query %d refused within the burst of 3", i+1)
+        }
+    }
+    ok, wait := l.allow("192.0.2.1", 2, 3, now)
+    if ok || wait != 500*time.Millisecond {
+        t.Errorf("after the burst got %v, retry in %v, want refused for 500ms at 2 qps", ok, wait)
+    }
+    if ok, _ := l.allow("192.0.2.1", 2, 3, now.Add(500*time.Millisecond)); !ok {
+        t.Error("refused once a token was refilled")
+    }
+    if ok, _ := l.allow("192.0.2.2", 2, 3, now); !ok {
+        t.Error("another client was refused by the first one's bucket")
+    }
+}
+
+// Buckets of clients idle past the timeout are dropped on a later query.
+func TestClientLimiterSweepsIdleBuckets(t *testing.T) {
+    l := newClientLimiter()
+    now := time.Now()
+    for i := 0; i < 100; i++ {
+        l.allow(fmt.Sprintf("192.0.2.%d", i), 10, 10, now)
+    }
+    if n := len(l.buckets); n != 100 {
+        t.Fatalf("%d buckets after 100 clients, want 100", n)
+    }
+
+    // One client stays active while the others go idle
+    l.allow("192.0.2.0", 10, 10, now.Add(clientLimitIdleTimeout/2))
+    l.allow("198.51.100.1", 10, 10, now.Add(clientLimitIdleTimeout+time.Second))
+    if n := len(l.buckets); n != 2 {
+        t.Errorf("%d buckets after the idle timeout, want the 2 recent clients", n)
+    }
+    if _, ok := l.buckets["192.0.2.0"]; !ok {
+        t.Error("bucket of the active client was dropped")
+    }
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+    "sync"
+    "testing"
+
+    "github.com/miekg/dns"
+)
+
+// Each query must see one configuration from start to end, however often it
+// is reloaded meanwhile. Run with go test -race.
+func TestReloadWhileQuerying(t *testing.T) {
+    p := testProxy(t, "HOST_INTERNAL_IP", "192.0.2.1", "SYNTHETIC_TTL", "10")
+    configs := []*Config{p.config()}
+    t.Setenv("HOST_INTERNAL_IP", "192.0.2.2")
+    t.Setenv("SYNTHETIC_TTL", "20")
+    configs = append(configs, loadConfig())
+    want := map[string]uint32{"192.0.2.1": 10, "192.0.2.2": 20}
+
+    stop := make(chan struct{})
+    var reloader sync.WaitGroup
+    reloader.Add(1)
+    go func() {
+        defer reloader.Done()
+        for i := 0; ; i++ {
+            select {
+            case <-stop:
+                return
+            default:
+            }
+            if err := p.reload(configs[i%2]); err != nil {
+                t.Error(err)
+                return
+            }
+        }
+    }()
+
+    var wg sync.WaitGroup
+    for i := 0; i < 50; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            for j := 0; j < 20; j++ {
+                m := query(p, hostInternalName, dns.TypeA)
+                if len(m.Answer) != 1 {
+                    t.Errorf("got %d answers, want 1", len(m.Answer))
+                    return
+                }
+                a := m.Answer[0].(*dns.A)
+                if ttl, ok := want[a.A.String()]; !ok || a.Hdr.Ttl != ttl {
+                    t.Errorf("answer %s mixes two configurations", a)
+                    return
+                }
+            }
+        }()
+    }
+    wg.Wait()
+    close(stop)
+    reloader.Wait()
+}
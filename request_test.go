@@ -0,0 +1,114 @@
+package main
+
+import (
+    "fmt"
+    "net"
+    "strings"
+    "testing"
+
+    "github.com/miekg/dns"
+)
+
+func TestValidQueryName(t *testing.T) {
+    for name, want := range map[string]bool{
+        "web.docker.":         true,
+        `we\.b.docker.`:       true,
+        `web\032x.docker.`:    true,
+        "web\n.docker.":       false,
+        `web\009.docker.`:     false,
+        `web\127.docker.`:     false,
+        "web\x7f.docker.":     false,
+        `web\` + "\n.docker.": false,
+    } {
+        if got := validQueryName(name); got != want {
+            t.Errorf("validQueryName(%q) = %v, want %v", name, got, want)
+        }
+    }
+}
+
+func TestControlCharacterName(t *testing.T) {
+    docker := fakeDNS(t, answerA("172.17.0.2"))
+    p := testProxy(t, "DOCKER_DNS", docker)
+    logs := captureLog(t)
+
+    // Names unpacked from the wire carry control characters escaped
+    packed, err := (&dns.Msg{Question: []dns.Question{{Name: "web\\009evil.docker.", Qtype: dns.TypeA, Qclass: dns.ClassINET}}}).Pack()
+    if err != nil {
+        t.Fatal(err)
+    }
+    r := new(dns.Msg)
+    if err := r.Unpack(packed); err != nil {
+        t.Fatal(err)
+    }
+
+    m, _ := p.dispatch(r)
+    if m == nil || m.Rcode != dns.RcodeFormatError {
+        t.Fatalf("got %v, want FORMERR", m)
+    }
+    if len(m.Answer) != 0 {
+        t.Errorf("FORMERR carries answers: %v", m.Answer)
+    }
+    if out := logs.String(); strings.Contains(out, "evil") {
+        t.Errorf("rejected name logged:\n%s", out)
+    }
+}
+
+func TestRequireTCP(t *testing.T) {
+    docker := fakeDNS(t, func(w dns.ResponseWriter, r *dns.Msg) {
+        m := new(dns.Msg)
+        m.SetReply(r)
+        for i := 1; i <= 10; i++ {
+            rr, _ := dns.NewRR(fmt.Sprintf("%s 30 IN A 172.17.0.%d", r.Question[0].Name, i))
+            m.Answer = append(m.Answer, rr)
+        }
+        w.WriteMsg(m)
+    })
+    p := testProxy(t, "DOCKER_DNS", docker, "ENABLE_FEATURES_TXT", "true",
+        "REQUIRE_TCP_QTYPES", "TXT", "REQUIRE_TCP_ABOVE", "200")
+    udp := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}
+    tcp := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}
+
+    for _, tt := range []struct {
+        name      string
+        qtype     uint16
+        remote    net.Addr
+        truncated bool
+    }{
+        {"_features.dns-proxy.docker.", dns.TypeTXT, udp, true},
+        {"_features.dns-proxy.docker.", dns.TypeTXT, tcp, false},
+        {"web.docker.", dns.TypeA, udp, true},
+        {"web.docker.", dns.TypeA, tcp, false},
+    } {
+        r := new(dns.Msg)
+        r.SetQuestion(tt.name, tt.qtype)
+        m := queryFrom(p, tt.remote, r)
+        if m == nil {
+            t.Fatalf("%s over %s: no response", dns.TypeToString[tt.qtype], tt.remote.Network())
+        }
+        if m.Truncated != tt.truncated || (tt.truncated && len(m.Answer) != 0) || (!tt.truncated && len(m.Answer) == 0) {
+            t.Errorf("%s over %s: TC %v with %d answers, want TC %v", dns.TypeToString[tt.qtype], tt.remote.Network(), m.Truncated, len(m.Answer), tt.truncated)
+        }
+    }
+}
+
+func TestFaultInjectionRate(t *testing.T) {
+    p := testProxy(t, "FAULT_INJECTION_RATE", "0.3", "HOST_INTERNAL_IP", "192.0.2.1")
+    const queries = 2000
+    failed := 0
+    for i := 0; i < queries; i++ {
+        if m := query(p, hostInternalName, dns.TypeA); m.Rcode == dns.RcodeServerFailure {
+            failed++
+        }
+    }
+    // 0.3 of 2000 is 600, with a standard deviation of about 20
+    if failed < 500 || failed > 700 {
+        t.Errorf("%d of %d queries failed, want about 600", failed, queries)
+    }
+
+    off := testProxy(t, "FAULT_INJECTION_RATE", "0")
+    for i := 0; i < 200; i++ {
+        if m := query(off, hostInternalName, dns.TypeA); m.Rcode != dns.RcodeSuccess {
+            t.Fatalf("query failed with fault injection off: %s", dns.RcodeToString[m.Rcode])
+        }
+    }
+}
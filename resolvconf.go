@@ -0,0 +1,35 @@
+package main
+
+import (
+    "fmt"
+    "net"
+    "strings"
+)
+
+// resolvConf builds a resolv.conf snippet pointing clients at this proxy,
+// searching the strip suffixes so short names like `web` resolve.
+func (c *Config) resolvConf() string {
+    var b strings.Builder
+    b.WriteString("# Generated by dns-proxy\n")
+
+    addr := c.ListenAddr
+    if ip := net.ParseIP(addr); addr == "" || (ip != nil && ip.IsUnspecified()) {
+        b.WriteString("# Listening on all addresses, replace with an address clients can reach\n")
+        addr = "127.0.0.1"
+    }
+    if c.ListenPort != "53" {
+        // resolv.conf has no way to give a port
+        fmt.Fprintf(&b, "# Listening on port %s, clients need it forwarded from port 53\n", c.ListenPort)
+    }
+    fmt.Fprintf(&b, "nameserver %s\n", addr)
+
+    if len(c.StripSuffixes) > 0 {
+        search := make([]string, len(c.StripSuffixes))
+        for i, suffix := range c.StripSuffixes {
+            search[i] = strings.TrimPrefix(suffix, ".")
+        }
+        fmt.Fprintf(&b, "search %s\n", strings.Join(search, " "))
+    }
+    b.WriteString("options ndots:1\n")
+    return b.String()
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+    "log"
+    "strings"
+
+    "github.com/miekg/dns"
+)
+
+// getNameRewritesEnv parses a comma-separated list of old=new name pairs,
+// e.g. `db.docker=postgres.docker`, into fully qualified lower-case names.
+func getNameRewritesEnv(key string) map[string]string {
+    var rewrites map[string]string
+    for _, entry := range getListEnv(key, "") {
+        from, to, ok := strings.Cut(entry, "=")
+        from, to = strings.TrimSpace(from), strings.TrimSpace(to)
+        if !ok || from == "" || to == "" {
+            log.Printf("Warning: Invalid entry in %s: %s, expected old=new", key, entry)
+            continue
+        }
+        if rewrites == nil {
+            rewrites = make(map[string]string)
+        }
+        rewrites[strings.ToLower(dns.Fqdn(from))] = strings.ToLower(dns.Fqdn(to))
+    }
+    return rewrites
+}
+
+// rewriteRequest returns r asking for the name NAME_REWRITES maps its
+// question to, and that name, or r itself and "" when there is no rewrite.
+func (c *Config) rewriteRequest(r *dns.Msg) (*dns.Msg, string) {
+    target, ok := c.NameRewrites[strings.ToLower(r.Question[0].Name)]
+    if !ok {
+        return r, ""
+    }
+    req := r.Copy()
+    req.Question[0].Name = target
+    return req, target
+}
+
+// restoreName puts the client's question back into m and renames the
+// records owned by the rewritten name to the name that was queried.
+func restoreName(r *dns.Msg, m *dns.Msg, target string) {
+    name := r.Question[0].Name
+    for _, rr := range m.Answer {
+        if hdr := rr.Header(); strings.EqualFold(hdr.Name, target) {
+            hdr.Name = name
+        }
+    }
+    m.Question = r.Question
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+    "testing"
+
+    "github.com/miekg/dns"
+)
+
+func TestGetNameRewritesEnv(t *testing.T) {
+    t.Setenv("NAME_REWRITES", "DB.docker=postgres.docker, cache.docker.=redis.docker., broken")
+    rewrites := getNameRewritesEnv("NAME_REWRITES")
+    want := map[string]string{"db.docker.": "postgres.docker.", "cache.docker.": "redis.docker."}
+    if len(rewrites) != len(want) {
+        t.Fatalf("got %v, want %v", rewrites, want)
+    }
+    for from, to := range want {
+        if rewrites[from] != to {
+            t.Errorf("%s rewritten to %q, want %q", from, rewrites[from], to)
+        }
+    }
+}
+
+func TestNameRewrites(t *testing.T) {
+    docker := fakeDNS(t, func(w dns.ResponseWriter, r *dns.Msg) {
+        if r.Question[0].Name != "postgres." {
+            m := new(dns.Msg)
+            m.SetRcode(r, dns.RcodeNameError)
+            w.WriteMsg(m)
+            return
+        }
+        answerA("172.17.0.5")(w, r)
+    })
+    p := testProxy(t, "DOCKER_DNS", docker, "NAME_REWRITES", "db.docker=postgres.docker")
+
+    m := query(p, "DB.docker.", dns.TypeA)
+    if ip := answerIP(m); ip != "172.17.0.5" {
+        t.Fatalf("got %v, want the answer for postgres.docker", m)
+    }
+    if name := m.Answer[0].Header().Name; name != "DB.docker." {
+        t.Errorf("answer owned by %s, want the queried DB.docker.", name)
+    }
+    if name := m.Question[0].Name; name != "DB.docker." {
+        t.Errorf("question %s, want the queried DB.docker.", name)
+    }
+}
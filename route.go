@@ -0,0 +1,78 @@
+package main
+
+import (
+    "context"
+    "strings"
+    "time"
+
+    "github.com/miekg/dns"
+)
+
+// Owner of the TXT naming the route a query took. It is in the CHAOS class
+// with a zero TTL so resolvers neither mix it up with real data nor cache it.
+const routeTXTName = "route.dns-proxy."
+
+// Owner of the TXT listing the sources with a record for a name
+const sourcesTXTName = "sources.dns-proxy."
+
+// Longest the Docker DNS query of traceSources may delay an answer the hosts
+// file already has
+const sourcesProbeTimeout = 250 * time.Millisecond
+
+// traceRoute adds a TXT to the additional section of m naming the rule that
+// routed the query and the resolvers it went to, e.g. "rule=regex ^db\."
+// and "resolver=127.0.0.11:53". It only does so at LOG_LEVEL=DEBUG.
+func (p *DNSProxy) traceRoute(m *dns.Msg, rule string, resolvers []string) {
+    if !p.logEnabled("DEBUG") {
+        return
+    }
+    resolver := strings.Join(resolvers, ",")
+    if resolver == "" {
+        resolver = "none"
+    }
+    m.Extra = append(m.Extra, &dns.TXT{
+        Hdr: dns.RR_Header{Name: routeTXTName, Rrtype: dns.TypeTXT, Class: dns.ClassCHAOS},
+        Txt: []string{"rule=" + rule, "resolver=" + resolver},
+    })
+}
+
+// traceSources adds a TXT to the additional section of m for a query the
+// hosts file answered, listing every source with a record for the name, e.g.
+// "answered=hosts" and "sources=hosts,docker", to see what the hosts entry
+// shadows. Docker DNS is asked for that, so it only happens at LOG_LEVEL=DEBUG.
+func (p *DNSProxy) traceSources(ctx context.Context, cfg *Config, m *dns.Msg, r *dns.Msg, domain string) {
+    if !p.logEnabled("DEBUG") {
+        return
+    }
+    question := r.Question[0]
+    name := normalizeHostName(domain, cfg.StripSuffixes)
+    sources := []string{"hosts"}
+    probe, cancel := context.WithTimeout(ctx, sourcesProbeTimeout)
+    defer cancel()
+    found, err := p.lookupDockerDNS(probe, cfg, new(dns.Msg), name, question.Qtype, nil)
+    if err != nil {
+        p.logDebug("Docker DNS query for the sources of %s failed: %v", domain, err)
+    }
+    if found {
+        sources = append(sources, "docker")
+    }
+    if _, ok := cfg.FallbackIPs[name]; ok {
+        sources = append(sources, "fallback-ips")
+    }
+    p.logDebug("Sources with a record for %s: %s", domain, strings.Join(sources, ", "))
+    m.Extra = append(m.Extra, &dns.TXT{
+        Hdr: dns.RR_Header{Name: sourcesTXTName, Rrtype: dns.TypeTXT, Class: dns.ClassCHAOS},
+        Txt: []string{"answered=hosts", "sources=" + strings.Join(sources, ",")},
+    })
+}
+
+// resolvers returns the servers a rule action sends domain to.
+func (c *Config) resolvers(action ruleAction, domain string, qtype uint16) []string {
+    switch action {
+    case ruleDocker:
+        return c.dockerDNSFor(qtype)
+    case ruleUpstream:
+        return c.upstreamsFor(domain)
+    }
+    return nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+    "strings"
+    "sync/atomic"
+    "testing"
+    "time"
+
+    "github.com/miekg/dns"
+)
+
+// traceTXT returns the strings of the TXT named name in the additional
+// section of m, or nil when there is none.
+func traceTXT(m *dns.Msg, name string) []string {
+    for _, rr := range m.Extra {
+        if txt, ok := rr.(*dns.TXT); ok && txt.Hdr.Name == name {
+            return txt.Txt
+        }
+    }
+    return nil
+}
+
+func TestTraceSourcesDockerDown(t *testing.T) {
+    silent := fakeDNS(t, func(w dns.ResponseWriter, r *dns.Msg) {})
+    p := testProxy(t, "DOCKER_DNS", silent, "LOG_LEVEL", "DEBUG", "TIMEOUT_SECONDS", "2",
+        "STATIC_HOSTS", "api.docker=10.0.0.5")
+
+    start := time.Now()
+    m := query(p, "api.docker.", dns.TypeA)
+    if took := time.Since(start); took > time.Second {
+        t.Errorf("hosts answer took %v waiting on Docker DNS", took)
+    }
+    if m == nil || len(m.Answer) != 1 {
+        t.Fatalf("got %v, want the hosts answer", m)
+    }
+    if sources := traceTXT(m, sourcesTXTName); len(sources) != 2 || sources[1] != "sources=hosts" {
+        t.Errorf("sources TXT %q, want only hosts", sources)
+    }
+    if n := atomic.LoadInt64(&p.errorCount); n != 0 {
+        t.Errorf("errorCount = %d after a failed sources probe, want 0", n)
+    }
+}
+
+
+func TestTraceRouteForRegexRule(t *testing.T) {
+    upstream := fakeDNS(t, answerA("192.0.2.1"))
+    for _, tt := range []struct {
+        level string
+        want  []string
+    }{
+        {"DEBUG", []string{`rule=regex ^api\.example\.$`, "resolver=" + upstream}},
+        {"INFO", nil},
+    } {
+        p := testProxy(t, "LOG_LEVEL", tt.level, "ENABLE_UPSTREAM", "true", "UPSTREAM_DNS", upstream,
+            "REGEX_RULES", `^api\.example\.$=upstream`)
+        m := query(p, "api.example.", dns.TypeA)
+        if ip := answerIP(m); ip != "192.0.2.1" {
+            t.Fatalf("LOG_LEVEL=%s: answer %q, want 192.0.2.1", tt.level, ip)
+        }
+        got := traceTXT(m, routeTXTName)
+        if len(got) != len(tt.want) || (len(got) == 2 && (got[0] != tt.want[0] || got[1] != tt.want[1])) {
+            t.Errorf("LOG_LEVEL=%s: route TXT %q, want %q", tt.level, got, tt.want)
+        }
+    }
+}
+
+func TestTraceSourcesListsMatches(t *testing.T) {
+    docker := fakeDNS(t, func(w dns.ResponseWriter, r *dns.Msg) {
+        if r.Question[0].Name != "web." {
+            m := new(dns.Msg)
+            m.SetRcode(r, dns.RcodeNameError)
+            w.WriteMsg(m)
+            return
+        }
+        answerA("172.17.0.2")(w, r)
+    })
+    for _, tt := range []struct {
+        level, name string
+        want        []string
+    }{
+        {"DEBUG", "web.docker.", []string{"answered=hosts", "sources=hosts,docker,fallback-ips"}},
+        {"DEBUG", "api.docker.", []string{"answered=hosts", "sources=hosts"}},
+        {"INFO", "web.docker.", nil},
+    } {
+        p := testProxy(t, "DOCKER_DNS", docker, "LOG_LEVEL", tt.level,
+            "STATIC_HOSTS", "web.docker=10.0.0.5,api.docker=10.0.0.6", "FALLBACK_IPS", "web.docker=10.0.0.9")
+        m := query(p, tt.name, dns.TypeA)
+        if m == nil || len(m.Answer) != 1 {
+            t.Fatalf("%s at %s: got %v, want the hosts answer", tt.name, tt.level, m)
+        }
+        got := traceTXT(m, sourcesTXTName)
+        if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+            t.Errorf("%s at %s: sources TXT %q, want %q", tt.name, tt.level, got, tt.want)
+        }
+    }
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+    "net"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/miekg/dns"
+)
+
+type rrlAction int
+
+const (
+    rrlAllow rrlAction = iota
+    rrlSlip            // answer with TC so a real client retries over TCP
+    rrlDrop
+)
+
+// Prefix lengths grouping clients into subnets
+const (
+    rrlSubnetBitsV4 = 24
+    rrlSubnetBitsV6 = 56
+)
+
+// clientSubnet returns the subnet a client's responses are limited under.
+func clientSubnet(ip net.IP) string {
+    if ip == nil {
+        return ""
+    }
+    if ip4 := ip.To4(); ip4 != nil {
+        return ip4.Mask(net.CIDRMask(rrlSubnetBitsV4, 32)).String()
+    }
+    return ip.Mask(net.CIDRMask(rrlSubnetBitsV6, 128)).String()
+}
+
+// Idle time after which a response bucket is forgotten
+const rrlIdleTimeout = time.Minute
+
+type rrlBucket struct {
+    tokens float64
+    last   time.Time
+    excess int
+}
+
+// responseLimiter implements response rate limiting: identical responses to
+// one client subnet are limited to a rate per second, mitigating reflection
+// attacks that spoof a victim's address.
+type responseLimiter struct {
+    mu        sync.Mutex
+    buckets   map[string]*rrlBucket
+    lastSweep time.Time
+}
+
+func newResponseLimiter() *responseLimiter {
+    return &responseLimiter{buckets: make(map[string]*rrlBucket)}
+}
+
+// rrlKey groups responses by client subnet, name, type and rcode. The name
+// is lower-cased so randomizing its case (0x20) doesn't get a fresh bucket.
+func rrlKey(subnet string, m *dns.Msg) string {
+    q := m.Question[0]
+    return subnet + "|" + strings.ToLower(q.Name) + "|" + strconv.Itoa(int(q.Qtype)) + "|" + strconv.Itoa(m.Rcode)
+}
+
+// check takes a token for key. Once out of tokens every slip-th excess
+// response is slipped and the rest dropped; slip 0 drops them all.
+func (l *responseLimiter) check(key string, rate float64, slip int, now time.Time) rrlAction {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+
+    if now.Sub(l.lastSweep) > rrlIdleTimeout {
+        for k, b := range l.buckets {
+            if now.Sub(b.last) > rrlIdleTimeout {
+                delete(l.buckets, k)
+            }
+        }
+        l.lastSweep = now
+    }
+
+    // A bucket holds at least one whole token, so rates below 1/s still
+    // let a response through now and then
+    burst := rate
+    if burst < 1 {
+        burst = 1
+    }
+
+    b, ok := l.buckets[key]
+    if !ok {
+        b = &rrlBucket{tokens: burst, last: now}
+        l.buckets[key] = b
+    }
+
+    b.tokens += now.Sub(b.last).Seconds() * rate
+    if b.tokens > burst {
+        b.tokens = burst
+    }
+    b.last = now
+
+    if b.tokens >= 1 {
+        b.tokens--
+        b.excess = 0
+        return rrlAllow
+    }
+
+    b.excess++
+    if slip > 0 && b.excess%slip == 0 {
+        return rrlSlip
+    }
+    return rrlDrop
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+    "net"
+    "sync/atomic"
+    "testing"
+    "time"
+
+    "github.com/miekg/dns"
+)
+
+func TestResponseRateLimit(t *testing.T) {
+    p := testProxy(t, "RRL_RESPONSES_PER_SEC", "5", "RRL_SLIP", "2", "HOST_INTERNAL_IP", "192.0.2.1")
+    ask := func(remote net.Addr) *dns.Msg {
+        r := new(dns.Msg)
+        r.SetQuestion(hostInternalName, dns.TypeA)
+        return queryFrom(p, remote, r)
+    }
+
+    // Spoofed sources spread over one /24 share the victim subnet's budget
+    answered, slipped, dropped := 0, 0, 0
+    for i := 0; i < 40; i++ {
+        switch m := ask(&net.UDPAddr{IP: net.IPv4(198, 51, 100, byte(i)), Port: 53}); {
+        case m == nil:
+            dropped++
+        case m.Truncated:
+            slipped++
+        default:
+            answered++
+        }
+    }
+    if answered < 5 || answered > 6 {
+        t.Errorf("%d of 40 identical responses sent, want about RRL_RESPONSES_PER_SEC 5", answered)
+    }
+    if slipped == 0 || dropped == 0 || slipped < dropped-2 || slipped > dropped+2 {
+        t.Errorf("%d slipped and %d dropped, want about half of the excess each with RRL_SLIP=2", slipped, dropped)
+    }
+    if n := atomic.LoadInt64(&p.rrlDropped); n != int64(dropped) {
+        t.Errorf("rrlDropped = %d, want %d", n, dropped)
+    }
+
+    if m := ask(&net.UDPAddr{IP: net.IPv4(203, 0, 113, 1), Port: 53}); m == nil || m.Truncated {
+        t.Errorf("client in another subnet got %v, want an answer", m)
+    }
+    if m := ask(&net.TCPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 53}); m == nil || m.Truncated {
+        t.Errorf("TCP client got %v, want an answer", m)
+    }
+}
+
+func TestResponseRateLimitIgnoresNameCase(t *testing.T) {
+    p := testProxy(t, "RRL_RESPONSES_PER_SEC", "5", "RRL_SLIP", "0", "HOST_INTERNAL_IP", "192.0.2.1")
+    remote := &net.UDPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 53}
+
+    // Randomizing the case (0x20) must not give each response its own bucket
+    answered := 0
+    for i := 0; i < 40; i++ {
+        name := []byte(hostInternalName)
+        for j := range name {
+            if i>>(j%6)&1 == 1 && name[j] >= 'a' && name[j] <= 'z' {
+                name[j] -= 'a' - 'A'
+            }
+        }
+        r := new(dns.Msg)
+        r.SetQuestion(string(name), dns.TypeA)
+        if m := queryFrom(p, remote, r); m != nil {
+            answered++
+        }
+    }
+    if answered < 5 || answered > 6 {
+        t.Errorf("%d of 40 mixed-case repeats answered, want about RRL_RESPONSES_PER_SEC 5", answered)
+    }
+}
+
+func TestResponseRateLimitBelowOnePerSecond(t *testing.T) {
+    l := newResponseLimiter()
+    now := time.Now()
+    if got := l.check("k", 0.5, 0, now); got != rrlAllow {
+        t.Fatalf("first response with RRL_RESPONSES_PER_SEC 0.5 got %v, want allowed", got)
+    }
+    if got := l.check("k", 0.5, 0, now.Add(time.Second)); got != rrlDrop {
+        t.Errorf("response after 1s got %v, want dropped", got)
+    }
+    if got := l.check("k", 0.5, 0, now.Add(3*time.Second)); got != rrlAllow {
+        t.Errorf("response after 3s got %v, want allowed again", got)
+    }
+}
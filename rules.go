@@ -0,0 +1,98 @@
+package main
+
+import (
+    "context"
+    "log"
+    "regexp"
+    "strings"
+
+    "github.com/miekg/dns"
+)
+
+// Longest pattern accepted in REGEX_RULES
+const maxRegexRuleLength = 256
+
+type ruleAction string
+
+const (
+    ruleDocker   ruleAction = "docker"
+    ruleUpstream ruleAction = "upstream"
+    ruleBlock    ruleAction = "block"
+)
+
+type regexRule struct {
+    pattern *regexp.Regexp
+    action  ruleAction
+}
+
+// getRegexRulesEnv parses a semicolon-separated list of pattern=action rules,
+// e.g. `^db[0-9]+\.docker\.$=docker;^ads\.=block`. Patterns are matched
+// against the lower-cased, fully qualified query name. Invalid rules are
+// skipped with a warning.
+func getRegexRulesEnv(key string) []regexRule {
+    var rules []regexRule
+    for _, entry := range strings.Split(getEnv(key, ""), ";") {
+        entry = strings.TrimSpace(entry)
+        if entry == "" {
+            continue
+        }
+
+        i := strings.LastIndex(entry, "=")
+        if i <= 0 {
+            log.Printf("Warning: Invalid rule in %s: %s, expected pattern=action", key, entry)
+            continue
+        }
+        pattern, action := entry[:i], ruleAction(strings.ToLower(entry[i+1:]))
+        if action != ruleDocker && action != ruleUpstream && action != ruleBlock {
+            log.Printf("Warning: Invalid action in %s: %s, expected docker, upstream or block", key, action)
+            continue
+        }
+        if len(pattern) > maxRegexRuleLength {
+            log.Printf("Warning: Pattern in %s longer than %d characters, skipping", key, maxRegexRuleLength)
+            continue
+        }
+
+        compiled, err := regexp.Compile(pattern)
+        if err != nil {
+            log.Printf("Warning: Invalid pattern in %s: %v", key, err)
+            continue
+        }
+        rules = append(rules, regexRule{pattern: compiled, action: action})
+    }
+    return rules
+}
+
+// matchRegexRule returns the first rule matching domain, if any.
+func (c *Config) matchRegexRule(domain string) *regexRule {
+    for i := range c.RegexRules {
+        if c.RegexRules[i].pattern.MatchString(domain) {
+            return &c.RegexRules[i]
+        }
+    }
+    return nil
+}
+
+func (p *DNSProxy) applyRegexRule(ctx context.Context, cfg *Config, rule *regexRule, m *dns.Msg, r *dns.Msg, domain string) (*dns.Msg, bool) {
+    p.logDebug("Query %s matched rule %s -> %s", domain, rule.pattern, rule.action)
+
+    switch rule.action {
+    case ruleDocker:
+        // Strip the suffix when present, otherwise ask for the name as-is
+        hostname := domain
+        if suffix := cfg.stripSuffix(domain); suffix != "" {
+            hostname = strings.TrimSuffix(domain, suffix+".")
+        }
+        return p.resolveDocker(ctx, cfg, m, r, domain, hostname)
+    case ruleUpstream:
+        return m, p.forwardToUpstream(ctx, cfg, m, r) != nil
+    }
+
+    m.SetRcode(r, dns.RcodeNameError)
+    return m, false
+}
+
+// k8sServiceSuffix is the suffix of Kubernetes service names, such as
+// .svc.cluster.local., routed to K8S_RESOLVER.
+func (c *Config) k8sServiceSuffix() string {
+    return ".svc." + strings.ToLower(dns.Fqdn(strings.Trim(c.K8sDomain, ".")))
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+    "sync/atomic"
+    "testing"
+
+    "github.com/miekg/dns"
+)
+
+func TestRegexRules(t *testing.T) {
+    asked := make(chan string, 1)
+    docker := fakeDNS(t, func(w dns.ResponseWriter, r *dns.Msg) {
+        asked <- r.Question[0].Name
+        answerA("172.17.0.2")(w, r)
+    })
+    var upstreamQueries int64
+    upstream := countingDNS(t, 0, &upstreamQueries)
+    p := testProxy(t, "DOCKER_DNS", docker, "ENABLE_UPSTREAM", "true", "UPSTREAM_DNS", upstream,
+        "REGEX_RULES", `^db[0-9]+\.docker\.$=docker;^ads\.=block`)
+
+    if ip := answerIP(query(p, "db12.docker.", dns.TypeA)); ip != "172.17.0.2" {
+        t.Errorf("db12.docker. answered %q, want Docker's 172.17.0.2", ip)
+    }
+    if name := <-asked; name != "db12." {
+        t.Errorf("Docker DNS asked for %q, want db12.", name)
+    }
+
+    m := query(p, "ads.example.com.", dns.TypeA)
+    if m == nil || m.Rcode != dns.RcodeNameError || len(m.Answer) != 0 {
+        t.Errorf("blocked name got %v, want an empty NXDOMAIN", m)
+    }
+    if n := atomic.LoadInt64(&upstreamQueries); n != 0 {
+        t.Errorf("blocked name reached the upstream %d times", n)
+    }
+
+    if ip := answerIP(query(p, "www.example.com.", dns.TypeA)); ip != "192.0.2.1" {
+        t.Errorf("unmatched name answered %q, want the upstream's 192.0.2.1", ip)
+    }
+}
+
+func TestGetRegexRulesEnv(t *testing.T) {
+    t.Setenv("TEST_RULES", `^a\.=docker; ^b\.=redirect ;^(c\.=block;=upstream;^d\.=UPSTREAM`)
+    rules := getRegexRulesEnv("TEST_RULES")
+    if len(rules) != 2 {
+        t.Fatalf("got %d rules, want the 2 valid ones", len(rules))
+    }
+    if rules[0].action != ruleDocker || rules[1].action != ruleUpstream || rules[1].pattern.String() != `^d\.` {
+        t.Errorf("got rules %v", rules)
+    }
+}
+
+func TestPassthroughSuffixes(t *testing.T) {
+    var dockerQueries int64
+    docker := countingDNS(t, 0, &dockerQueries)
+    asked := make(chan string, 1)
+    upstream := fakeDNS(t, func(w dns.ResponseWriter, r *dns.Msg) {
+        asked <- r.Question[0].Name
+        answerA("198.51.100.7")(w, r)
+    })
+    p := testProxy(t, "DOCKER_DNS", docker, "ENABLE_UPSTREAM", "true", "UPSTREAM_DNS", upstream,
+        "PASSTHROUGH_SUFFIXES", ".corp.docker")
+
+    if ip := answerIP(query(p, "db.corp.docker.", dns.TypeA)); ip != "198.51.100.7" {
+        t.Errorf("passthrough name answered %q, want the upstream's 198.51.100.7", ip)
+    }
+    if name := <-asked; name != "db.corp.docker." {
+        t.Errorf("upstream asked for %q, want the name untouched", name)
+    }
+    if n := atomic.LoadInt64(&dockerQueries); n != 0 {
+        t.Errorf("Docker DNS got %d queries for a passthrough name", n)
+    }
+}
+
+func TestK8sResolver(t *testing.T) {
+    asked := make(chan string, 1)
+    k8s := fakeDNS(t, func(w dns.ResponseWriter, r *dns.Msg) {
+        asked <- r.Question[0].Name
+        answerA("10.96.0.20")(w, r)
+    })
+    var upstreamQueries int64
+    upstream := countingDNS(t, 0, &upstreamQueries)
+    p := testProxy(t, "ENABLE_UPSTREAM", "true", "UPSTREAM_DNS", upstream, "K8S_RESOLVER", k8s)
+
+    if ip := answerIP(query(p, "web.default.svc.cluster.local.", dns.TypeA)); ip != "10.96.0.20" {
+        t.Errorf("service name answered %q, want the Kubernetes resolver's 10.96.0.20", ip)
+    }
+    if name := <-asked; name != "web.default.svc.cluster.local." {
+        t.Errorf("Kubernetes resolver asked for %q", name)
+    }
+    if ip := answerIP(query(p, "cluster.local.example.com.", dns.TypeA)); ip != "192.0.2.1" {
+        t.Errorf("other name answered %q, want the upstream's 192.0.2.1", ip)
+    }
+    if n := atomic.LoadInt64(&upstreamQueries); n != 1 {
+        t.Errorf("upstream got %d queries, want only the other name", n)
+    }
+}
+
+func TestStrictZones(t *testing.T) {
+    var upstreamCount int64
+    upstream := countingDNS(t, 0, &upstreamCount)
+    docker := fakeDNS(t, answerA("172.17.0.2"))
+
+    for _, tt := range []struct {
+        strict, upstream string
+        rcode            int
+    }{
+        {"true", "false", dns.RcodeRefused},
+        {"true", "true", dns.RcodeRefused},
+        {"false", "false", dns.RcodeNameError},
+    } {
+        p := testProxy(t, "DOCKER_DNS", docker, "STRICT_ZONES", tt.strict,
+            "ENABLE_UPSTREAM", tt.upstream, "UPSTREAM_DNS", upstream)
+        if m := query(p, "example.com.", dns.TypeA); m == nil || m.Rcode != tt.rcode {
+            t.Errorf("STRICT_ZONES=%s ENABLE_UPSTREAM=%s: got %v, want %s", tt.strict, tt.upstream, m, dns.RcodeToString[tt.rcode])
+        }
+        if ip := answerIP(query(p, "web.docker.", dns.TypeA)); ip != "172.17.0.2" {
+            t.Errorf("STRICT_ZONES=%s: in-zone answer %q, want 172.17.0.2", tt.strict, ip)
+        }
+    }
+    if n := atomic.LoadInt64(&upstreamCount); n != 0 {
+        t.Errorf("upstream got %d queries for names outside the zones, want 0", n)
+    }
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+    "fmt"
+    "strings"
+
+    "github.com/miekg/dns"
+)
+
+// checkResponse reports what is wrong with m as the reply to r: a question
+// or ID that doesn't match, answers other than an alias chain on NXDOMAIN,
+// empty records, or a message that doesn't pack. It guards the client against
+// a bug anywhere in the pipeline assembling the response.
+func checkResponse(r, m *dns.Msg) error {
+    if m.Id != r.Id || !m.Response {
+        return fmt.Errorf("reply ID %d does not answer query ID %d", m.Id, r.Id)
+    }
+    if len(m.Question) != len(r.Question) {
+        return fmt.Errorf("reply has %d questions, query %d", len(m.Question), len(r.Question))
+    }
+    for i, q := range m.Question {
+        asked := r.Question[i]
+        if !strings.EqualFold(q.Name, asked.Name) || q.Qtype != asked.Qtype || q.Qclass != asked.Qclass {
+            return fmt.Errorf("reply question %s does not match %s", q.String(), asked.String())
+        }
+    }
+
+    for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+        for _, rr := range section {
+            if rr == nil {
+                return fmt.Errorf("reply has an empty record")
+            }
+        }
+    }
+    if m.Rcode == dns.RcodeNameError {
+        for _, rr := range m.Answer {
+            if t := rr.Header().Rrtype; t != dns.TypeCNAME && t != dns.TypeDNAME {
+                return fmt.Errorf("NXDOMAIN reply has a %s answer", dns.TypeToString[t])
+            }
+        }
+    }
+
+    if _, err := m.Pack(); err != nil {
+        return fmt.Errorf("reply does not pack: %v", err)
+    }
+    return nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+    "testing"
+
+    "github.com/miekg/dns"
+)
+
+func TestSanityCheck(t *testing.T) {
+    for _, tt := range []struct {
+        name    string
+        corrupt func(req, resp *dns.Msg)
+    }{
+        {"answers on NXDOMAIN", func(req, resp *dns.Msg) {
+            resp.Rcode = dns.RcodeNameError
+        }},
+        {"other question", func(req, resp *dns.Msg) {
+            resp.Question[0].Name = "elsewhere.docker."
+        }},
+        {"other ID", func(req, resp *dns.Msg) {
+            resp.Id = req.Id + 1
+        }},
+        {"empty record", func(req, resp *dns.Msg) {
+            resp.Answer = append(resp.Answer, nil)
+        }},
+    } {
+        for _, check := range []string{"true", "false"} {
+            p := testProxy(t, "STATIC_HOSTS", "web.docker=10.0.0.99", "SANITY_CHECK", check)
+            p.AddResponseFilter(ResponseFilterFunc(tt.corrupt))
+            m := query(p, "web.docker.", dns.TypeA)
+            if m == nil {
+                t.Fatalf("%s, SANITY_CHECK=%s: no response", tt.name, check)
+            }
+            servfail := m.Rcode == dns.RcodeServerFailure && len(m.Answer) == 0
+            if want := check == "true"; servfail != want {
+                t.Errorf("%s, SANITY_CHECK=%s: got %v, want SERVFAIL %v", tt.name, check, m, want)
+            }
+        }
+    }
+
+    // An intact response passes
+    p := testProxy(t, "STATIC_HOSTS", "web.docker=10.0.0.99", "SANITY_CHECK", "true")
+    if ip := answerIP(query(p, "web.docker.", dns.TypeA)); ip != "10.0.0.99" {
+        t.Errorf("intact response answered %q, want 10.0.0.99", ip)
+    }
+}
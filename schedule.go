@@ -0,0 +1,173 @@
+package main
+
+import (
+    "fmt"
+    "log"
+    "strings"
+    "time"
+)
+
+const (
+    minutesPerDay  = 24 * 60
+    minutesPerWeek = 7 * minutesPerDay
+)
+
+var weekdays = map[string]time.Weekday{
+    "sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+    "thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// scheduleRule sends upstream queries to its own upstreams during a weekly
+// time window.
+type scheduleRule struct {
+    window    string
+    days      [7]bool
+    start     int // minutes after midnight
+    end       int // minutes after midnight, before start when the window spans midnight
+    upstreams []string
+}
+
+func (r scheduleRule) String() string {
+    return r.window + "=" + strings.Join(r.upstreams, ",")
+}
+
+// getScheduleRulesEnv parses a semicolon-separated list of window=upstreams
+// rules, e.g. `mon-fri 09:00-18:00=10.0.0.53,10.0.0.54;sat 22:00-02:00=...`.
+// The days are optional and default to every day. Upstreams without a port
+// get the one of UPSTREAM_PROTOCOL. Invalid rules are skipped with a warning.
+func getScheduleRulesEnv(key, port string) []scheduleRule {
+    var rules []scheduleRule
+    for _, entry := range strings.Split(getEnv(key, ""), ";") {
+        entry = strings.TrimSpace(entry)
+        if entry == "" {
+            continue
+        }
+
+        i := strings.Index(entry, "=")
+        if i <= 0 {
+            log.Printf("Warning: Invalid rule in %s: %s, expected window=upstreams", key, entry)
+            continue
+        }
+        rule, err := parseScheduleWindow(strings.TrimSpace(entry[:i]))
+        if err != nil {
+            log.Printf("Warning: Invalid window in %s: %v", key, err)
+            continue
+        }
+        for _, upstream := range strings.Split(entry[i+1:], ",") {
+            if upstream = strings.TrimSpace(upstream); upstream != "" {
+                rule.upstreams = append(rule.upstreams, upstream)
+            }
+        }
+        if len(rule.upstreams) == 0 {
+            log.Printf("Warning: No upstreams for %s in %s, skipping", rule.window, key)
+            continue
+        }
+        rule.upstreams = withDefaultPort(rule.upstreams, port)
+        rules = append(rules, rule)
+    }
+    return rules
+}
+
+// parseScheduleWindow parses "[day[-day]] HH:MM-HH:MM".
+func parseScheduleWindow(window string) (scheduleRule, error) {
+    rule := scheduleRule{window: window}
+    fields := strings.Fields(strings.ToLower(window))
+    switch len(fields) {
+    case 1:
+        for d := range rule.days {
+            rule.days[d] = true
+        }
+    case 2:
+        from, to := fields[0], fields[0]
+        if i := strings.Index(fields[0], "-"); i >= 0 {
+            from, to = fields[0][:i], fields[0][i+1:]
+        }
+        first, ok1 := weekdays[from]
+        last, ok2 := weekdays[to]
+        if !ok1 || !ok2 {
+            return rule, fmt.Errorf("%q: unknown days %s", window, fields[0])
+        }
+        for d := first; ; d = (d + 1) % 7 {
+            rule.days[d] = true
+            if d == last {
+                break
+            }
+        }
+    default:
+        return rule, fmt.Errorf("%q: expected [days] HH:MM-HH:MM", window)
+    }
+
+    times := fields[len(fields)-1]
+    i := strings.Index(times, "-")
+    if i < 0 {
+        return rule, fmt.Errorf("%q: expected HH:MM-HH:MM", window)
+    }
+    var err error
+    if rule.start, err = parseClock(times[:i]); err != nil {
+        return rule, fmt.Errorf("%q: %v", window, err)
+    }
+    if rule.end, err = parseClock(times[i+1:]); err != nil {
+        return rule, fmt.Errorf("%q: %v", window, err)
+    }
+    if rule.start == rule.end {
+        return rule, fmt.Errorf("%q: empty window", window)
+    }
+    return rule, nil
+}
+
+func parseClock(s string) (int, error) {
+    t, err := time.Parse("15:04", s)
+    if err != nil {
+        return 0, fmt.Errorf("invalid time %s", s)
+    }
+    return t.Hour()*60 + t.Minute(), nil
+}
+
+// active reports whether now falls in the window. A window spanning midnight
+// belongs to the day it starts on.
+func (r scheduleRule) active(now time.Time) bool {
+    minute := int(now.Weekday())*minutesPerDay + now.Hour()*60 + now.Minute()
+    length := (r.end - r.start + minutesPerDay) % minutesPerDay
+    for d, on := range r.days {
+        if !on {
+            continue
+        }
+        if (minute-(d*minutesPerDay+r.start)+minutesPerWeek)%minutesPerWeek < length {
+            return true
+        }
+    }
+    return false
+}
+
+// scheduledUpstreams returns the upstreams of the first SCHEDULE_RULES window
+// now falls in, or UPSTREAM_DNS outside of every window. Windows are in the
+// location of now, the server's local time (set with TZ) for time.Now.
+func (c *Config) scheduledUpstreams(now time.Time) []string {
+    for _, rule := range c.ScheduleRules {
+        if rule.active(now) {
+            return rule.upstreams
+        }
+    }
+    return c.UpstreamDNS
+}
+
+// allUpstreams returns UPSTREAM_DNS and the upstreams of every SCHEDULE_RULES
+// window, each once, for the health checks and stats that cover every
+// upstream a query may go to.
+func (c *Config) allUpstreams() []string {
+    seen := make(map[string]bool)
+    var upstreams []string
+    add := func(servers []string) {
+        for _, server := range servers {
+            if !seen[server] {
+                seen[server] = true
+                upstreams = append(upstreams, server)
+            }
+        }
+    }
+    add(c.UpstreamDNS)
+    for _, rule := range c.ScheduleRules {
+        add(rule.upstreams)
+    }
+    return upstreams
+}
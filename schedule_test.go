@@ -0,0 +1,111 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "net/http"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/miekg/dns"
+)
+
+func TestScheduleWindowBoundaries(t *testing.T) {
+    t.Setenv("UPSTREAM_DNS", "10.0.0.1")
+    t.Setenv("SCHEDULE_RULES", "mon-fri 09:00-18:00=10.0.0.53;sat 22:00-02:00=10.0.0.54:5353")
+    cfg := loadConfig()
+
+    at := func(day, hour, minute int) time.Time {
+        // 12 October 2026 is a Monday
+        return time.Date(2026, 10, day, hour, minute, 0, 0, time.UTC)
+    }
+    for _, tt := range []struct {
+        now  time.Time
+        want string
+    }{
+        {at(12, 8, 59), "10.0.0.1:53"},
+        {at(12, 9, 0), "10.0.0.53:53"},
+        {at(12, 17, 59), "10.0.0.53:53"},
+        {at(12, 18, 0), "10.0.0.1:53"},
+        {at(16, 12, 0), "10.0.0.53:53"},
+        {at(17, 12, 0), "10.0.0.1:53"},
+        {at(17, 21, 59), "10.0.0.1:53"},
+        {at(17, 22, 0), "10.0.0.54:5353"},
+        // A window spanning midnight runs into the next day
+        {at(18, 1, 59), "10.0.0.54:5353"},
+        {at(18, 2, 0), "10.0.0.1:53"},
+        // but only from the days it starts on
+        {at(13, 1, 0), "10.0.0.1:53"},
+    } {
+        if got := strings.Join(cfg.scheduledUpstreams(tt.now), ","); got != tt.want {
+            t.Errorf("%s: upstreams %s, want %s", tt.now.Format("Mon 15:04"), got, tt.want)
+        }
+    }
+}
+
+func TestParseScheduleWindow(t *testing.T) {
+    for _, window := range []string{"09:00", "mon 09:00-09:00", "funday 09:00-18:00", "mon-fri 9-18", "mon fri 09:00-18:00"} {
+        if _, err := parseScheduleWindow(window); err == nil {
+            t.Errorf("parseScheduleWindow(%q) accepted an invalid window", window)
+        }
+    }
+    rule, err := parseScheduleWindow("fri-mon 22:00-06:00")
+    if err != nil {
+        t.Fatal(err)
+    }
+    want := [7]bool{true, true, false, false, false, true, true}
+    if rule.days != want || rule.start != 22*60 || rule.end != 6*60 {
+        t.Errorf("got days %v from %d to %d, want Fri-Mon from 1320 to 360", rule.days, rule.start, rule.end)
+    }
+}
+
+func TestAllUpstreams(t *testing.T) {
+    t.Setenv("UPSTREAM_DNS", "10.0.0.1,10.0.0.2")
+    t.Setenv("SCHEDULE_RULES", "mon-fri 09:00-18:00=10.0.0.53,10.0.0.1;sat 22:00-02:00=10.0.0.54,10.0.0.53")
+    cfg := loadConfig()
+
+    want := "10.0.0.1:53,10.0.0.2:53,10.0.0.53:53,10.0.0.54:53"
+    if got := strings.Join(cfg.allUpstreams(), ","); got != want {
+        t.Errorf("got %s, want %s", got, want)
+    }
+}
+
+// An upstream only named in SCHEDULE_RULES is health-checked and listed in
+// the status like the UPSTREAM_DNS ones.
+func TestScheduledUpstreamsChecked(t *testing.T) {
+    healthy := fakeDNS(t, answerA("192.0.2.1"))
+    broken := fakeDNS(t, func(w dns.ResponseWriter, r *dns.Msg) {
+        w.Write([]byte{0, 1, 2})
+    })
+    p := testProxy(t, "ENABLE_UPSTREAM", "true", "UPSTREAM_DNS", healthy,
+        "SCHEDULE_RULES", "sun 03:00-04:00="+broken, "UPSTREAM_HEALTHCHECK_INTERVAL", "1",
+        "ADMIN_TOKEN", testAdminToken)
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+    go p.checkUpstreams(ctx)
+
+    deadline := time.Now().Add(3 * time.Second)
+    for p.upstreamHealthy(broken) {
+        if time.Now().After(deadline) {
+            t.Fatalf("scheduled upstream %s was never health-checked", broken)
+        }
+        time.Sleep(10 * time.Millisecond)
+    }
+    if !p.upstreamHealthy(healthy) {
+        t.Errorf("%s is unhealthy, want healthy", healthy)
+    }
+
+    var status struct {
+        Inflight map[string]int `json:"inflight"`
+    }
+    w := adminRequest(p, http.MethodGet, "/status")
+    if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+        t.Fatalf("status %s: %v", w.Body, err)
+    }
+    for _, upstream := range []string{healthy, broken} {
+        if _, ok := status.Inflight[upstream]; !ok {
+            t.Errorf("status lists in-flight queries for %v, want %s too", status.Inflight, upstream)
+        }
+    }
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+    "context"
+    "sort"
+    "strings"
+    "sync/atomic"
+
+    "github.com/miekg/dns"
+)
+
+// queryShadow sends a copy of request to SHADOW_UPSTREAM and logs when its
+// answer differs from want, the answerSummary of the reply the client got,
+// taken before the response pipeline goes on changing it. The shadow reply
+// is never returned, which makes it safe for qualifying a replacement
+// resolver.
+func (p *DNSProxy) queryShadow(cfg *Config, request *dns.Msg, want string) {
+    ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeout)
+    defer cancel()
+
+    domain := request.Question[0].Name
+    atomic.AddInt64(&p.shadowQueries, 1)
+    shadow, err := p.exchange(ctx, cfg, request, cfg.ShadowUpstream)
+    if err != nil {
+        atomic.AddInt64(&p.shadowMismatches, 1)
+        p.logInfo("Shadow upstream %s failed for %s: %v", cfg.ShadowUpstream, domain, err)
+        return
+    }
+
+    if got := answerSummary(shadow); got != want {
+        atomic.AddInt64(&p.shadowMismatches, 1)
+        p.logInfo("Shadow upstream %s differs for %s: got %q, upstream answered %q", cfg.ShadowUpstream, domain, got, want)
+    }
+}
+
+// answerSummary describes the rcode and answer records of m, ignoring TTLs
+// and record order so equivalent answers compare equal.
+func answerSummary(m *dns.Msg) string {
+    records := make([]string, 0, len(m.Answer))
+    for _, rr := range m.Answer {
+        rr = dns.Copy(rr)
+        rr.Header().Ttl = 0
+        records = append(records, strings.ToLower(rr.String()))
+    }
+    sort.Strings(records)
+    return dns.RcodeToString[m.Rcode] + " " + strings.Join(records, "; ")
+}
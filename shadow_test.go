@@ -0,0 +1,84 @@
+package main
+
+import (
+    "strings"
+    "sync"
+    "sync/atomic"
+    "testing"
+    "time"
+
+    "github.com/miekg/dns"
+)
+
+// The shadow comparison runs while the response pipeline still edits the
+// answers the client gets, go test -race catches any sharing between them.
+func TestShadowDoesNotShareReply(t *testing.T) {
+    handler := func(w dns.ResponseWriter, r *dns.Msg) {
+        m := new(dns.Msg)
+        m.SetReply(r)
+        for _, ip := range []string{"192.0.2.3", "192.0.2.1", "192.0.2.2"} {
+            rr, _ := dns.NewRR(r.Question[0].Name + " 30 IN A " + ip)
+            m.Answer = append(m.Answer, rr)
+        }
+        w.WriteMsg(m)
+    }
+    p := testProxy(t,
+        "ENABLE_UPSTREAM", "true",
+        "UPSTREAM_DNS", fakeDNS(t, handler),
+        "SHADOW_UPSTREAM", fakeDNS(t, handler),
+        "SORT_ANSWERS", "true",
+        "NAME_REWRITES", "alias.example=target.example")
+
+    var wg sync.WaitGroup
+    for i := 0; i < 20; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            if m := query(p, "alias.example.", dns.TypeA); len(m.Answer) != 3 {
+                t.Errorf("got %d answers, want 3", len(m.Answer))
+            }
+        }()
+    }
+    wg.Wait()
+
+    deadline := time.Now().Add(2 * time.Second)
+    for atomic.LoadInt64(&p.shadowQueries) < 20 && time.Now().Before(deadline) {
+        time.Sleep(10 * time.Millisecond)
+    }
+    time.Sleep(50 * time.Millisecond)
+    if mismatches := atomic.LoadInt64(&p.shadowMismatches); mismatches != 0 {
+        t.Errorf("got %d shadow mismatches, want 0", mismatches)
+    }
+}
+
+func TestShadowMismatchLogged(t *testing.T) {
+    var shadowQueried int64
+    shadow := fakeDNS(t, func(w dns.ResponseWriter, r *dns.Msg) {
+        atomic.AddInt64(&shadowQueried, 1)
+        answerA("198.51.100.9")(w, r)
+    })
+    p := testProxy(t,
+        "ENABLE_UPSTREAM", "true",
+        "UPSTREAM_DNS", fakeDNS(t, answerA("192.0.2.1")),
+        "SHADOW_UPSTREAM", shadow)
+    logs := captureLog(t)
+
+    m := query(p, "example.com.", dns.TypeA)
+    if len(m.Answer) != 1 || m.Answer[0].(*dns.A).A.String() != "192.0.2.1" {
+        t.Fatalf("got %v, want the upstream answer 192.0.2.1", m.Answer)
+    }
+
+    deadline := time.Now().Add(2 * time.Second)
+    for atomic.LoadInt64(&p.shadowMismatches) == 0 && time.Now().Before(deadline) {
+        time.Sleep(10 * time.Millisecond)
+    }
+    if n := atomic.LoadInt64(&shadowQueried); n != 1 {
+        t.Errorf("shadow got %d queries, want 1", n)
+    }
+    if n := atomic.LoadInt64(&p.shadowMismatches); n != 1 {
+        t.Fatalf("got %d shadow mismatches, want 1", n)
+    }
+    if out := logs.String(); !strings.Contains(out, "differs for example.com.") || !strings.Contains(out, "198.51.100.9") {
+        t.Errorf("mismatch not logged:\n%s", out)
+    }
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+    "context"
+    "log"
+    "net/http"
+    "sync/atomic"
+    "time"
+)
+
+// How often drain checks whether the in-flight queries have finished
+const drainPollInterval = 10 * time.Millisecond
+
+func (p *DNSProxy) isDraining() bool {
+    return atomic.LoadInt32(&p.draining) == 1
+}
+
+// idle reports whether no query is being answered or waiting in the worker
+// pool's queue.
+func (p *DNSProxy) idle() bool {
+    if p.pool != nil && atomic.LoadInt64(&p.pool.pending) > 0 {
+        return false
+    }
+    return atomic.LoadInt64(&p.active) == 0
+}
+
+// inFlight counts the queries being answered and those queued for a worker.
+func (p *DNSProxy) inFlight() int64 {
+    n := atomic.LoadInt64(&p.active)
+    if p.pool != nil {
+        n += int64(len(p.pool.jobs))
+    }
+    return n
+}
+
+// drain makes new queries get REFUSED, so clients move on to their next
+// resolver, and waits up to timeout for the queries being answered or
+// queued to finish. It reports whether they all did.
+func (p *DNSProxy) drain(timeout time.Duration) bool {
+    atomic.StoreInt32(&p.draining, 1)
+
+    deadline := time.Now().Add(timeout)
+    for !p.idle() {
+        if time.Now().After(deadline) {
+            return false
+        }
+        time.Sleep(drainPollInterval)
+    }
+    return true
+}
+
+// shutdown stops the proxy in a fixed order: drain in-flight queries, close
+// the listeners, stop background tasks, then write the final stats and close
+// the query log. From the first step on new queries are refused.
+func (p *DNSProxy) shutdown(timeout time.Duration, servers []*listener, httpServers []*http.Server, stopBackground context.CancelFunc) {
+    log.Println("Draining in-flight queries...")
+    if !p.drain(timeout) {
+        log.Printf("Warning: %d queries still in flight after %v", p.inFlight(), timeout)
+    }
+
+    log.Println("Shutting down DNS server...")
+    ctx, cancel := context.WithTimeout(context.Background(), timeout)
+    defer cancel()
+    for _, server := range servers {
+        if err := server.shutdown(ctx); err != nil {
+            log.Printf("Error shutting down %s listener: %v", server.net, err)
+        }
+    }
+    for _, server := range httpServers {
+        if server == nil {
+            continue
+        }
+        if err := server.Shutdown(ctx); err != nil {
+            log.Printf("Error shutting down HTTP server on %s: %v", server.Addr, err)
+        }
+    }
+
+    stopBackground()
+
+    p.printStats()
+    if err := p.queryLog.reopen(""); err != nil {
+        log.Printf("Error closing query log: %v", err)
+    }
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+    "net"
+    "net/http"
+    "sync/atomic"
+    "testing"
+    "time"
+
+    "github.com/miekg/dns"
+)
+
+func TestShutdownOrder(t *testing.T) {
+    docker := fakeDNS(t, func(w dns.ResponseWriter, r *dns.Msg) {
+        time.Sleep(300 * time.Millisecond)
+        answerA("172.17.0.2")(w, r)
+    })
+    p := testProxy(t, "DOCKER_DNS", docker)
+
+    pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    addr := pc.LocalAddr().String()
+    pc.Close()
+    started := make(chan struct{})
+    l := newListener(func() *dns.Server {
+        return &dns.Server{Addr: addr, Net: "udp", Handler: dns.HandlerFunc(p.handleRequest),
+            NotifyStartedFunc: func() { close(started) }}
+    })
+    served := make(chan error, 1)
+    go func() { served <- l.serve(0) }()
+    <-started
+
+    answered := make(chan *dns.Msg, 1)
+    go func() {
+        r := new(dns.Msg)
+        r.SetQuestion("web.docker.", dns.TypeA)
+        m, _, err := (&dns.Client{Timeout: 2 * time.Second}).Exchange(r, addr)
+        if err != nil {
+            t.Errorf("in-flight query: %v", err)
+        }
+        answered <- m
+    }()
+    for atomic.LoadInt64(&p.active) == 0 {
+        time.Sleep(time.Millisecond)
+    }
+
+    var stoppedWithActive int64 = -1
+    var listenerStopped bool
+    shutdownDone := make(chan struct{})
+    go func() {
+        p.shutdown(2*time.Second, []*listener{l}, []*http.Server{nil}, func() {
+            stoppedWithActive = atomic.LoadInt64(&p.active)
+            _, listenerStopped = l.current()
+        })
+        close(shutdownDone)
+    }()
+
+    for !p.isDraining() {
+        time.Sleep(time.Millisecond)
+    }
+    r := new(dns.Msg)
+    r.SetQuestion("late.docker.", dns.TypeA)
+    if m, _, err := (&dns.Client{Timeout: time.Second}).Exchange(r, addr); err != nil || m.Rcode != dns.RcodeRefused {
+        t.Errorf("query while draining: got %v, %v, want REFUSED", m, err)
+    }
+
+    if m := <-answered; m == nil || answerIP(m) != "172.17.0.2" {
+        t.Errorf("in-flight query got %v, want its answer despite the shutdown", m)
+    }
+    <-shutdownDone
+    if err := <-served; err != nil {
+        t.Errorf("listener: %v", err)
+    }
+    if stoppedWithActive != 0 {
+        t.Errorf("background tasks stopped with %d queries in flight, want 0", stoppedWithActive)
+    }
+    if !listenerStopped {
+        t.Error("background tasks stopped before the listener")
+    }
+}
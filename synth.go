@@ -0,0 +1,206 @@
+package main
+
+import (
+    "context"
+    "log"
+    "net"
+    "strings"
+    "sync/atomic"
+
+    "github.com/miekg/dns"
+)
+
+// Names Docker Desktop provides for reaching the host and the gateway
+const (
+    hostInternalName    = "host.docker.internal."
+    gatewayInternalName = "gateway.docker.internal."
+)
+
+// answerInternalName handles host.docker.internal and gateway.docker.internal
+// regardless of the configured strip suffix. When an IP is configured for the
+// name it is answered directly, otherwise the full name is passed to Docker
+// DNS, which knows it on Docker Desktop. failed reports a Docker DNS query
+// that got no reply, answered with SERVFAIL as resolveDocker does.
+func (p *DNSProxy) answerInternalName(ctx context.Context, cfg *Config, m *dns.Msg, domain string, qtype uint16, opt *dns.OPT) (handled, failed bool) {
+    var configured string
+    switch domain {
+    case hostInternalName:
+        configured = cfg.HostInternalIP
+    case gatewayInternalName:
+        configured = cfg.GatewayInternalIP
+        if configured == "" {
+            configured = cfg.HostInternalIP
+        }
+    default:
+        return false, false
+    }
+
+    if configured == "" {
+        p.logDebug("No IP configured for %s, querying Docker DNS", domain)
+        found, err := p.queryDockerDNS(ctx, cfg, m, domain, qtype, opt)
+        switch {
+        case err != nil:
+            m.Rcode = dns.RcodeServerFailure
+        case !found:
+            m.Rcode = dns.RcodeNameError
+        }
+        return true, err != nil
+    }
+
+    ip := net.ParseIP(configured)
+    if ip == nil {
+        p.logError("Invalid IP configured for %s: %s", domain, configured)
+        m.Rcode = dns.RcodeServerFailure
+        return true, false
+    }
+
+    if rr := addressRecord(domain, qtype, ip, cfg.SyntheticTTL); rr != nil {
+        m.Answer = append(m.Answer, rr)
+    }
+    p.logDebug("Answered %s with configured IP %s", domain, configured)
+    return true, false
+}
+
+// addressRecord returns an A or AAAA record for ip if it matches qtype, or nil
+// when the address family doesn't fit the question.
+func addressRecord(name string, qtype uint16, ip net.IP, ttl uint32) dns.RR {
+    hdr := dns.RR_Header{Name: name, Class: dns.ClassINET, Ttl: ttl}
+    if ip4 := ip.To4(); ip4 != nil {
+        if qtype != dns.TypeA {
+            return nil
+        }
+        hdr.Rrtype = dns.TypeA
+        return &dns.A{Hdr: hdr, A: ip4}
+    }
+    if qtype != dns.TypeAAAA {
+        return nil
+    }
+    hdr.Rrtype = dns.TypeAAAA
+    return &dns.AAAA{Hdr: hdr, AAAA: ip}
+}
+
+// Prefix of the name answering with the list of enabled features, placed
+// under the strip suffix, e.g. _features.dns-proxy.docker
+const featuresNamePrefix = "_features.dns-proxy"
+
+// features lists the optional behaviour enabled by the configuration.
+func (c *Config) features() []string {
+    var features []string
+    add := func(enabled bool, name string) {
+        if enabled {
+            features = append(features, name)
+        }
+    }
+    add(c.CacheEnabled, "cache")
+    add(c.CacheEnabled && c.StaleIfErrorTTL > 0, "stale-if-error")
+    add(c.CacheEnabled && c.NegativeCacheTTL > 0, "negative-cache")
+    add(c.CacheEnabled && c.CacheRefreshAhead > 0, "refresh-ahead")
+    add(c.CacheEnabled && c.PrefetchThreshold > 0, "prefetch")
+    add(c.EnableUpstream, "upstream")
+    add(c.EnableUpstream && c.EmptyUpstreamRetry, "empty-upstream-retry")
+    add(c.EnableUpstream && c.FallbackToUpstream, "fallback-to-upstream")
+    add(c.EnableUpstream && c.FallbackToUpstream && c.ParallelResolve, "parallel-resolve")
+    add(c.EnableUpstream && c.UpstreamProtocol == protocolDoT, "upstream-tls")
+    add(c.EnableUpstream && len(c.ScheduleRules) > 0, "schedule-rules")
+    add(c.EnableUpstream && c.ShadowUpstream != "", "shadow-upstream")
+    add(c.EnableUpstream && c.ValidatingUpstream != "", "validating-upstream")
+    add(len(c.Hosts) > 0, "hosts")
+    add(len(c.FallbackIPs) > 0, "fallback-ips")
+    add(len(c.RegexRules) > 0, "regex-rules")
+    add(len(c.NameRewrites) > 0, "name-rewrites")
+    add(c.StrictZones, "strict-zones")
+    add(c.SortAnswers, "sort-answers")
+    add(c.SanityCheck, "sanity-check")
+    add(c.K8sResolver != "", "k8s")
+    add(c.HostInternalIP != "" || c.GatewayInternalIP != "", "host-internal")
+    add(c.EnableMetrics, "metrics")
+    add(c.EnableCookies, "cookies")
+    add(c.EnableEDE, "ede")
+    add(c.RRLResponsesPerSec > 0, "rrl")
+    add(c.RateLimitQPS > 0, "rate-limit")
+    add(c.TopClients > 0, "top-clients")
+    add(c.AdminAddr != "", "admin")
+    add(c.MaintenanceMode, "maintenance")
+    add(c.FaultInjectionRate > 0, "fault-injection")
+    return features
+}
+
+// answerFeatures answers TXT queries for the features name under a strip
+// suffix with one string per enabled feature.
+func (p *DNSProxy) answerFeatures(cfg *Config, m *dns.Msg, domain string, qtype uint16) bool {
+    if !cfg.EnableFeaturesTXT {
+        return false
+    }
+    suffix := cfg.stripSuffix(domain)
+    if suffix == "" || domain != featuresNamePrefix+suffix+"." {
+        return false
+    }
+
+    if qtype == dns.TypeTXT || qtype == dns.TypeANY {
+        features := cfg.features()
+        if len(features) == 0 {
+            features = []string{"none"}
+        }
+        m.Answer = append(m.Answer, &dns.TXT{
+            Hdr: dns.RR_Header{Name: domain, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: cfg.SyntheticTTL},
+            Txt: features,
+        })
+    }
+    p.logDebug("Answered features query %s", domain)
+    return true
+}
+
+// maintenanceName is the name answering with the maintenance TXT, by default
+// status under the first strip suffix.
+func (c *Config) maintenanceName() string {
+    name := c.MaintenanceName
+    if name == "" {
+        name = "status" + c.primarySuffix()
+    }
+    return strings.ToLower(dns.Fqdn(name))
+}
+
+func (p *DNSProxy) inMaintenance() bool {
+    return atomic.LoadInt32(&p.maintenance) == 1
+}
+
+func (p *DNSProxy) setMaintenance(enabled bool) {
+    var v int32
+    if enabled {
+        v = 1
+    }
+    if atomic.SwapInt32(&p.maintenance, v) != v {
+        log.Printf("Maintenance mode enabled: %v", enabled)
+    }
+}
+
+// answerMaintenance returns the response to send while in maintenance mode:
+// a TXT with the maintenance message for the maintenance name, and SERVFAIL
+// for everything else when MAINTENANCE_SERVFAIL is set. It returns nil when
+// the query should be resolved normally.
+func (p *DNSProxy) answerMaintenance(cfg *Config, r *dns.Msg, domain string) *dns.Msg {
+    if !p.inMaintenance() {
+        return nil
+    }
+
+    m := new(dns.Msg)
+    m.SetReply(r)
+    m.RecursionAvailable = true
+
+    if domain == cfg.maintenanceName() {
+        if qtype := r.Question[0].Qtype; qtype == dns.TypeTXT || qtype == dns.TypeANY {
+            m.Answer = append(m.Answer, &dns.TXT{
+                Hdr: dns.RR_Header{Name: domain, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: cfg.SyntheticTTL},
+                Txt: []string{cfg.MaintenanceMessage},
+            })
+        }
+        return m
+    }
+
+    if cfg.MaintenanceServfail {
+        p.logDebug("Maintenance mode, returning SERVFAIL for: %s", domain)
+        m.SetRcode(r, dns.RcodeServerFailure)
+        return m
+    }
+    return nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+    "context"
+    "testing"
+
+    "github.com/miekg/dns"
+)
+
+func TestInternalNames(t *testing.T) {
+    tests := []struct {
+        name, host, gateway, query string
+        qtype                      uint16
+        want                       string
+    }{
+        {"host", "192.168.65.2", "", hostInternalName, dns.TypeA, "192.168.65.2"},
+        {"gateway from host", "192.168.65.2", "", gatewayInternalName, dns.TypeA, "192.168.65.2"},
+        {"gateway", "192.168.65.2", "192.168.65.1", gatewayInternalName, dns.TypeA, "192.168.65.1"},
+        {"host AAAA for an IPv4", "192.168.65.2", "", hostInternalName, dns.TypeAAAA, ""},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            p := testProxy(t, "HOST_INTERNAL_IP", tt.host, "GATEWAY_INTERNAL_IP", tt.gateway)
+            m := query(p, tt.query, tt.qtype)
+            if m == nil || m.Rcode != dns.RcodeSuccess {
+                t.Fatalf("got %v, want NOERROR", m)
+            }
+            if ip := answerIP(m); ip != tt.want {
+                t.Errorf("answer %q, want %q", ip, tt.want)
+            }
+        })
+    }
+}
+
+func TestInternalNameFromDocker(t *testing.T) {
+    asked := make(chan string, 1)
+    docker := fakeDNS(t, func(w dns.ResponseWriter, r *dns.Msg) {
+        asked <- r.Question[0].Name
+        answerA("192.168.65.254")(w, r)
+    })
+    p := testProxy(t, "DOCKER_DNS", docker)
+    if ip := answerIP(query(p, hostInternalName, dns.TypeA)); ip != "192.168.65.254" {
+        t.Errorf("answer %q, want Docker's 192.168.65.254", ip)
+    }
+    if name := <-asked; name != hostInternalName {
+        t.Errorf("Docker DNS asked for %q, want the full %s", name, hostInternalName)
+    }
+}
+
+// A Docker DNS outage is a failure, not proof that the name doesn't exist.
+func TestInternalNameDockerError(t *testing.T) {
+    // DOCKER_DNS stays on the port nothing listens on
+    p := testProxy(t)
+    r := new(dns.Msg)
+    r.SetQuestion(hostInternalName, dns.TypeA)
+    m, failed := p.lookup(context.Background(), p.config(), r)
+    if m.Rcode != dns.RcodeServerFailure || !failed {
+        t.Errorf("got %s, failed %v, want SERVFAIL and failed", dns.RcodeToString[m.Rcode], failed)
+    }
+}
+
+func TestFeaturesTXT(t *testing.T) {
+    tests := []struct {
+        name    string
+        enabled string
+        query   string
+        want    bool
+    }{
+        {"off by default", "", "_features.dns-proxy.docker.", false},
+        {"under the strip suffix", "true", "_features.dns-proxy.docker.", true},
+        {"without a strip suffix", "true", "_features.dns-proxy.", false},
+        {"under another suffix", "true", "_features.dns-proxy.example.", false},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            p := testProxy(t, "ENABLE_FEATURES_TXT", tt.enabled, "TIMEOUT_SECONDS", "1")
+            m := query(p, tt.query, dns.TypeTXT)
+            answered := m != nil && len(m.Answer) == 1 && m.Answer[0].Header().Rrtype == dns.TypeTXT
+            if answered != tt.want {
+                t.Errorf("answered %v, want %v: %v", answered, tt.want, m)
+            }
+        })
+    }
+}
+
+func TestFeaturesTXTListsEnabledOptions(t *testing.T) {
+    p := testProxy(t, "ENABLE_FEATURES_TXT", "true", "CACHE_ENABLED", "true", "STALE_IF_ERROR_TTL", "30",
+        "ENABLE_UPSTREAM", "false", "SORT_ANSWERS", "true", "SANITY_CHECK", "false")
+    m := query(p, "_features.dns-proxy.docker.", dns.TypeTXT)
+    if m == nil || len(m.Answer) != 1 {
+        t.Fatalf("got %v, want the features TXT", m)
+    }
+    features := map[string]bool{}
+    for _, feature := range m.Answer[0].(*dns.TXT).Txt {
+        features[feature] = true
+    }
+    for _, want := range []string{"cache", "stale-if-error", "sort-answers"} {
+        if !features[want] {
+            t.Errorf("features %v lack %s", features, want)
+        }
+    }
+    for _, unwanted := range []string{"upstream", "refresh-ahead", "sanity-check", "metrics"} {
+        if features[unwanted] {
+            t.Errorf("features %v list disabled %s", features, unwanted)
+        }
+    }
+    if ttl := m.Answer[0].Header().Ttl; ttl != p.config().SyntheticTTL {
+        t.Errorf("TTL %d, want SYNTHETIC_TTL %d", ttl, p.config().SyntheticTTL)
+    }
+}
+
+func TestMaintenanceMode(t *testing.T) {
+    p := testProxy(t, "MAINTENANCE_MODE", "true", "MAINTENANCE_MESSAGE", "back at 10:00",
+        "MAINTENANCE_SERVFAIL", "true", "HOST_INTERNAL_IP", "192.0.2.1")
+
+    m := query(p, "status.docker.", dns.TypeTXT)
+    if m == nil || len(m.Answer) != 1 {
+        t.Fatalf("got %v, want the maintenance TXT", m)
+    }
+    if txt := m.Answer[0].(*dns.TXT).Txt; len(txt) != 1 || txt[0] != "back at 10:00" {
+        t.Errorf("maintenance TXT %q, want MAINTENANCE_MESSAGE", txt)
+    }
+    if m := query(p, hostInternalName, dns.TypeA); m.Rcode != dns.RcodeServerFailure {
+        t.Errorf("got %s during maintenance, want SERVFAIL", dns.RcodeToString[m.Rcode])
+    }
+
+    p.setMaintenance(false)
+    if ip := answerIP(query(p, hostInternalName, dns.TypeA)); ip != "192.0.2.1" {
+        t.Errorf("answer %q after maintenance, want 192.0.2.1", ip)
+    }
+    if m := query(p, "status.docker.", dns.TypeTXT); len(m.Answer) != 0 {
+        t.Errorf("maintenance TXT still answered after maintenance: %v", m.Answer)
+    }
+}
+
+func TestSyntheticTTL(t *testing.T) {
+    p := testProxy(t, "SYNTHETIC_TTL", "42", "HOST_INTERNAL_IP", "192.0.2.1",
+        "STATIC_HOSTS", "web.docker=10.0.0.99", "ENABLE_FEATURES_TXT", "true")
+    for _, q := range []struct {
+        name  string
+        qtype uint16
+    }{
+        {hostInternalName, dns.TypeA},
+        {gatewayInternalName, dns.TypeA},
+        {"web.docker.", dns.TypeA},
+        {featuresNamePrefix + ".docker.", dns.TypeTXT},
+    } {
+        m := query(p, q.name, q.qtype)
+        if m == nil || len(m.Answer) == 0 {
+            t.Errorf("%s: got %v, want a synthesized answer", q.name, m)
+            continue
+        }
+        for _, rr := range m.Answer {
+            if ttl := rr.Header().Ttl; ttl != 42 {
+                t.Errorf("%s: TTL %d, want SYNTHETIC_TTL 42", q.name, ttl)
+            }
+        }
+    }
+
+    p = testProxy(t, "SYNTHETIC_TTL", "42", "MAINTENANCE_MODE", "true", "ENABLE_FEATURES_TXT", "false")
+    m := query(p, "status.docker.", dns.TypeTXT)
+    if m == nil || len(m.Answer) != 1 {
+        t.Fatalf("got %v, want the maintenance TXT", m)
+    }
+    if ttl := m.Answer[0].Header().Ttl; ttl != 42 {
+        t.Errorf("maintenance TXT TTL %d, want SYNTHETIC_TTL 42", ttl)
+    }
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+    "testing"
+    "time"
+
+    "github.com/miekg/dns"
+)
+
+func TestRequestTimeoutBoundsLookups(t *testing.T) {
+    silent := func(w dns.ResponseWriter, r *dns.Msg) {}
+    docker := fakeDNS(t, silent) + "," + fakeDNS(t, silent)
+    upstream := fakeDNS(t, silent)
+    p := testProxy(t, "DOCKER_DNS", docker, "ENABLE_UPSTREAM", "true", "UPSTREAM_DNS", upstream,
+        "FALLBACK_TO_UPSTREAM", "true", "TIMEOUT_SECONDS", "2", "REQUEST_TIMEOUT_SECONDS", "1")
+
+    // Two Docker DNS servers and the upstream at 2s each would take 6s
+    start := time.Now()
+    m := query(p, "web.docker.", dns.TypeA)
+    if took := time.Since(start); took > 1500*time.Millisecond {
+        t.Errorf("query took %v, want about REQUEST_TIMEOUT_SECONDS", took)
+    }
+    if m == nil || len(m.Answer) != 0 {
+        t.Errorf("got %v, want a reply without answers", m)
+    }
+}
+
+func TestQtypeTimeouts(t *testing.T) {
+    silent := fakeDNS(t, func(w dns.ResponseWriter, r *dns.Msg) {})
+    p := testProxy(t, "ENABLE_UPSTREAM", "true", "UPSTREAM_DNS", silent,
+        "TIMEOUT_SECONDS", "2", "QTYPE_TIMEOUTS", "TXT=1")
+
+    cfg := p.config()
+    if got := cfg.timeoutFor(dns.TypeTXT); got != time.Second {
+        t.Errorf("TXT timeout %v, want its QTYPE_TIMEOUTS 1s", got)
+    }
+    if got := cfg.timeoutFor(dns.TypeA); got != 2*time.Second {
+        t.Errorf("A timeout %v, want TIMEOUT_SECONDS 2s", got)
+    }
+
+    for _, tt := range []struct {
+        qtype    uint16
+        min, max time.Duration
+    }{
+        {dns.TypeTXT, 900 * time.Millisecond, 1500 * time.Millisecond},
+        {dns.TypeA, 1900 * time.Millisecond, 2500 * time.Millisecond},
+    } {
+        start := time.Now()
+        query(p, "example.com.", tt.qtype)
+        if took := time.Since(start); took < tt.min || took > tt.max {
+            t.Errorf("%s query gave up after %v, want between %v and %v", dns.TypeToString[tt.qtype], took, tt.min, tt.max)
+        }
+    }
+}
+
+func TestQtypeTimeoutsClampedToMinimum(t *testing.T) {
+    t.Setenv("QTYPE_TIMEOUTS", "AAAA=0,TXT=3")
+    config := loadConfig()
+    if got := config.QtypeTimeouts[dns.TypeAAAA]; got != minTimeout {
+        t.Errorf("QTYPE_TIMEOUTS AAAA=0 gave %v, want %v", got, minTimeout)
+    }
+    if got := config.QtypeTimeouts[dns.TypeTXT]; got != 3*time.Second {
+        t.Errorf("QTYPE_TIMEOUTS TXT=3 gave %v, want 3s unchanged", got)
+    }
+}
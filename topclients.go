@@ -0,0 +1,89 @@
+package main
+
+import (
+    "sort"
+    "sync"
+)
+
+// Clients tracked per top client reported, so that clients just outside the
+// top still have a count when they overtake one inside it
+const topClientsSlack = 4
+
+type clientCount struct {
+    Client  string `json:"client"`
+    Queries int64  `json:"queries"`
+}
+
+// topClients finds the clients sending the most queries with the
+// space-saving algorithm: it counts at most a fixed number of clients, and a
+// new client takes over the slot of the least busy one, inheriting its count.
+// Counts are upper bounds, but a client sending more than its share of
+// queries is never missed, and memory stays bounded however many clients
+// there are.
+type topClients struct {
+    mu     sync.Mutex
+    max    int
+    counts map[string]int64
+}
+
+func newTopClients(n int) *topClients {
+    t := &topClients{counts: make(map[string]int64)}
+    t.setSize(n)
+    return t
+}
+
+// setSize changes the number of top clients reported. A smaller size takes
+// effect as new clients come in.
+func (t *topClients) setSize(n int) {
+    t.mu.Lock()
+    t.max = n * topClientsSlack
+    t.mu.Unlock()
+}
+
+func (t *topClients) record(client string) {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+
+    if _, ok := t.counts[client]; !ok {
+        var inherited int64
+        for len(t.counts) > 0 && len(t.counts) >= t.max {
+            inherited = t.evictLocked()
+        }
+        t.counts[client] = inherited
+    }
+    t.counts[client]++
+}
+
+// evictLocked drops the client with the lowest count and returns the count.
+func (t *topClients) evictLocked() int64 {
+    var minClient string
+    var min int64 = -1
+    for c, n := range t.counts {
+        if min < 0 || n < min {
+            minClient, min = c, n
+        }
+    }
+    delete(t.counts, minClient)
+    return min
+}
+
+// top returns up to n clients, busiest first.
+func (t *topClients) top(n int) []clientCount {
+    t.mu.Lock()
+    clients := make([]clientCount, 0, len(t.counts))
+    for c, queries := range t.counts {
+        clients = append(clients, clientCount{c, queries})
+    }
+    t.mu.Unlock()
+
+    sort.Slice(clients, func(i, j int) bool {
+        if clients[i].Queries != clients[j].Queries {
+            return clients[i].Queries > clients[j].Queries
+        }
+        return clients[i].Client < clients[j].Client
+    })
+    if len(clients) > n {
+        clients = clients[:n]
+    }
+    return clients
+}
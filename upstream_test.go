@@ -0,0 +1,152 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "net"
+    "sync/atomic"
+    "testing"
+    "time"
+
+    "github.com/miekg/dns"
+)
+
+// answerEmpty answers every question with NOERROR and no records.
+func answerEmpty(w dns.ResponseWriter, r *dns.Msg) {
+    m := new(dns.Msg)
+    m.SetReply(r)
+    w.WriteMsg(m)
+}
+
+func TestEmptyUpstreamRetry(t *testing.T) {
+    empty := fakeDNS(t, answerEmpty)
+    full := fakeDNS(t, answerA("192.0.2.1"))
+
+    for _, tt := range []struct {
+        retry string
+        want  string
+    }{
+        {"true", "192.0.2.1"},
+        {"false", ""},
+    } {
+        p := testProxy(t, "ENABLE_UPSTREAM", "true", "UPSTREAM_DNS", empty+","+full, "EMPTY_UPSTREAM_RETRY", tt.retry)
+        m := query(p, "example.com.", dns.TypeA)
+        if m == nil || m.Rcode != dns.RcodeSuccess {
+            t.Fatalf("EMPTY_UPSTREAM_RETRY=%s: got %v, want NOERROR", tt.retry, m)
+        }
+        if ip := answerIP(m); ip != tt.want {
+            t.Errorf("EMPTY_UPSTREAM_RETRY=%s: answer %q, want %q", tt.retry, ip, tt.want)
+        }
+    }
+}
+
+func TestUpstreamRecordCaps(t *testing.T) {
+    upstream := fakeDNSBoth(t, func(w dns.ResponseWriter, r *dns.Msg) {
+        m := new(dns.Msg)
+        m.SetReply(r)
+        if isUDP(w.RemoteAddr()) {
+            m.Truncated = true
+            w.WriteMsg(m)
+            return
+        }
+        for i := 0; i < 3000; i++ {
+            m.Answer = append(m.Answer, &dns.A{
+                Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 30},
+                A:   net.IPv4(10, byte(i>>16), byte(i>>8), byte(i)),
+            })
+        }
+        ns, _ := dns.NewRR("example.com. 30 IN NS ns.example.com.")
+        m.Ns = append(m.Ns, ns, ns)
+        m.Compress = true
+        w.WriteMsg(m)
+    })
+    p := testProxy(t, "ENABLE_UPSTREAM", "true", "UPSTREAM_DNS", upstream,
+        "UPSTREAM_MAX_ANSWERS", "100", "UPSTREAM_MAX_AUTHORITY", "1")
+
+    r := new(dns.Msg)
+    r.SetQuestion("big.example.com.", dns.TypeA)
+    w := &responseRecorder{local: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}, remote: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}}
+    p.handleRequest(w, r)
+    if w.msg == nil || w.msg.Rcode != dns.RcodeSuccess {
+        t.Fatalf("got %v, want NOERROR", w.msg)
+    }
+    if n := len(w.msg.Answer); n != 100 {
+        t.Errorf("%d answers, want UPSTREAM_MAX_ANSWERS 100", n)
+    }
+    if n := len(w.msg.Ns); n != 1 {
+        t.Errorf("%d authority records, want UPSTREAM_MAX_AUTHORITY 1", n)
+    }
+}
+
+func TestConsistentHashSelection(t *testing.T) {
+    t.Setenv("UPSTREAM_DNS", "10.0.0.1,10.0.0.2,10.0.0.3")
+    t.Setenv("UPSTREAM_SELECTION", "consistent-hash")
+    cfg := loadConfig()
+
+    first := map[string]int{}
+    for i := 0; i < 300; i++ {
+        name := fmt.Sprintf("host%d.example.com.", i)
+        order := cfg.upstreamsFor(name)
+        if len(order) != 3 {
+            t.Fatalf("%s got %d upstreams, want all 3 for failover", name, len(order))
+        }
+        for j := 0; j < 3; j++ {
+            again := cfg.upstreamsFor(name)
+            if again[0] != order[0] {
+                t.Fatalf("%s went to %s, then %s", name, order[0], again[0])
+            }
+        }
+        first[order[0]]++
+    }
+    for _, upstream := range cfg.UpstreamDNS {
+        if n := first[upstream]; n < 50 {
+            t.Errorf("%s is first for %d of 300 names, want them spread across upstreams", upstream, n)
+        }
+    }
+}
+
+func TestHealthGatedUpstream(t *testing.T) {
+    var failing int32 = 1
+    var answered int64
+    first := fakeDNS(t, func(w dns.ResponseWriter, r *dns.Msg) {
+        if atomic.LoadInt32(&failing) != 0 {
+            w.Write([]byte{0, 1, 2})
+            return
+        }
+        if r.Question[0].Qtype == dns.TypeA {
+            atomic.AddInt64(&answered, 1)
+        }
+        answerA("192.0.2.1")(w, r)
+    })
+    second := fakeDNS(t, answerA("192.0.2.2"))
+    p := testProxy(t, "ENABLE_UPSTREAM", "true", "UPSTREAM_DNS", first+","+second,
+        "UPSTREAM_HEALTHCHECK_INTERVAL", "1")
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+    go p.checkUpstreams(ctx)
+
+    waitHealth := func(healthy bool) {
+        deadline := time.Now().Add(3 * time.Second)
+        for p.upstreamHealthy(first) != healthy {
+            if time.Now().After(deadline) {
+                t.Fatalf("%s never became %s", first, healthString(healthy))
+            }
+            time.Sleep(10 * time.Millisecond)
+        }
+    }
+
+    waitHealth(false)
+    // Recovered, but skipped until the next health check says so
+    atomic.StoreInt32(&failing, 0)
+    if ip := answerIP(query(p, "example.com.", dns.TypeA)); ip != "192.0.2.2" {
+        t.Errorf("with %s unhealthy answered %q, want 192.0.2.2", first, ip)
+    }
+    if n := atomic.LoadInt64(&answered); n != 0 {
+        t.Errorf("unhealthy upstream got %d queries, want 0", n)
+    }
+
+    waitHealth(true)
+    if ip := answerIP(query(p, "example.com.", dns.TypeA)); ip != "192.0.2.1" {
+        t.Errorf("after a successful health check answered %q, want 192.0.2.1", ip)
+    }
+}
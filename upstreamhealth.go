@@ -0,0 +1,72 @@
+package main
+
+import (
+    "context"
+    "log"
+    "time"
+)
+
+// upstreamHealthy reports whether the last health check of upstream
+// succeeded. Upstreams not checked yet count as healthy.
+func (p *DNSProxy) upstreamHealthy(upstream string) bool {
+    p.healthMu.Lock()
+    defer p.healthMu.Unlock()
+
+    return !p.unhealthy[upstream]
+}
+
+func (p *DNSProxy) setUpstreamHealth(upstream string, healthy bool) {
+    p.healthMu.Lock()
+    changed := p.unhealthy[upstream] == healthy
+    if healthy {
+        delete(p.unhealthy, upstream)
+    } else {
+        p.unhealthy[upstream] = true
+    }
+    p.healthMu.Unlock()
+
+    p.metrics.setUpstreamHealth(upstream, healthy)
+    if changed {
+        log.Printf("Upstream DNS %s is now %s", upstream, healthString(healthy))
+    }
+}
+
+func healthString(healthy bool) string {
+    if healthy {
+        return "healthy"
+    }
+    return "unhealthy"
+}
+
+// checkUpstreams probes every upstream each UPSTREAM_HEALTHCHECK_INTERVAL,
+// so forwardToUpstream can skip the unreachable ones instead of waiting for
+// them to time out. It returns when ctx is cancelled.
+func (p *DNSProxy) checkUpstreams(ctx context.Context) {
+    for {
+        // Re-read on every round so a reload can change the interval
+        wait := p.config().UpstreamHealthInterval
+        if wait <= 0 {
+            wait = time.Second
+        }
+        select {
+        case <-time.After(wait):
+        case <-ctx.Done():
+            return
+        }
+
+        cfg := p.config()
+        if cfg.UpstreamHealthInterval <= 0 || !p.upstreamEnabled() {
+            continue
+        }
+        for upstream, result := range probeAll(ctx, cfg, cfg.allUpstreams()) {
+            if ctx.Err() != nil {
+                return
+            }
+            healthy := result == "ok"
+            if !healthy {
+                p.logDebug("Health check of upstream DNS %s failed: %s", upstream, result)
+            }
+            p.setUpstreamHealth(upstream, healthy)
+        }
+    }
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+    "fmt"
+    "net"
+    "strconv"
+    "strings"
+)
+
+// validate reports the first setting that would leave the server half
+// broken: an address that isn't host:port, a port out of range, an unknown
+// log level or a timeout that isn't positive.
+func (c *Config) validate() error {
+    if err := validPort("LISTEN_PORT", c.ListenPort); err != nil {
+        return err
+    }
+    if strings.Contains(c.ListenAddr, ":") && net.ParseIP(c.ListenAddr) == nil {
+        return fmt.Errorf("LISTEN_ADDR: %q is not a host, give the port in LISTEN_PORT", c.ListenAddr)
+    }
+    if len(c.DockerDNS) == 0 {
+        return fmt.Errorf("DOCKER_DNS: no servers given")
+    }
+    if err := validAddrs("DOCKER_DNS", c.DockerDNS); err != nil {
+        return err
+    }
+    if err := validAddrs("UPSTREAM_DNS", c.UpstreamDNS); err != nil {
+        return err
+    }
+    for _, rule := range c.ScheduleRules {
+        if err := validAddrs("SCHEDULE_RULES", rule.upstreams); err != nil {
+            return err
+        }
+    }
+    for _, setting := range []struct{ key, addr string }{
+        {"DOCKER_DNS_V4", c.DockerDNSV4},
+        {"DOCKER_DNS_V6", c.DockerDNSV6},
+        {"SHADOW_UPSTREAM", c.ShadowUpstream},
+        {"VALIDATING_UPSTREAM", c.ValidatingUpstream},
+        {"K8S_RESOLVER", c.K8sResolver},
+    } {
+        if setting.addr == "" {
+            continue
+        }
+        if err := validAddrs(setting.key, []string{setting.addr}); err != nil {
+            return err
+        }
+    }
+    if !logLevels[strings.ToUpper(c.LogLevel)] {
+        return fmt.Errorf("LOG_LEVEL: unknown level %q, expected DEBUG, INFO or ERROR", c.LogLevel)
+    }
+    if c.Timeout <= 0 {
+        return fmt.Errorf("TIMEOUT_SECONDS: must be positive, got %v", c.Timeout)
+    }
+    if c.RequestTimeout <= 0 {
+        return fmt.Errorf("REQUEST_TIMEOUT_SECONDS: must be positive, got %v", c.RequestTimeout)
+    }
+    return nil
+}
+
+func validAddrs(key string, addrs []string) error {
+    for _, addr := range addrs {
+        _, port, err := net.SplitHostPort(addr)
+        if err != nil {
+            return fmt.Errorf("%s: %q is not host:port: %v", key, addr, err)
+        }
+        if err := validPort(key, port); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func validPort(key, port string) error {
+    n, err := strconv.Atoi(port)
+    if err != nil {
+        return fmt.Errorf("%s: port %q is not a number", key, port)
+    }
+    if n < 1 || n > 65535 {
+        return fmt.Errorf("%s: port %d out of range 1-65535", key, n)
+    }
+    return nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+    "strings"
+    "testing"
+)
+
+func TestValidate(t *testing.T) {
+    tests := []struct {
+        name string
+        env  []string
+        want string // substring of the error, empty for a valid config
+    }{
+        {"defaults", nil, ""},
+        {"listen port not a number", []string{"LISTEN_PORT", "dns"}, "LISTEN_PORT"},
+        {"listen port out of range", []string{"LISTEN_PORT", "70000"}, "LISTEN_PORT"},
+        {"listen addr with port", []string{"LISTEN_ADDR", "0.0.0.0:53"}, "LISTEN_ADDR"},
+        {"docker dns without port", []string{"DOCKER_DNS", "127.0.0.11"}, "DOCKER_DNS"},
+        {"docker dns bad port", []string{"DOCKER_DNS", "127.0.0.11:0"}, "DOCKER_DNS"},
+        {"upstream bad port", []string{"UPSTREAM_DNS", "8.8.8.8:dns"}, "UPSTREAM_DNS"},
+        {"upstream without port", []string{"UPSTREAM_DNS", "8.8.8.8"}, ""},
+        {"schedule upstream bad port", []string{"SCHEDULE_RULES", "09:00-18:00=10.0.0.53:99999"}, "SCHEDULE_RULES"},
+        {"docker dns v4 without port", []string{"DOCKER_DNS_V4", "127.0.0.11"}, ""},
+        {"docker dns v4 bad port", []string{"DOCKER_DNS_V4", "127.0.0.11:x"}, "DOCKER_DNS_V4"},
+        {"docker dns v6 without port", []string{"DOCKER_DNS_V6", "::1"}, ""},
+        {"docker dns v6 bad port", []string{"DOCKER_DNS_V6", "[::1]:0"}, "DOCKER_DNS_V6"},
+        {"shadow upstream without port", []string{"SHADOW_UPSTREAM", "10.0.0.53"}, ""},
+        {"shadow upstream bad port", []string{"SHADOW_UPSTREAM", "10.0.0.53:x"}, "SHADOW_UPSTREAM"},
+        {"validating upstream bad port", []string{"VALIDATING_UPSTREAM", "10.0.0.53:70000"}, "VALIDATING_UPSTREAM"},
+        {"k8s resolver without port", []string{"K8S_RESOLVER", "10.96.0.10"}, ""},
+        {"k8s resolver bad port", []string{"K8S_RESOLVER", "10.96.0.10:x"}, "K8S_RESOLVER"},
+        {"unknown log level", []string{"LOG_LEVEL", "VERBOSE"}, "LOG_LEVEL"},
+        {"lowercase log level", []string{"LOG_LEVEL", "debug"}, ""},
+        {"zero timeout", []string{"TIMEOUT_SECONDS", "0"}, "TIMEOUT_SECONDS"},
+        {"negative timeout", []string{"TIMEOUT_SECONDS", "-1"}, "TIMEOUT_SECONDS"},
+        {"zero request timeout", []string{"REQUEST_TIMEOUT_SECONDS", "0"}, "REQUEST_TIMEOUT_SECONDS"},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            t.Setenv("DOCKER_DNS", "127.0.0.11:53")
+            for i := 0; i+1 < len(tt.env); i += 2 {
+                t.Setenv(tt.env[i], tt.env[i+1])
+            }
+            err := loadConfig().validate()
+            switch {
+            case tt.want == "" && err != nil:
+                t.Errorf("unexpected error: %v", err)
+            case tt.want != "" && err == nil:
+                t.Errorf("no error, want one for %s", tt.want)
+            case tt.want != "" && !strings.HasPrefix(err.Error(), tt.want+":"):
+                t.Errorf("error %q is not about %s", err, tt.want)
+            }
+        })
+    }
+}
+
+func TestDefaultPorts(t *testing.T) {
+    t.Setenv("DOCKER_DNS_V4", "127.0.0.11")
+    t.Setenv("DOCKER_DNS_V6", "::1")
+    t.Setenv("SHADOW_UPSTREAM", "10.0.0.53:5353")
+    t.Setenv("K8S_RESOLVER", "10.96.0.10")
+    config := loadConfig()
+    for _, tt := range []struct{ key, got, want string }{
+        {"DOCKER_DNS_V4", config.DockerDNSV4, "127.0.0.11:53"},
+        {"DOCKER_DNS_V6", config.DockerDNSV6, "[::1]:53"},
+        {"SHADOW_UPSTREAM", config.ShadowUpstream, "10.0.0.53:5353"},
+        {"K8S_RESOLVER", config.K8sResolver, "10.96.0.10:53"},
+    } {
+        if tt.got != tt.want {
+            t.Errorf("%s = %s, want %s", tt.key, tt.got, tt.want)
+        }
+    }
+    if config.ValidatingUpstream != "" {
+        t.Errorf("unset VALIDATING_UPSTREAM became %q", config.ValidatingUpstream)
+    }
+}